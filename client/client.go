@@ -15,6 +15,22 @@ import (
 	"github.com/kwilteam/kwil-db/core/log"
 )
 
+// InvalidMessageError is returned by ReadMessage if a message cannot be
+// decoded. The connection is still usable.
+type InvalidMessageError struct {
+	// Payload is the raw message.
+	Payload []byte
+	Err     error
+}
+
+func (e *InvalidMessageError) Error() string {
+	return fmt.Sprintf("failed to unmarshal message: %v", e.Err)
+}
+
+func (e *InvalidMessageError) Unwrap() error {
+	return e.Err
+}
+
 // Client is a Streamr client. It is meant to connect to a Streamr websocket server.
 // One client should be used for each stream subscription.
 // It is a thin wrapper around the gorilla/websocket.Conn type that handles connection
@@ -23,7 +39,8 @@ type Client struct {
 	conn   *websocket.Conn
 	mu     sync.Mutex // mu protects all methods.
 	config *ClientConfig
-	url    string
+	// url is the URL of the stream's subscription, without a resend.
+	url string
 }
 
 // NewClient creates a new Streamr client.
@@ -37,11 +54,15 @@ func NewClient(ctx context.Context, streamrWebsocketUrl, streamID string, opts *
 		conf.Apply(opts)
 	}
 
-	path := "/streams/" + url.PathEscape(streamID) + "/subscribe"
-	if opts.ApiKey != nil {
-		path += "?apiKey=" + *opts.ApiKey
+	c := &Client{
+		config: conf,
+		url:    streamrWebsocketUrl + "/streams/" + url.PathEscape(streamID) + "/subscribe",
+	}
+
+	fullUrl, err := c.subscribeURL(conf.ResendFrom, conf.ResendLast)
+	if err != nil {
+		return nil, err
 	}
-	fullUrl := streamrWebsocketUrl + path
 
 	conn, req, err := websocket.DefaultDialer.DialContext(ctx, fullUrl, nil)
 	if err != nil {
@@ -49,11 +70,44 @@ func NewClient(ctx context.Context, streamrWebsocketUrl, streamID string, opts *
 	}
 	defer req.Body.Close()
 
-	return &Client{
-		conn:   conn,
-		config: opts,
-		url:    fullUrl,
-	}, nil
+	c.conn = conn
+	return c, nil
+}
+
+// subscribeURL returns the URL of the subscription, with an optional
+// resend from a position, or of the last messages.
+func (c *Client) subscribeURL(from *ResendPosition, last *int) (string, error) {
+	query := url.Values{}
+	if c.config.ApiKey != nil {
+		query.Set("apiKey", *c.config.ApiKey)
+	}
+	if from != nil || last != nil {
+		resend := map[string]any{"from": from}
+		if from == nil {
+			resend = map[string]any{"last": *last}
+		}
+		bts, err := json.Marshal(resend)
+		if err != nil {
+			return "", err
+		}
+		query.Set("resend", string(bts))
+	}
+
+	if len(query) == 0 {
+		return c.url, nil
+	}
+	return c.url + "?" + query.Encode(), nil
+}
+
+// reconnectURL returns the URL that the client reconnects with. The resend
+// that the client was created with is not repeated, since it would read
+// the messages since the original start again. The client only resends
+// from the position returned by ReconnectFrom, if it is set.
+func (c *Client) reconnectURL() (string, error) {
+	if c.config.ReconnectFrom == nil {
+		return c.subscribeURL(nil, nil)
+	}
+	return c.subscribeURL(c.config.ReconnectFrom(), nil)
 }
 
 // Close closes the client's connection.
@@ -85,12 +139,20 @@ func (c *Client) readMessage() (ev *StreamrEvent, err error) {
 			Jitter: true,
 		}
 
+		reconnectUrl, err := c.reconnectURL()
+		if err != nil {
+			return nil, err
+		}
+
 		for i := 0; i < *c.config.MaxRetrys; i++ {
 			time.Sleep(b.Duration())
 			c.conn.Close()
-			c.conn, _, err = websocket.DefaultDialer.Dial(c.url, nil)
+			c.conn, _, err = websocket.DefaultDialer.Dial(reconnectUrl, nil)
 			if err == nil {
 				c.config.Logger.Info("reconnected to Streamr node, retrying readMessage")
+				if c.config.OnReconnect != nil {
+					c.config.OnReconnect()
+				}
 				// if reconnection is successful, try to read again
 				return c.readMessage()
 			}
@@ -105,7 +167,7 @@ func (c *Client) readMessage() (ev *StreamrEvent, err error) {
 	ev = &StreamrEvent{}
 	err = json.Unmarshal(p, ev)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal message: %v", err)
+		return nil, &InvalidMessageError{Payload: p, Err: err}
 	}
 
 	return ev, nil
@@ -127,6 +189,34 @@ type ClientConfig struct {
 	MaxRetryDelay *time.Duration
 	// Logger is the logger to use for the client.
 	Logger *log.SugaredLogger
+	// ResendFrom asks the Streamr node to resend the messages published
+	// since this position before sending live messages. It is only used
+	// for the first connection. It is optional.
+	ResendFrom *ResendPosition
+	// OnReconnect is called each time the client reconnects to the
+	// Streamr node. It is optional.
+	OnReconnect func()
+	// ResendLast asks the Streamr node to resend this many of the latest
+	// messages before sending live messages. It is ignored if ResendFrom
+	// is set. Like ResendFrom, it is only used for the first connection.
+	// It is optional.
+	ResendLast *int
+	// ReconnectFrom returns the position that the client resends from when
+	// it reconnects, such as the latest position that the reader has
+	// handled. If it is nil, or returns nil, the client reconnects with
+	// live messages only. Readers must skip messages that they have already
+	// seen. It is optional.
+	ReconnectFrom func() *ResendPosition
+}
+
+// ResendPosition is a position in a stream that messages can be resent
+// from.
+type ResendPosition struct {
+	// Timestamp is the timestamp of the first message to resend.
+	Timestamp int64 `json:"timestamp"`
+	// SequenceNumber is the sequence number of the first message to
+	// resend, among the messages with the same timestamp.
+	SequenceNumber int64 `json:"sequenceNumber"`
 }
 
 // Apply applies non-default values from the given configuration to the config.
@@ -146,6 +236,18 @@ func (c *ClientConfig) Apply(config *ClientConfig) {
 	if config.Logger != nil {
 		c.Logger = config.Logger
 	}
+	if config.ResendFrom != nil {
+		c.ResendFrom = config.ResendFrom
+	}
+	if config.ResendLast != nil {
+		c.ResendLast = config.ResendLast
+	}
+	if config.OnReconnect != nil {
+		c.OnReconnect = config.OnReconnect
+	}
+	if config.ReconnectFrom != nil {
+		c.ReconnectFrom = config.ReconnectFrom
+	}
 
 }
 
@@ -171,9 +273,11 @@ type StreamrEvent struct {
 	// Metadata is the metadata of the event, provided
 	// by the Streamr network.
 	Metadata struct {
-		Timestamp      int64  `json:"timestamp"`
-		SequenceNumber int64  `json:"sequenceNumber"`
-		PublisherID    string `json:"publisherId"`
-		MsgChainID     string `json:"msgChainId"`
+		StreamID        string `json:"streamId"`
+		StreamPartition int64  `json:"streamPartition"`
+		Timestamp       int64  `json:"timestamp"`
+		SequenceNumber  int64  `json:"sequenceNumber"`
+		PublisherID     string `json:"publisherId"`
+		MsgChainID      string `json:"msgChainId"`
 	} `json:"metadata"`
 }
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+func newCursorsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cursors",
+		Short: "Inspect the committed Streamr cursors",
+		Long: `Cursors are the positions of the latest events applied per stream, target
+and message chain. They are committed by the resolution, so they are the same
+on every node, and listeners with the "cursor" config resume from them.`,
+	}
+
+	cmd.AddCommand(newListCursorsCmd())
+	return cmd
+}
+
+func newListCursorsCmd() *cobra.Command {
+	var conn pgFlags
+	var stream, dbid, target string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the committed cursors",
+		Long:  "List the committed cursors, read from the node's local database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := conn.connect(ctx)
+			if err != nil {
+				return err
+			}
+			defer db.Close(context.Background())
+
+			// targets are recorded in lowercase, as they are allowed
+			rows, err := db.Query(ctx, resolution.ListCursors, stream, dbid, strings.ToLower(target))
+			if err != nil {
+				return fmt.Errorf("failed to list cursors: %w", err)
+			}
+			defer rows.Close()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STREAM\tDBID\tTARGET\tPUBLISHER\tCHAIN\tSTREAM TIME\tSEQUENCE")
+			for rows.Next() {
+				var stream, dbid, target, publisher, chain string
+				var streamTime, sequence int64
+				if err := rows.Scan(&stream, &dbid, &target, &publisher, &chain, &streamTime, &sequence); err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", stream, dbid, target, publisher, chain, streamTime, sequence)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			return w.Flush()
+		},
+	}
+
+	conn.bind(cmd)
+	cmd.Flags().StringVar(&stream, "stream", "", "only list cursors of this stream")
+	cmd.Flags().StringVar(&dbid, "dbid", "", "only list cursors that target this database")
+	cmd.Flags().StringVar(&target, "target", "", "only list cursors of this target, regardless of case")
+	return cmd
+}
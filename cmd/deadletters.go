@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kwilteam/kwil-streamr/extensions/listener"
+)
+
+func newDeadLettersCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "deadletters",
+		Short: "Inspect and replay the Streamr dead letters",
+		Long: `Dead letters are the Streamr messages that the listener could not turn into
+events, for example because a mapped field was missing. They are written to
+the "dead_letter_dir" of the listener, on the node that received them.`,
+	}
+
+	cmd.AddCommand(newListDeadLettersCmd(), newReplayDeadLettersCmd())
+	return cmd
+}
+
+func newListDeadLettersCmd() *cobra.Command {
+	var dir string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the dead letters",
+		Long:  "List the dead letters of a dead letter directory, oldest first.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files, err := listener.DeadLetterFiles(dir)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "TIME\tSTAGE\tMAPPING\tPUBLISHER\tSTREAM TIME\tSEQUENCE\tERROR")
+			for _, file := range files {
+				err := listener.ReadDeadLetters(file, func(dl *listener.DeadLetter) error {
+					var publisher string
+					var streamTime, sequence int64
+					if dl.Message != nil {
+						publisher, streamTime, sequence = dl.Message.Metadata.PublisherID, dl.Message.Metadata.Timestamp, dl.Message.Metadata.SequenceNumber
+					}
+					_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", dl.Time.Format(time.RFC3339), dl.Stage, dl.Mapping, publisher, streamTime, sequence, dl.Error)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			return w.Flush()
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "the dead_letter_dir of the listener")
+	cmd.MarkFlagRequired("dir")
+	return cmd
+}
+
+func newReplayDeadLettersCmd() *cobra.Command {
+	var dir string
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Queue the dead letters to be re-processed",
+		Long: `Queue the dead letters to be re-processed by the listener the next time it
+starts, with its configuration at that time. This should be run while the node
+is stopped, typically after fixing the mapping that the messages failed on.
+Messages that fail again are written back to the dead letters.
+
+Each node only re-processes its own dead letters, so the messages only reach
+the resolution threshold if enough validators replay them.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files, err := listener.DeadLetterFiles(dir)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				return errors.New("no dead letters found")
+			}
+
+			replayDir := filepath.Join(dir, listener.DeadLetterReplayDir)
+			if err := os.MkdirAll(replayDir, 0o755); err != nil {
+				return err
+			}
+
+			// the names keep the files in order, after any files that were
+			// already queued.
+			prefix := time.Now().UTC().Format("20060102T150405")
+			for i, file := range files {
+				queued := filepath.Join(replayDir, fmt.Sprintf("%s-%03d.jsonl", prefix, i))
+				if err := os.Rename(file, queued); err != nil {
+					return fmt.Errorf("failed to queue %s: %w", file, err)
+				}
+			}
+
+			fmt.Printf("queued %d dead letter files, they are replayed when the node starts\n", len(files))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&dir, "dir", "", "the dead_letter_dir of the listener")
+	cmd.MarkFlagRequired("dir")
+	return cmd
+}
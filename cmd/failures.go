@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+func newFailuresCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "failures",
+		Short: "Inspect the Streamr failure ledger",
+		Long: `The failure ledger records Streamr events whose target procedure failed.
+Failures are re-driven by the owner of the target schema, using the "redrive"
+method of the streamr precompile.`,
+	}
+
+	cmd.AddCommand(newListFailuresCmd())
+	return cmd
+}
+
+func newListFailuresCmd() *cobra.Command {
+	var conn pgFlags
+	var dbid string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the failures in the ledger",
+		Long:  "List the failures in the ledger, read from the node's local database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := conn.connect(ctx)
+			if err != nil {
+				return err
+			}
+			defer db.Close(context.Background())
+
+			rows, err := db.Query(ctx, resolution.ListFailures, dbid)
+			if err != nil {
+				return fmt.Errorf("failed to list failures: %w", err)
+			}
+			defer rows.Close()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tDBID\tPROCEDURE\tCLASS\tSTREAM TIME\tERROR")
+			for rows.Next() {
+				var id, dbid, procedure, class, message string
+				var streamTime int64
+				if err := rows.Scan(&id, &dbid, &procedure, &class, &message, &streamTime); err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", id, dbid, procedure, class, strconv.FormatInt(streamTime, 10), message)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			return w.Flush()
+		},
+	}
+
+	conn.bind(cmd)
+	cmd.Flags().StringVar(&dbid, "dbid", "", "only list failures that target this database")
+	return cmd
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+func newShadowCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "shadow",
+		Short: "Inspect Streamr subscriptions in shadow mode",
+		Long: `Subscriptions in shadow mode are voted on, but their procedures are not
+executed. Instead, statistics about the confirmed events are recorded.`,
+	}
+
+	cmd.AddCommand(newShadowStatsCmd())
+	return cmd
+}
+
+func newShadowStatsCmd() *cobra.Command {
+	var conn pgFlags
+	var dbid string
+
+	cmd := &cobra.Command{
+		Use:   "stats",
+		Short: "Show the statistics of shadow subscriptions",
+		Long:  "Show the statistics of shadow subscriptions, read from the node's local database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := conn.connect(ctx)
+			if err != nil {
+				return err
+			}
+			defer db.Close(context.Background())
+
+			rows, err := db.Query(ctx, resolution.ListShadowStats, dbid)
+			if err != nil {
+				return fmt.Errorf("failed to list shadow statistics: %w", err)
+			}
+			defer rows.Close()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STREAM\tDBID\tPROCEDURE\tCONFIRMED\tBINDING ERRORS\tMISSING VALUES\tSHADOW ERRORS\tFIRST\tLAST")
+			for rows.Next() {
+				var stream, dbid, procedure string
+				var confirmed, bindingErrors, missingValues, shadowErrors, first, last int64
+				err := rows.Scan(&stream, &dbid, &procedure, &confirmed, &bindingErrors, &missingValues, &shadowErrors, &first, &last)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\n", stream, dbid, procedure,
+					confirmed, bindingErrors, missingValues, shadowErrors, first, last)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			return w.Flush()
+		},
+	}
+
+	conn.bind(cmd)
+	cmd.Flags().StringVar(&dbid, "dbid", "", "only show subscriptions that target this database")
+	return cmd
+}
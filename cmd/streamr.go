@@ -0,0 +1,101 @@
+// package cmd implements the kwild subcommands for operating the Streamr
+// extensions.
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kwilteam/kwil-db/cmd/kwild/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/kwilteam/kwil-streamr/extensions/listener"
+)
+
+// NewStreamrCmd creates the "streamr" command, which groups the
+// subcommands of the Streamr extensions.
+func NewStreamrCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "streamr",
+		Short: "Manage the Streamr extensions of a node",
+	}
+
+	cmd.AddCommand(newFailuresCmd(), newTargetsCmd(), newShadowCmd(), newCursorsCmd(), newDeadLettersCmd())
+	return cmd
+}
+
+// pgFlags are the flags used to connect to the node's Postgres database.
+// The defaults match the defaults of kwild.
+type pgFlags struct {
+	host, port, user, pass, name string
+}
+
+func (p *pgFlags) bind(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&p.host, "pg-db-host", "127.0.0.1", "host of the node's Postgres database")
+	cmd.Flags().StringVar(&p.port, "pg-db-port", "5432", "port of the node's Postgres database")
+	cmd.Flags().StringVar(&p.user, "pg-db-user", "kwild", "user of the node's Postgres database")
+	cmd.Flags().StringVar(&p.pass, "pg-db-pass", "", "password of the node's Postgres database")
+	cmd.Flags().StringVar(&p.name, "pg-db-name", "kwild", "name of the node's Postgres database")
+}
+
+func (p *pgFlags) connect(ctx context.Context) (*pgx.Conn, error) {
+	cfg, err := pgx.ParseConfig("")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Host, cfg.User, cfg.Password, cfg.Database = p.host, p.user, p.pass, p.name
+
+	port, err := strconv.ParseUint(p.port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", p.port)
+	}
+	cfg.Port = uint16(port)
+
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
+	}
+	return conn, nil
+}
+
+// NodeDatabase resolves the database config of the kwild root command
+// with kwild's own config loading, from the flags that the command was
+// run with. It is only called by listeners that resume from the committed
+// cursor, so that a config that kwild itself accepts never stops it.
+func NodeDatabase(root *cobra.Command) (*listener.NodeDatabase, error) {
+	flagCfg := config.EmptyConfig()
+	flags := pflag.NewFlagSet(root.Name(), pflag.ContinueOnError)
+	config.AddConfigFlags(flags, flagCfg)
+
+	var err error
+	root.Flags().Visit(func(f *pflag.Flag) {
+		target := flags.Lookup(f.Name)
+		if err != nil || target == nil {
+			return
+		}
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			err = target.Value.(pflag.SliceValue).Replace(slice.GetSlice())
+			return
+		}
+		err = flags.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := config.GetCfg(flagCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listener.NodeDatabase{
+		Host: cfg.AppCfg.DBHost,
+		Port: cfg.AppCfg.DBPort,
+		User: cfg.AppCfg.DBUser,
+		Pass: cfg.AppCfg.DBPass,
+		Name: cfg.AppCfg.DBName,
+	}, nil
+}
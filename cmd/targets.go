@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+func newTargetsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "targets",
+		Short: "Inspect the allowlist of Streamr targets",
+		Long: `Streamr events are only applied to procedures that the owner of the target
+schema has allowed, using the "allow" and "revoke" methods of the streamr
+precompile.`,
+	}
+
+	cmd.AddCommand(newListTargetsCmd())
+	return cmd
+}
+
+func newListTargetsCmd() *cobra.Command {
+	var conn pgFlags
+	var dbid string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the allowed targets",
+		Long:  "List the allowed targets, read from the node's local database.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			db, err := conn.connect(ctx)
+			if err != nil {
+				return err
+			}
+			defer db.Close(context.Background())
+
+			rows, err := db.Query(ctx, resolution.ListAllowedTargets, dbid)
+			if err != nil {
+				return fmt.Errorf("failed to list targets: %w", err)
+			}
+			defer rows.Close()
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "STREAM\tDBID\tPROCEDURE")
+			for rows.Next() {
+				var stream, dbid, procedure string
+				if err := rows.Scan(&stream, &dbid, &procedure); err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", stream, dbid, procedure)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			return w.Flush()
+		},
+	}
+
+	conn.bind(cmd)
+	cmd.Flags().StringVar(&dbid, "dbid", "", "only list targets in this database")
+	return cmd
+}
@@ -0,0 +1,476 @@
+package listener
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// aggregateFunc is a function that can be computed over a window.
+type aggregateFunc string
+
+const (
+	aggCount aggregateFunc = "count"
+	aggMin   aggregateFunc = "min"
+	aggMax   aggregateFunc = "max"
+	aggSum   aggregateFunc = "sum"
+	aggMean  aggregateFunc = "mean"
+	aggLast  aggregateFunc = "last"
+)
+
+// errLateMessage is returned when a message arrives for a window that has
+// already been emitted.
+var errLateMessage = errors.New("message arrived after its aggregation window closed")
+
+// allAggregateFuncs is the set of supported functions, in the order
+// they are applied if none are configured.
+var allAggregateFuncs = []aggregateFunc{aggCount, aggMin, aggMax, aggSum, aggMean, aggLast}
+
+// aggregateConfig configures windowed aggregation of messages.
+type aggregateConfig struct {
+	// Procedure is the procedure that each closed window is sent to.
+	Procedure string
+	// Window is the size of each tumbling window, in stream time.
+	Window time.Duration
+	// Lateness is how long, in stream time, the listener waits after a
+	// window ends before emitting it.
+	Lateness time.Duration
+	// KeyMappings maps procedure parameters to the JSON fields that
+	// make up the aggregation key. A window is kept for each distinct key.
+	// If empty, all messages are aggregated together.
+	KeyMappings map[string]string
+	// FieldMappings maps names to the JSON fields that are aggregated.
+	// For a name "temp" and the function "max", the procedure receives
+	// the parameter "temp_max".
+	FieldMappings map[string]string
+	// Funcs are the functions that are computed for each window.
+	Funcs []aggregateFunc
+	// Precision is the number of decimal places that means are rounded to.
+	Precision int
+	// IdleTimeout is how long, in wall-clock time, the stream must be
+	// quiet for windows that ended at least as long ago to be emitted.
+	IdleTimeout time.Duration
+}
+
+// aggregator computes aggregates per key over tumbling stream-time windows.
+// All arithmetic is done on exact decimals, and windows are emitted in a
+// fixed order, so that every validator that received the same messages
+// emits identical events.
+type aggregator struct {
+	conf     *aggregateConfig
+	stream   string
+	targetDB string
+	window   tumblingWindow
+	// fields are the names of the aggregated fields, sorted.
+	fields []string
+	// open maps a window start and key to the window's state.
+	open map[windowKey]*windowState
+	// lastAdd is when a message was last added.
+	lastAdd time.Time
+}
+
+type windowKey struct {
+	start int64
+	key   string
+}
+
+// windowState is the running state of one window for one key.
+type windowState struct {
+	keyValues []*resolution.ParamValue
+	count     int64
+	fields    map[string]*fieldState
+}
+
+// fieldState is the running state of one field within a window.
+type fieldState struct {
+	min, max, sum *big.Rat
+	// last is the value of the latest message in the window.
+	last string
+	// lastPos is the message that last was taken from. It is compared
+	// by stream position, so that last does not depend on arrival order.
+	lastPos *message
+}
+
+func newAggregator(conf *aggregateConfig, stream, targetDB string) *aggregator {
+	fields := make([]string, 0, len(conf.FieldMappings))
+	for name := range conf.FieldMappings {
+		fields = append(fields, name)
+	}
+	slices.Sort(fields)
+
+	return &aggregator{
+		conf:     conf,
+		stream:   stream,
+		targetDB: targetDB,
+		window: tumblingWindow{
+			size:     conf.Window.Milliseconds(),
+			lateness: conf.Lateness.Milliseconds(),
+		},
+		fields: fields,
+		open:   make(map[windowKey]*windowState),
+	}
+}
+
+// add adds a message to its window. It returns an event for each window
+// that has closed as a result of the message, ordered by window start and key.
+// If the message belongs to a window that has already been emitted, it
+// returns errLateMessage.
+func (a *aggregator) add(msg *message) ([]*resolution.StreamrEvent, error) {
+	start := a.window.start(msg.timestamp)
+	if a.window.closed(start) {
+		return nil, errLateMessage
+	}
+	a.lastAdd = time.Now()
+
+	keyValues, err := msg.parse(a.conf.KeyMappings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse aggregation key: %w", err)
+	}
+	// a window aggregates the messages of a key, whether or not its value
+	// was defaulted.
+	for _, v := range keyValues {
+		v.Defaulted = false
+	}
+
+	values, err := msg.parse(a.conf.FieldMappings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse aggregated fields: %w", err)
+	}
+
+	// we parse all numbers before updating any state, so that a message
+	// with an invalid field is not partially applied.
+	numeric := a.needsNumbers()
+	nums := make(map[string]*big.Rat, len(values))
+	for _, v := range values {
+		if v.IsArray {
+			return nil, fmt.Errorf("aggregated field %s is an array", v.Param)
+		}
+		if !numeric {
+			continue
+		}
+		r, ok := new(big.Rat).SetString(v.Value)
+		if !ok {
+			return nil, fmt.Errorf("aggregated field %s is not a number: %s", v.Param, v.Value)
+		}
+		nums[v.Param] = r
+	}
+
+	key, err := joinKey(keyValues)
+	if err != nil {
+		return nil, err
+	}
+
+	k := windowKey{start: start, key: key}
+	state, ok := a.open[k]
+	if !ok {
+		state = &windowState{
+			keyValues: keyValues,
+			fields:    make(map[string]*fieldState),
+		}
+		a.open[k] = state
+	}
+
+	state.count++
+	for _, v := range values {
+		f, ok := state.fields[v.Param]
+		if !ok {
+			f = &fieldState{}
+			state.fields[v.Param] = f
+		}
+
+		if n, ok := nums[v.Param]; ok {
+			if f.sum == nil {
+				f.min, f.max, f.sum = new(big.Rat).Set(n), new(big.Rat).Set(n), new(big.Rat)
+			}
+			if n.Cmp(f.min) < 0 {
+				f.min.Set(n)
+			}
+			if n.Cmp(f.max) > 0 {
+				f.max.Set(n)
+			}
+			f.sum.Add(f.sum, n)
+		}
+
+		if f.lastPos == nil || f.lastPos.compare(msg) <= 0 {
+			f.last, f.lastPos = v.Value, msg
+		}
+	}
+
+	a.window.observe(msg.timestamp)
+
+	return a.flush(), nil
+}
+
+// flushIdle emits the windows that ended, with their lateness, at least
+// IdleTimeout ago in wall-clock time, if no message was added for
+// IdleTimeout. Otherwise, the last windows of a stream that has gone
+// quiet would never be emitted, since no later message moves the
+// watermark.
+func (a *aggregator) flushIdle(now time.Time) []*resolution.StreamrEvent {
+	if now.Sub(a.lastAdd) < a.conf.IdleTimeout {
+		return nil
+	}
+	return a.flushDue(now, a.conf.IdleTimeout)
+}
+
+// flushDue emits the windows that ended, with their lateness, at least
+// grace ago in wall-clock time. Messages that arrive later for them are
+// late.
+func (a *aggregator) flushDue(now time.Time, grace time.Duration) []*resolution.StreamrEvent {
+	// windows that start earlier are due earlier, so closing the latest
+	// window that is due closes all of them.
+	for k := range a.open {
+		if a.window.due(k.start, now, grace) {
+			a.window.close(k.start)
+		}
+	}
+	return a.flush()
+}
+
+// openWindows returns the number of windows that have not been emitted,
+// over all keys.
+func (a *aggregator) openWindows() int {
+	return len(a.open)
+}
+
+// flush emits the windows that are closed, ordered by window start and
+// key.
+func (a *aggregator) flush() []*resolution.StreamrEvent {
+	var closed []windowKey
+	for k := range a.open {
+		if a.window.closed(k.start) {
+			closed = append(closed, k)
+		}
+	}
+	slices.SortFunc(closed, func(a, b windowKey) int {
+		if c := cmp.Compare(a.start, b.start); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+
+	events := make([]*resolution.StreamrEvent, 0, len(closed))
+	for _, k := range closed {
+		events = append(events, a.event(k, a.open[k]))
+		delete(a.open, k)
+	}
+
+	return events
+}
+
+// event creates the event for a closed window.
+func (a *aggregator) event(k windowKey, state *windowState) *resolution.StreamrEvent {
+	values := slices.Clone(state.keyValues)
+	values = append(values,
+		&resolution.ParamValue{Param: "window_start", Value: strconv.FormatInt(k.start, 10)},
+		&resolution.ParamValue{Param: "window_end", Value: strconv.FormatInt(k.start+a.window.size, 10)},
+	)
+
+	for _, fn := range a.conf.Funcs {
+		if fn == aggCount {
+			values = append(values, &resolution.ParamValue{Param: "count", Value: strconv.FormatInt(state.count, 10)})
+			continue
+		}
+
+		for _, name := range a.fields {
+			f, ok := state.fields[name]
+			if !ok {
+				continue
+			}
+
+			var v string
+			switch fn {
+			case aggMin:
+				v = decimalString(f.min)
+			case aggMax:
+				v = decimalString(f.max)
+			case aggSum:
+				v = decimalString(f.sum)
+			case aggMean:
+				mean := new(big.Rat).Quo(f.sum, new(big.Rat).SetInt64(state.count))
+				v = trimZeros(mean.FloatString(a.conf.Precision))
+			case aggLast:
+				v = f.last
+			}
+
+			values = append(values, &resolution.ParamValue{Param: name + "_" + string(fn), Value: v})
+		}
+	}
+
+	slices.SortFunc(values, func(a, b *resolution.ParamValue) int {
+		return strings.Compare(a.Param, b.Param)
+	})
+
+	return &resolution.StreamrEvent{
+		Values:          values,
+		TargetDBID:      a.targetDB,
+		TargetProcedure: a.conf.Procedure,
+		Timestamp:       uint64(k.start),
+		AggregateKey:    k.key,
+		StreamID:        a.stream,
+	}
+}
+
+// needsNumbers returns true if any configured function needs the
+// aggregated fields to be numbers.
+func (a *aggregator) needsNumbers() bool {
+	for _, fn := range a.conf.Funcs {
+		if fn != aggCount && fn != aggLast {
+			return true
+		}
+	}
+	return false
+}
+
+// joinKey creates the string key for a set of key values.
+// The values are already sorted by parameter name. The key is a JSON array
+// of parameter and value pairs, so that different key values never produce
+// the same key, whatever characters they contain.
+func joinKey(values []*resolution.ParamValue) (string, error) {
+	pairs := make([][2]any, 0, len(values))
+	for _, v := range values {
+		if v.IsArray {
+			pairs = append(pairs, [2]any{v.Param, append([]string{}, v.ValueArray...)})
+			continue
+		}
+		pairs = append(pairs, [2]any{v.Param, v.Value})
+	}
+
+	bts, err := json.Marshal(pairs)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// decimalString formats a rational number as an exact decimal. It must
+// only be given numbers that have a finite decimal representation, which
+// is true of all sums of decimal numbers.
+func decimalString(r *big.Rat) string {
+	// the number of decimal places needed is the larger of the
+	// powers of 2 and 5 in the denominator.
+	denom := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	two, five := big.NewInt(2), big.NewInt(5)
+	mod := new(big.Int)
+	for {
+		q, m := new(big.Int).QuoRem(denom, two, mod)
+		if m.Sign() != 0 {
+			break
+		}
+		denom, twos = q, twos+1
+	}
+	for {
+		q, m := new(big.Int).QuoRem(denom, five, mod)
+		if m.Sign() != 0 {
+			break
+		}
+		denom, fives = q, fives+1
+	}
+
+	return r.FloatString(max(twos, fives))
+}
+
+// trimZeros removes trailing zeros after the decimal point.
+func trimZeros(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// parseAggregateConfig parses the aggregation configuration.
+// It returns nil if aggregation is not configured.
+func parseAggregateConfig(m map[string]string) (*aggregateConfig, error) {
+	procedure, ok := m["aggregate_procedure"]
+	if !ok {
+		return nil, nil
+	}
+
+	conf := &aggregateConfig{
+		Procedure:   procedure,
+		Window:      time.Minute,
+		Funcs:       allAggregateFuncs,
+		Precision:   8,
+		KeyMappings: make(map[string]string),
+		IdleTimeout: defaultIdleTimeout,
+	}
+
+	var err error
+	if v, ok := m["aggregate_window"]; ok {
+		conf.Window, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregate_window config: %v", err)
+		}
+		if conf.Window < time.Millisecond {
+			return nil, fmt.Errorf("invalid aggregate_window config: must be at least 1ms")
+		}
+	}
+
+	if v, ok := m["aggregate_lateness"]; ok {
+		conf.Lateness, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregate_lateness config: %v", err)
+		}
+	}
+
+	if v, ok := m["aggregate_idle_timeout"]; ok {
+		conf.IdleTimeout, err = time.ParseDuration(v)
+		if err != nil || conf.IdleTimeout <= 0 {
+			return nil, fmt.Errorf("invalid aggregate_idle_timeout config: %s", v)
+		}
+	}
+
+	if v, ok := m["aggregate_key"]; ok {
+		conf.KeyMappings, err = parseMappings(v)
+		if err == nil {
+			err = checkNotOptional(conf.KeyMappings)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid aggregate_key config: %v", err)
+		}
+	}
+
+	fields, ok := m["aggregate_fields"]
+	if !ok {
+		return nil, errors.New("missing required aggregate_fields config")
+	}
+	conf.FieldMappings, err = parseMappings(fields)
+	if err == nil {
+		err = checkNotOptional(conf.FieldMappings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregate_fields config: %v", err)
+	}
+
+	if v, ok := m["aggregate_functions"]; ok {
+		conf.Funcs = nil
+		for _, fn := range strings.Split(v, ",") {
+			fn := aggregateFunc(strings.ToLower(strings.TrimSpace(fn)))
+			if !slices.Contains(allAggregateFuncs, fn) {
+				return nil, fmt.Errorf("invalid aggregate_functions config: unknown function %s", fn)
+			}
+			if !slices.Contains(conf.Funcs, fn) {
+				conf.Funcs = append(conf.Funcs, fn)
+			}
+		}
+	}
+
+	if v, ok := m["aggregate_precision"]; ok {
+		conf.Precision, err = strconv.Atoi(v)
+		if err != nil || conf.Precision < 0 {
+			return nil, fmt.Errorf("invalid aggregate_precision config: %s", v)
+		}
+	}
+
+	return conf, nil
+}
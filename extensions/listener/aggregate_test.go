@@ -0,0 +1,173 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Aggregator(t *testing.T) {
+	conf := &aggregateConfig{
+		Procedure:     "agg",
+		Window:        time.Minute,
+		KeyMappings:   map[string]string{"device": "device"},
+		FieldMappings: map[string]string{"temp": "data.temp"},
+		Funcs:         allAggregateFuncs,
+		Precision:     4,
+	}
+
+	msg := func(ts int64, device string, temp float64) *message {
+		return &message{
+			position: position{
+				streamID:  "stream",
+				timestamp: ts,
+				chainID:   "chain",
+			},
+			content: map[string]any{
+				"device": device,
+				"data": map[string]any{
+					"temp": temp,
+				},
+			},
+		}
+	}
+
+	// messages arrive out of order within the window, and for two devices.
+	msgs := []*message{
+		msg(60_500, "b", 1.5),
+		msg(60_300, "a", 20.1),
+		msg(60_100, "a", 10.2),
+		msg(61_000, "a", 0.3),
+		msg(119_999, "b", -2),
+	}
+
+	a := newAggregator(conf, "stream", "dbid")
+	for _, m := range msgs {
+		events, err := a.add(m)
+		require.NoError(t, err)
+		require.Empty(t, events)
+	}
+
+	// a message in the next window closes the first one
+	events, err := a.add(msg(120_000, "a", 5))
+	require.NoError(t, err)
+
+	want := []*resolution.StreamrEvent{
+		{
+			TargetDBID:      "dbid",
+			TargetProcedure: "agg",
+			Timestamp:       60_000,
+			AggregateKey:    `[["device","a"]]`,
+			StreamID:        "stream",
+			Values: []*resolution.ParamValue{
+				{Param: "count", Value: "3"},
+				{Param: "device", Value: "a"},
+				{Param: "temp_last", Value: "0.3"},
+				{Param: "temp_max", Value: "20.1"},
+				{Param: "temp_mean", Value: "10.2"},
+				{Param: "temp_min", Value: "0.3"},
+				{Param: "temp_sum", Value: "30.6"},
+				{Param: "window_end", Value: "120000"},
+				{Param: "window_start", Value: "60000"},
+			},
+		},
+		{
+			TargetDBID:      "dbid",
+			TargetProcedure: "agg",
+			Timestamp:       60_000,
+			AggregateKey:    `[["device","b"]]`,
+			StreamID:        "stream",
+			Values: []*resolution.ParamValue{
+				{Param: "count", Value: "2"},
+				{Param: "device", Value: "b"},
+				{Param: "temp_last", Value: "-2"},
+				{Param: "temp_max", Value: "1.5"},
+				{Param: "temp_mean", Value: "-0.25"},
+				{Param: "temp_min", Value: "-2"},
+				{Param: "temp_sum", Value: "-0.5"},
+				{Param: "window_end", Value: "120000"},
+				{Param: "window_start", Value: "60000"},
+			},
+		},
+	}
+	require.EqualValues(t, want, events)
+
+	// messages for the closed window are rejected
+	_, err = a.add(msg(61_000, "a", 1))
+	require.ErrorIs(t, err, errLateMessage)
+}
+
+func Test_AggregatorIdle(t *testing.T) {
+	conf := &aggregateConfig{
+		Procedure:     "agg",
+		Window:        time.Second,
+		FieldMappings: map[string]string{"temp": "temp"},
+		Funcs:         []aggregateFunc{aggCount},
+		IdleTimeout:   time.Minute,
+	}
+	now := time.Now().Truncate(time.Second)
+	msg := func(ts time.Time) *message {
+		return &message{
+			position: position{streamID: "stream", timestamp: ts.UnixMilli(), chainID: "chain"},
+			content:  map[string]any{"temp": 1},
+		}
+	}
+
+	a := newAggregator(conf, "stream", "dbid")
+	last := now.Add(-500 * time.Millisecond)
+	events, err := a.add(msg(last))
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// the window is only emitted once the stream is quiet, and the window
+	// ended at least the idle timeout ago
+	a.lastAdd = now
+	require.Empty(t, a.flushIdle(now.Add(30*time.Second)))
+	a.lastAdd = now.Add(-time.Hour)
+	require.Empty(t, a.flushIdle(now.Add(30*time.Second)))
+
+	events = a.flushIdle(now.Add(time.Minute))
+	require.Len(t, events, 1)
+	require.Equal(t, uint64(now.Add(-time.Second).UnixMilli()), events[0].Timestamp)
+
+	// messages for an emitted window are late
+	_, err = a.add(msg(last))
+	require.ErrorIs(t, err, errLateMessage)
+
+	// on shutdown, only the windows that ended are emitted
+	_, err = a.add(msg(now.Add(1500 * time.Millisecond)))
+	require.NoError(t, err)
+	require.Empty(t, a.flushDue(now.Add(time.Second), 0))
+	require.Equal(t, 1, a.openWindows())
+	require.Len(t, a.flushDue(now.Add(2*time.Second), 0), 1)
+	require.Zero(t, a.openWindows())
+}
+
+func Test_JoinKey(t *testing.T) {
+	key := func(values ...*resolution.ParamValue) string {
+		k, err := joinKey(values)
+		require.NoError(t, err)
+		return k
+	}
+
+	require.Equal(t, `[["device","a"],["tags",["x","y"]]]`, key(
+		&resolution.ParamValue{Param: "device", Value: "a"},
+		&resolution.ParamValue{Param: "tags", ValueArray: []string{"x", "y"}, IsArray: true},
+	))
+
+	// separators in values do not make different keys collide
+	require.NotEqual(t,
+		key(&resolution.ParamValue{Param: "a", Value: "1&b=2"}),
+		key(&resolution.ParamValue{Param: "a", Value: "1"}, &resolution.ParamValue{Param: "b", Value: "2"}),
+	)
+	require.NotEqual(t,
+		key(&resolution.ParamValue{Param: "a", ValueArray: []string{"1,2"}, IsArray: true}),
+		key(&resolution.ParamValue{Param: "a", ValueArray: []string{"1", "2"}, IsArray: true}),
+	)
+	require.NotEqual(t,
+		key(&resolution.ParamValue{Param: "a", ValueArray: []string{}, IsArray: true}),
+		key(&resolution.ParamValue{Param: "a", Value: "[]"}),
+	)
+}
@@ -0,0 +1,152 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/kwilteam/kwil-streamr/client"
+)
+
+// backfillLogInterval is how often the progress of a backfill is logged.
+const backfillLogInterval = 10 * time.Second
+
+// startFrom is where a subscription starts reading its stream, if it has
+// no checkpoint to resume from.
+type startFrom struct {
+	// Timestamp is the stream time to start from, in milliseconds. It is
+	// 0 for the earliest available message.
+	Timestamp int64
+	// Last is the number of messages before the live messages to start
+	// from. If it is set, Timestamp is ignored.
+	Last int
+}
+
+// resend returns the client options that request the resend.
+func (s *startFrom) resend(opts *client.ClientConfig) {
+	if s.Last > 0 {
+		opts.ResendLast = &s.Last
+		return
+	}
+	opts.ResendFrom = &client.ResendPosition{Timestamp: s.Timestamp}
+}
+
+// parseStartFrom parses the start_from config. It returns nil if the
+// subscription starts with live messages.
+func parseStartFrom(m map[string]string) (*startFrom, error) {
+	v, ok := m["start_from"]
+	if !ok || v == "now" {
+		return nil, nil
+	}
+
+	if v == "earliest" {
+		return &startFrom{}, nil
+	}
+
+	if n, ok := strings.CutPrefix(v, "last:"); ok {
+		last, err := strconv.Atoi(n)
+		if err != nil || last < 1 {
+			return nil, fmt.Errorf("invalid start_from config: %s", v)
+		}
+		return &startFrom{Last: last}, nil
+	}
+
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil && ms >= 0 {
+		return &startFrom{Timestamp: ms}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start_from config: %s", v)
+	}
+	return &startFrom{Timestamp: t.UnixMilli()}, nil
+}
+
+// parseBackfillRate parses the backfill_rate config. It returns 0 if the
+// backfill is not paced.
+func parseBackfillRate(m map[string]string) (float64, error) {
+	v, ok := m["backfill_rate"]
+	if !ok {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(v, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid backfill_rate config: %s", v)
+	}
+	return rate, nil
+}
+
+// backfill paces the messages that are resent when the listener starts,
+// and logs its progress, until the messages reach the time the listener
+// started.
+type backfill struct {
+	// until is the stream time, in milliseconds, at which the backfill
+	// has caught up.
+	until int64
+	// interval is the minimum time between two messages. If it is 0, the
+	// backfill is not paced.
+	interval time.Duration
+	logger   log.SugaredLogger
+
+	done    bool
+	count   int64
+	next    time.Time
+	lastLog time.Time
+}
+
+// newBackfill creates a backfill that catches up at the given time. rate
+// is the maximum number of messages per second, or 0 for no limit.
+func newBackfill(until time.Time, rate float64, logger log.SugaredLogger) *backfill {
+	b := &backfill{
+		until:   until.UnixMilli(),
+		logger:  logger,
+		lastLog: until,
+	}
+	if rate > 0 {
+		b.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return b
+}
+
+// wait is called for each message that is read. While the backfill has
+// not caught up, it waits until the message may be handled, so that the
+// backfill does not exceed its rate. It returns an error if the context
+// is cancelled while waiting.
+func (b *backfill) wait(ctx context.Context, timestamp int64) error {
+	if b.done {
+		return nil
+	}
+
+	now := time.Now()
+	if timestamp >= b.until {
+		b.done = true
+		b.logger.Info("Streamr backfill caught up", "messages", b.count, "duration", now.Sub(time.UnixMilli(b.until)).Round(time.Second))
+		return nil
+	}
+
+	b.count++
+	if now.Sub(b.lastLog) >= backfillLogInterval {
+		b.lastLog = now
+		b.logger.Info("backfilling Streamr stream", "messages", b.count, "stream_time", time.UnixMilli(timestamp).UTC().Format(time.RFC3339),
+			"behind", time.Duration(b.until-timestamp)*time.Millisecond)
+	}
+
+	if b.interval == 0 {
+		return nil
+	}
+	if b.next.After(now) {
+		timer := time.NewTimer(b.next.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now = b.next
+	}
+	b.next = now.Add(b.interval)
+	return nil
+}
@@ -0,0 +1,107 @@
+package listener
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StartFrom(t *testing.T) {
+	type testcase struct {
+		name    string
+		value   string
+		want    *startFrom
+		wantErr bool
+	}
+
+	tests := []testcase{
+		{
+			name:  "now",
+			value: "now",
+		},
+		{
+			name:  "earliest",
+			value: "earliest",
+			want:  &startFrom{},
+		},
+		{
+			name:  "last messages",
+			value: "last:100",
+			want:  &startFrom{Last: 100},
+		},
+		{
+			name:  "milliseconds",
+			value: "1718146494844",
+			want:  &startFrom{Timestamp: 1718146494844},
+		},
+		{
+			name:  "RFC 3339",
+			value: "2024-06-01T00:00:00Z",
+			want:  &startFrom{Timestamp: 1717200000000},
+		},
+		{
+			name:    "no messages",
+			value:   "last:0",
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			value:   "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStartFrom(map[string]string{"start_from": tt.value})
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_BackfillRate(t *testing.T) {
+	rate, err := parseBackfillRate(map[string]string{})
+	require.NoError(t, err)
+	require.Zero(t, rate)
+
+	rate, err = parseBackfillRate(map[string]string{"backfill_rate": "2.5"})
+	require.NoError(t, err)
+	require.Equal(t, 2.5, rate)
+
+	_, err = parseBackfillRate(map[string]string{"backfill_rate": "0"})
+	require.Error(t, err)
+}
+
+func Test_Backfill(t *testing.T) {
+	ctx := context.Background()
+	until := time.Now()
+	b := newBackfill(until, 100, log.NewNoOp().Sugar())
+
+	// messages before the start are paced
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.wait(ctx, until.UnixMilli()-1000))
+	}
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	require.False(t, b.done)
+	require.EqualValues(t, 3, b.count)
+
+	// a live message ends the backfill
+	require.NoError(t, b.wait(ctx, until.UnixMilli()))
+	require.True(t, b.done)
+
+	// a cancelled context stops waiting
+	b = newBackfill(until, 0.001, log.NewNoOp().Sugar())
+	require.NoError(t, b.wait(ctx, 0))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Error(t, b.wait(cancelled, 0))
+}
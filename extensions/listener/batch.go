@@ -0,0 +1,274 @@
+package listener
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwilteam/kwil-db/cmd/kwild/config"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// batcher groups events into batches. Batch boundaries are derived only from
+// the timestamps of the events, so that validators that received the same
+// messages produce identical batches, even if they received them in a
+// different order or at a different time.
+//
+// Events are first grouped into stream-time windows. Once a window closes,
+// its events are sorted and split into batches by row count and byte size.
+type batcher struct {
+	window tumblingWindow
+	// maxRows is the maximum number of events in a batch.
+	// If it is 0, there is no limit.
+	maxRows int
+	// maxBytes is the maximum encoded size of the events in a batch.
+	// If it is 0, there is no limit. An event that is larger than
+	// maxBytes on its own is put in a batch by itself.
+	maxBytes int
+	// wireVersion is the encoding that the size of an event is measured in.
+	wireVersion resolution.WireVersion
+	// idleTimeout is how long no event must have been added for the
+	// windows that ended to be flushed. See flushIdle.
+	idleTimeout time.Duration
+	// lastAdd is when an event was last added.
+	lastAdd time.Time
+	// pending maps a window start to the events received for the window.
+	pending map[int64][]*resolution.StreamrEvent
+}
+
+func newBatcher(conf *batchConfig, wireVersion resolution.WireVersion) *batcher {
+	return &batcher{
+		window: tumblingWindow{
+			size:     conf.Window.Milliseconds(),
+			lateness: conf.Lateness.Milliseconds(),
+		},
+		maxRows:     conf.MaxRows,
+		maxBytes:    conf.MaxBytes,
+		wireVersion: wireVersion,
+		idleTimeout: conf.IdleTimeout,
+		pending:     make(map[int64][]*resolution.StreamrEvent),
+	}
+}
+
+// add adds an event to the batcher. It returns all batches that are ready
+// to be broadcast as a result of the event's arrival, ordered by window.
+func (b *batcher) add(ev *resolution.StreamrEvent) ([]*resolution.StreamrBatch, error) {
+	ts := int64(ev.Timestamp)
+	start := b.window.start(ts)
+	b.lastAdd = time.Now()
+
+	// if the event's window has already been flushed, we can't include it
+	// in the window's batches anymore. We still want it ingested, so it is
+	// sent as a batch of its own.
+	if b.window.closed(start) {
+		return []*resolution.StreamrBatch{{Events: []*resolution.StreamrEvent{ev}}}, nil
+	}
+
+	b.pending[start] = append(b.pending[start], ev)
+	b.window.observe(ts)
+
+	return b.flush(b.window.closed)
+}
+
+// flushIdle flushes the windows that ended, with their lateness, at least
+// idleTimeout ago in wall-clock time, if no event was added for
+// idleTimeout. Otherwise, the last windows of a stream that has gone quiet
+// would never be flushed, since no later event moves the watermark.
+func (b *batcher) flushIdle(now time.Time) ([]*resolution.StreamrBatch, error) {
+	if now.Sub(b.lastAdd) < b.idleTimeout {
+		return nil, nil
+	}
+	return b.flushDue(now, b.idleTimeout)
+}
+
+// flushDue flushes the windows that ended, with their lateness, at least
+// grace ago in wall-clock time. Events that arrive later for them are
+// sent as batches of their own.
+func (b *batcher) flushDue(now time.Time, grace time.Duration) ([]*resolution.StreamrBatch, error) {
+	// windows that start earlier are due earlier, so closing the latest
+	// window that is due closes all of them.
+	for start := range b.pending {
+		if b.window.due(start, now, grace) {
+			b.window.close(start)
+		}
+	}
+	return b.flush(b.window.closed)
+}
+
+// open returns the number of windows that have not been flushed, and the
+// number of events in them.
+func (b *batcher) open() (windows, events int) {
+	for _, evs := range b.pending {
+		events += len(evs)
+	}
+	return len(b.pending), events
+}
+
+// flush flushes the windows for which closed returns true, ordered by
+// window.
+func (b *batcher) flush(closed func(start int64) bool) ([]*resolution.StreamrBatch, error) {
+	var starts []int64
+	for start := range b.pending {
+		if closed(start) {
+			starts = append(starts, start)
+		}
+	}
+	slices.Sort(starts)
+
+	var batches []*resolution.StreamrBatch
+	for _, start := range starts {
+		split, err := b.split(b.pending[start])
+		if err != nil {
+			return nil, err
+		}
+		delete(b.pending, start)
+
+		batches = append(batches, split...)
+	}
+
+	return batches, nil
+}
+
+// split sorts a window's events and splits them into batches.
+func (b *batcher) split(events []*resolution.StreamrEvent) ([]*resolution.StreamrBatch, error) {
+	slices.SortStableFunc(events, compareEvents)
+
+	var batches []*resolution.StreamrBatch
+	current := &resolution.StreamrBatch{}
+	size := 0
+	for _, ev := range events {
+		bts, err := ev.MarshalVersion(b.wireVersion)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
+		}
+
+		full := b.maxRows > 0 && len(current.Events) >= b.maxRows
+		full = full || (b.maxBytes > 0 && len(current.Events) > 0 && size+len(bts) > b.maxBytes)
+		if full {
+			batches = append(batches, current)
+			current = &resolution.StreamrBatch{}
+			size = 0
+		}
+
+		current.Events = append(current.Events, ev)
+		size += len(bts)
+	}
+	if len(current.Events) > 0 {
+		batches = append(batches, current)
+	}
+
+	return batches, nil
+}
+
+// compareEvents orders events by their position in the stream.
+func compareEvents(a, b *resolution.StreamrEvent) int {
+	if c := cmp.Compare(a.Timestamp, b.Timestamp); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.PublisherID, b.PublisherID); c != 0 {
+		return c
+	}
+	if c := strings.Compare(a.MsgChainID, b.MsgChainID); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.SequenceID, b.SequenceID); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.ElementIndex, b.ElementIndex); c != 0 {
+		return c
+	}
+	return strings.Compare(a.AggregateKey, b.AggregateKey)
+}
+
+const (
+	// defaultBatchMaxRows is the default maximum number of messages in a
+	// batch.
+	defaultBatchMaxRows = 1000
+)
+
+// defaultBatchMaxBytes is the default maximum encoded size of the messages
+// in a batch. The bodies of resolutions are voted on in transactions of
+// the block proposer, which are limited to kwild's max_tx_bytes, along
+// with the bodies of other resolutions, so a batch only takes a quarter of
+// kwild's default limit.
+var defaultBatchMaxBytes = config.DefaultConfig().ChainCfg.Mempool.MaxTxBytes / 4
+
+// batchConfig configures how messages are grouped into batches.
+type batchConfig struct {
+	// Window is the size of the stream-time window that a batch is
+	// taken from. Messages in different windows are never batched together.
+	Window time.Duration
+	// Lateness is how long, in stream time, the listener waits after a
+	// window ends before flushing it.
+	Lateness time.Duration
+	// MaxRows is the maximum number of messages in a batch.
+	MaxRows int
+	// MaxBytes is the maximum encoded size of the messages in a batch.
+	MaxBytes int
+	// IdleTimeout is how long, in wall-clock time, the stream must be
+	// quiet for windows that ended at least as long ago to be flushed.
+	IdleTimeout time.Duration
+}
+
+// parseBatchConfig parses the batch configuration.
+// It returns nil if batching is not configured.
+func parseBatchConfig(m map[string]string) (*batchConfig, error) {
+	window, hasWindow := m["batch_window"]
+	size, hasSize := m["batch_size"]
+	maxBytes, hasBytes := m["batch_max_bytes"]
+	if !hasWindow && !hasSize && !hasBytes {
+		return nil, nil
+	}
+
+	conf := &batchConfig{
+		Window:      time.Second,
+		MaxRows:     defaultBatchMaxRows,
+		MaxBytes:    defaultBatchMaxBytes,
+		IdleTimeout: defaultIdleTimeout,
+	}
+
+	var err error
+	if hasWindow {
+		conf.Window, err = time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch_window config: %v", err)
+		}
+		if conf.Window < time.Millisecond {
+			return nil, fmt.Errorf("invalid batch_window config: must be at least 1ms")
+		}
+	}
+
+	if v, ok := m["batch_lateness"]; ok {
+		conf.Lateness, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch_lateness config: %v", err)
+		}
+	}
+
+	if v, ok := m["batch_idle_timeout"]; ok {
+		conf.IdleTimeout, err = time.ParseDuration(v)
+		if err != nil || conf.IdleTimeout <= 0 {
+			return nil, fmt.Errorf("invalid batch_idle_timeout config: %s", v)
+		}
+	}
+
+	if hasSize {
+		conf.MaxRows, err = strconv.Atoi(size)
+		if err != nil || conf.MaxRows < 1 {
+			return nil, fmt.Errorf("invalid batch_size config: %s", size)
+		}
+	}
+
+	if hasBytes {
+		conf.MaxBytes, err = strconv.Atoi(maxBytes)
+		if err != nil || conf.MaxBytes < 1 {
+			return nil, fmt.Errorf("invalid batch_max_bytes config: %s", maxBytes)
+		}
+	}
+
+	return conf, nil
+}
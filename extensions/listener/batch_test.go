@@ -0,0 +1,169 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Batcher(t *testing.T) {
+	ev := func(ts, seq uint64) *resolution.StreamrEvent {
+		return &resolution.StreamrEvent{
+			Timestamp:  ts,
+			SequenceID: seq,
+			MsgChainID: "chain",
+		}
+	}
+
+	type testcase struct {
+		name   string
+		conf   *batchConfig
+		events []*resolution.StreamrEvent
+		// want is the timestamps of the events in each flushed batch
+		want [][]uint64
+	}
+
+	tests := []testcase{
+		{
+			name: "window closes on later message",
+			conf: &batchConfig{Window: time.Second},
+			events: []*resolution.StreamrEvent{
+				ev(1000, 0), ev(1500, 0), ev(1999, 0), ev(2000, 0),
+			},
+			want: [][]uint64{{1000, 1500, 1999}},
+		},
+		{
+			name: "out of order messages are sorted",
+			conf: &batchConfig{Window: time.Second},
+			events: []*resolution.StreamrEvent{
+				ev(1500, 0), ev(1000, 1), ev(1000, 0), ev(3000, 0),
+			},
+			want: [][]uint64{{1000, 1000, 1500}},
+		},
+		{
+			name: "split by row count",
+			conf: &batchConfig{Window: time.Second, MaxRows: 2},
+			events: []*resolution.StreamrEvent{
+				ev(1000, 0), ev(1100, 0), ev(1200, 0), ev(2000, 0),
+			},
+			want: [][]uint64{{1000, 1100}, {1200}},
+		},
+		{
+			name: "lateness keeps the window open",
+			conf: &batchConfig{Window: time.Second, Lateness: 500 * time.Millisecond},
+			events: []*resolution.StreamrEvent{
+				ev(1000, 0), ev(2100, 0), ev(1900, 0), ev(2500, 0),
+			},
+			want: [][]uint64{{1000, 1900}},
+		},
+		{
+			name: "late message is sent alone",
+			conf: &batchConfig{Window: time.Second},
+			events: []*resolution.StreamrEvent{
+				ev(1000, 0), ev(2000, 0), ev(1500, 0),
+			},
+			want: [][]uint64{{1000}, {1500}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBatcher(tt.conf, resolution.LatestWireVersion)
+
+			var got [][]uint64
+			for _, e := range tt.events {
+				batches, err := b.add(e)
+				require.NoError(t, err)
+
+				for _, batch := range batches {
+					var ts []uint64
+					for _, e := range batch.Events {
+						ts = append(ts, e.Timestamp)
+					}
+					got = append(got, ts)
+				}
+			}
+
+			require.EqualValues(t, tt.want, got)
+		})
+	}
+}
+
+func Test_BatcherIdle(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	ev := func(ts time.Time) *resolution.StreamrEvent {
+		return &resolution.StreamrEvent{Timestamp: uint64(ts.UnixMilli()), MsgChainID: "chain"}
+	}
+
+	// the last window of a stream that went quiet is never closed by a
+	// later event
+	b := newBatcher(&batchConfig{Window: time.Second, IdleTimeout: time.Minute}, resolution.LatestWireVersion)
+	last := now.Add(-500 * time.Millisecond)
+	batches, err := b.add(ev(last))
+	require.NoError(t, err)
+	require.Empty(t, batches)
+
+	// nothing is flushed while events are still added, or before the
+	// window ended at least the idle timeout ago
+	b.lastAdd = now
+	batches, err = b.flushIdle(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	require.Empty(t, batches)
+
+	b.lastAdd = now.Add(-time.Hour)
+	batches, err = b.flushIdle(now.Add(30 * time.Second))
+	require.NoError(t, err)
+	require.Empty(t, batches)
+
+	batches, err = b.flushIdle(now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, uint64(last.UnixMilli()), batches[0].Events[0].Timestamp)
+
+	// a later event for the flushed window is sent alone
+	batches, err = b.add(ev(last))
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+
+	// on shutdown, the windows that ended are flushed without waiting
+	next := now.Add(1500 * time.Millisecond)
+	_, err = b.add(ev(next))
+	require.NoError(t, err)
+
+	batches, err = b.flushDue(now.Add(time.Second), 0)
+	require.NoError(t, err)
+	require.Empty(t, batches)
+	windows, events := b.open()
+	require.Equal(t, 1, windows)
+	require.Equal(t, 1, events)
+
+	batches, err = b.flushDue(now.Add(2*time.Second), 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, uint64(next.UnixMilli()), batches[0].Events[0].Timestamp)
+}
+
+func Test_ParseBatchConfig(t *testing.T) {
+	conf, err := parseBatchConfig(map[string]string{})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	// batches are always limited, so that a busy stream does not produce
+	// a body that is too large to be voted on
+	conf, err = parseBatchConfig(map[string]string{"batch_window": "5s"})
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Second, conf.Window)
+	require.Equal(t, defaultBatchMaxRows, conf.MaxRows)
+	require.Equal(t, 1024*1024, conf.MaxBytes)
+
+	conf, err = parseBatchConfig(map[string]string{"batch_size": "10", "batch_max_bytes": "2000"})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, conf.Window)
+	require.Equal(t, 10, conf.MaxRows)
+	require.Equal(t, 2000, conf.MaxBytes)
+
+	_, err = parseBatchConfig(map[string]string{"batch_max_bytes": "0"})
+	require.Error(t, err)
+}
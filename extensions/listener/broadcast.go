@@ -0,0 +1,272 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/kwilteam/kwil-db/extensions/listeners"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// broadcaster sends events to the local event store, so that they are
+// broadcast to the network. If a batcher is set, events are grouped into
+// batches first.
+type broadcaster struct {
+	eventstore listeners.EventStore
+	batcher    *batcher
+	// resolutionType is the resolution type that events are broadcast
+	// with. Batches use its batch resolution type.
+	resolutionType string
+	// idVersion is the version of the transaction ID derivation that
+	// events are created with.
+	idVersion uint8
+	// wireVersion is the version of the encoding that events and
+	// batches are broadcast with.
+	wireVersion resolution.WireVersion
+	// replayRetention is the replay retention that events are created
+	// with. See resolution.StreamrEvent.ReplayRetention.
+	replayRetention time.Duration
+	// recordFailures is a flag to record events whose procedure fails in
+	// the failure ledger.
+	recordFailures bool
+	// shadow is a flag to resolve events in shadow mode.
+	shadow bool
+	// trackCursor is a flag to record events in the cursor of their
+	// stream and target.
+	trackCursor bool
+	// checkpoints are advanced when events are broadcast. They are
+	// optional.
+	checkpoints *checkpoints
+	// pending are the positions of the messages of events that are
+	// waiting in the batcher, since the events of legacy IDs lose them.
+	pending map[*resolution.StreamrEvent]checkpoint
+	// messages are the messages whose events have not all been broadcast
+	// yet. The checkpoint of a message only advances once all of its
+	// events are broadcast, so that a message that is split into several
+	// events is resent if the node stops before its last one is.
+	messages map[checkpoint]*messageEvents
+	logger   log.SugaredLogger
+}
+
+// messageEvents tracks the events of a message that are being broadcast.
+type messageEvents struct {
+	// unsent is the number of events that have not been broadcast, plus
+	// one while the message is held.
+	unsent int
+	// sent is set once an event of the message is sent. Messages without
+	// events, such as those that are only aggregated, do not advance
+	// their checkpoint.
+	sent bool
+	// failed is set if any event of the message could not be broadcast,
+	// in which case its checkpoint does not advance.
+	failed bool
+}
+
+// send sends an event. It returns an error if the event cannot be
+// marshalled, so that the message it was created from can be rejected.
+// Events that cannot be broadcast are logged and dropped, since a single
+// bad event should not stop the listener.
+func (b *broadcaster) send(ctx context.Context, ev *resolution.StreamrEvent) error {
+	ev.IDVersion = b.idVersion
+	ev.ReplayRetention = uint64(b.replayRetention.Milliseconds())
+	ev.RecordFailures = b.recordFailures
+	ev.Shadow = b.shadow
+	ev.TrackCursor = b.trackCursor && ev.AggregateKey == ""
+	cp, hasCheckpoint := eventCheckpoint(ev)
+	if ev.IDVersion == resolution.IDVersionLegacy {
+		// the legacy ID does not use these fields, and leaving them out
+		// keeps the event body identical to the one created by nodes that
+		// do not know about them.
+		ev.StreamID, ev.Partition, ev.PublisherID = "", 0, ""
+	}
+
+	// events are marshalled before they are batched as well, so that a
+	// bad event does not fail its whole batch.
+	bts, err := ev.MarshalVersion(b.wireVersion)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	hasCheckpoint = hasCheckpoint && b.checkpoints != nil
+	if hasCheckpoint {
+		b.track(cp).sent = true
+	}
+
+	if b.batcher == nil {
+		err = b.eventstore.Broadcast(ctx, b.resolutionType, bts)
+		if err != nil {
+			broadcastErrors.WithLabelValues(broadcastEvent).Inc()
+			b.logger.Error("failed to broadcast event", "error", err)
+		} else {
+			broadcasts.WithLabelValues(broadcastEvent).Inc()
+		}
+		if hasCheckpoint {
+			b.done(ctx, cp, err == nil)
+		}
+		return nil
+	}
+
+	batches, err := b.batcher.add(ev)
+	if err != nil {
+		b.logger.Error("failed to batch event", "error", err)
+		if hasCheckpoint {
+			b.done(ctx, cp, false)
+		}
+		return nil
+	}
+	if hasCheckpoint {
+		b.pending[ev] = cp
+	}
+
+	b.broadcastBatches(ctx, batches)
+	return nil
+}
+
+// flushIdle broadcasts the batches of the windows that the batcher
+// flushes because the stream went quiet, and stores the checkpoints that
+// advanced since they were last stored.
+func (b *broadcaster) flushIdle(ctx context.Context, now time.Time) {
+	defer b.flushCheckpoints(ctx, now)
+	if b.batcher == nil {
+		return
+	}
+
+	batches, err := b.batcher.flushIdle(now)
+	if err != nil {
+		b.logger.Error("failed to flush idle batches", "error", err)
+		return
+	}
+	b.broadcastBatches(ctx, batches)
+}
+
+// shutdown broadcasts the batches of the windows that have ended in
+// wall-clock time, when the listener stops, and stores the checkpoints.
+// The windows that are still open are lost, and are only logged.
+func (b *broadcaster) shutdown(ctx context.Context, now time.Time) {
+	defer b.flushCheckpoints(ctx, now)
+	if b.batcher == nil {
+		return
+	}
+
+	batches, err := b.batcher.flushDue(now, 0)
+	if err != nil {
+		b.logger.Error("failed to flush batches", "error", err)
+	} else {
+		b.broadcastBatches(ctx, batches)
+	}
+
+	// without checkpoints, the events of the open windows are not resent
+	// when the listener starts again.
+	if windows, events := b.batcher.open(); windows > 0 {
+		b.logger.Warn("dropping open batch windows on shutdown", "windows", windows, "events", events, "resent_on_start", b.checkpoints != nil)
+	}
+}
+
+// broadcastBatches broadcasts batches, and advances the checkpoints of
+// their events.
+func (b *broadcaster) broadcastBatches(ctx context.Context, batches []*resolution.StreamrBatch) {
+	for _, batch := range batches {
+		bts, err := batch.MarshalVersion(b.wireVersion)
+		if err != nil {
+			b.logger.Error("failed to marshal batch", "error", err)
+			continue
+		}
+
+		err = b.eventstore.Broadcast(ctx, resolution.BatchResolutionName(b.resolutionType), bts)
+		if err != nil {
+			broadcastErrors.WithLabelValues(broadcastBatch).Inc()
+			b.logger.Error("failed to broadcast batch", "error", err)
+		} else {
+			broadcasts.WithLabelValues(broadcastBatch).Inc()
+		}
+
+		// the events are no longer pending even if the batch failed, so
+		// that a failed batch does not hold back the checkpoints forever.
+		for _, ev := range batch.Events {
+			if cp, ok := b.pending[ev]; ok {
+				delete(b.pending, ev)
+				b.done(ctx, cp, err == nil)
+			}
+		}
+	}
+}
+
+// proposeAllow broadcasts a proposal to allow the targets of the
+// subscription. Each validator that proposes it votes for it, and it is
+// applied once enough of them have.
+func (b *broadcaster) proposeAllow(ctx context.Context, p *resolution.AllowProposal) {
+	bts, err := p.MarshalBinary()
+	if err != nil {
+		b.logger.Error("failed to marshal allow proposal", "error", err)
+		return
+	}
+
+	if err = b.eventstore.Broadcast(ctx, resolution.StreamrAllowResolutionName, bts); err != nil {
+		broadcastErrors.WithLabelValues(broadcastAllow).Inc()
+		b.logger.Error("failed to broadcast allow proposal", "error", err)
+		return
+	}
+	broadcasts.WithLabelValues(broadcastAllow).Inc()
+}
+
+// hold keeps the checkpoint of a message from advancing while its events
+// are sent, until release is called. Without it, each event advances the
+// checkpoint once it is broadcast.
+func (b *broadcaster) hold(cp checkpoint) {
+	if b.checkpoints != nil {
+		b.track(cp)
+	}
+}
+
+// release releases the hold on the checkpoint of a message, which
+// advances it if all of its events have been broadcast.
+func (b *broadcaster) release(ctx context.Context, cp checkpoint) {
+	if b.checkpoints != nil {
+		b.done(ctx, cp, true)
+	}
+}
+
+// track counts an event of a message that is not broadcast yet.
+func (b *broadcaster) track(cp checkpoint) *messageEvents {
+	m, ok := b.messages[cp]
+	if !ok {
+		m = &messageEvents{}
+		b.messages[cp] = m
+	}
+	m.unsent++
+	return m
+}
+
+// done counts an event of a message as broadcast, or as failed, and
+// advances the message's checkpoint once none of its events are left.
+func (b *broadcaster) done(ctx context.Context, cp checkpoint, broadcast bool) {
+	m, ok := b.messages[cp]
+	if !ok {
+		return
+	}
+	m.unsent--
+	m.failed = m.failed || !broadcast
+	if m.unsent > 0 {
+		return
+	}
+
+	delete(b.messages, cp)
+	if m.failed || !m.sent {
+		return
+	}
+	if err := b.checkpoints.advance(ctx, cp); err != nil {
+		b.logger.Error("failed to store checkpoint", "error", err)
+	}
+}
+
+// flushCheckpoints stores the checkpoints, if there are any.
+func (b *broadcaster) flushCheckpoints(ctx context.Context, now time.Time) {
+	if b.checkpoints == nil {
+		return
+	}
+
+	if err := b.checkpoints.flush(ctx, now); err != nil {
+		b.logger.Error("failed to store checkpoint", "error", err)
+	}
+}
@@ -0,0 +1,221 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kwilteam/kwil-db/extensions/listeners"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// checkpointKeyPrefix is the prefix of the event store key that the
+// checkpoints of a stream are stored under.
+const checkpointKeyPrefix = "checkpoint/"
+
+// checkpointStoreInterval is the least time between two writes of the
+// checkpoints to the event store. Checkpoints that advance in between are
+// written by a later advance or flush, so a node that stops abruptly
+// resends up to this much of the stream, which is voted on again.
+const checkpointStoreInterval = time.Second
+
+// parseCheckpointConfig parses the checkpoint config, which is false if it
+// is not set.
+func parseCheckpointConfig(m map[string]string) (bool, error) {
+	v, ok := m["checkpoint"]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid checkpoint config: %s", v)
+	}
+	return enabled, nil
+}
+
+// chainKey identifies a message chain of a stream.
+type chainKey struct {
+	PublisherID string `json:"publisher_id"`
+	MsgChainID  string `json:"msg_chain_id"`
+}
+
+// newChainKey returns the key of a message chain. Publisher IDs are
+// addresses, which are case-insensitive, so they are lowercased, as they
+// are in the committed cursor.
+func newChainKey(publisherID, msgChainID string) chainKey {
+	return chainKey{PublisherID: strings.ToLower(publisherID), MsgChainID: msgChainID}
+}
+
+// chainPosition is the position of a message in its message chain.
+type chainPosition struct {
+	Timestamp int64 `json:"timestamp"`
+	Sequence  int64 `json:"sequence"`
+}
+
+// after returns true if p is after o.
+func (p chainPosition) after(o chainPosition) bool {
+	if p.Timestamp != o.Timestamp {
+		return p.Timestamp > o.Timestamp
+	}
+	return p.Sequence > o.Sequence
+}
+
+// checkpoint is the position of a message in a stream.
+type checkpoint struct {
+	chainKey
+	chainPosition
+}
+
+// eventCheckpoint returns the position of the message that an event was
+// created from. It returns false for aggregates, since they do not have
+// the position of a message.
+func eventCheckpoint(ev *resolution.StreamrEvent) (checkpoint, bool) {
+	if ev.AggregateKey != "" {
+		return checkpoint{}, false
+	}
+
+	return checkpoint{
+		chainKey:      newChainKey(ev.PublisherID, ev.MsgChainID),
+		chainPosition: chainPosition{Timestamp: int64(ev.Timestamp), Sequence: int64(ev.SequenceID)},
+	}, true
+}
+
+// checkpoints are the positions of the latest messages of each message
+// chain that were broadcast. They are kept in the listener's event store,
+// so that the listener can resume from them after a restart.
+type checkpoints struct {
+	// eventstore is the event store that the checkpoints are kept in. If
+	// it is nil, they are only kept in memory.
+	eventstore listeners.EventStore
+	key        []byte
+	// storeInterval is the least time between two writes to the event
+	// store.
+	storeInterval time.Duration
+
+	mu        sync.Mutex
+	positions map[chainKey]chainPosition
+	// dirty is set if the positions changed since they were stored.
+	dirty  bool
+	stored time.Time
+}
+
+// newCheckpoints creates checkpoints that are only kept in memory.
+func newCheckpoints() *checkpoints {
+	return &checkpoints{positions: make(map[chainKey]chainPosition)}
+}
+
+// loadCheckpoints loads the checkpoints of a stream from the event store.
+func loadCheckpoints(ctx context.Context, eventstore listeners.EventStore, stream string) (*checkpoints, error) {
+	c := &checkpoints{
+		eventstore:    eventstore,
+		key:           []byte(checkpointKeyPrefix + stream),
+		storeInterval: checkpointStoreInterval,
+		positions:     make(map[chainKey]chainPosition),
+	}
+
+	bts, err := eventstore.Get(ctx, c.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load checkpoints: %w", err)
+	}
+	if len(bts) == 0 {
+		return c, nil
+	}
+
+	var stored []*checkpoint
+	if err := json.Unmarshal(bts, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoints: %w", err)
+	}
+	for _, s := range stored {
+		key := newChainKey(s.PublisherID, s.MsgChainID)
+		if pos, ok := c.positions[key]; !ok || s.after(pos) {
+			c.positions[key] = s.chainPosition
+		}
+	}
+
+	return c, nil
+}
+
+// resendFrom returns the earliest checkpoint of all message chains, which
+// is the position that messages must be resent from. It returns false if
+// there are no checkpoints.
+func (c *checkpoints) resendFrom() (chainPosition, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var earliest chainPosition
+	found := false
+	for _, pos := range c.positions {
+		if !found || earliest.after(pos) {
+			earliest, found = pos, true
+		}
+	}
+	return earliest, found
+}
+
+// seen returns true if a message is at or before the checkpoint of its
+// message chain, meaning that it was already broadcast.
+func (c *checkpoints) seen(key chainKey, pos chainPosition) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp, ok := c.positions[key]
+	return ok && !pos.after(cp)
+}
+
+// advance moves the checkpoints of the messages' chains forward, and
+// stores them, unless they were stored less than storeInterval ago.
+func (c *checkpoints) advance(ctx context.Context, messages ...checkpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range messages {
+		if cp, ok := c.positions[m.chainKey]; ok && !m.after(cp) {
+			continue
+		}
+		c.positions[m.chainKey] = m.chainPosition
+		c.dirty = true
+	}
+
+	return c.store(ctx, time.Now(), false)
+}
+
+// flush stores the checkpoints if they advanced since they were last
+// stored. It is called periodically, and when the listener stops.
+func (c *checkpoints) flush(ctx context.Context, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.store(ctx, now, true)
+}
+
+// store writes the checkpoints to the event store. Unless force is set,
+// it does nothing if they were stored less than storeInterval ago. The
+// caller must hold the lock.
+func (c *checkpoints) store(ctx context.Context, now time.Time, force bool) error {
+	if !c.dirty || c.eventstore == nil {
+		return nil
+	}
+	if !force && now.Sub(c.stored) < c.storeInterval {
+		return nil
+	}
+
+	stored := make([]*checkpoint, 0, len(c.positions))
+	for key, pos := range c.positions {
+		stored = append(stored, &checkpoint{chainKey: key, chainPosition: pos})
+	}
+
+	bts, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := c.eventstore.Set(ctx, c.key, bts); err != nil {
+		return err
+	}
+
+	c.dirty, c.stored = false, now
+	return nil
+}
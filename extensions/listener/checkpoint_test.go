@@ -0,0 +1,268 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryEventStore is an in-memory listeners.EventStore.
+type memoryEventStore struct {
+	kv        map[string][]byte
+	broadcast [][]byte
+}
+
+func newMemoryEventStore() *memoryEventStore {
+	return &memoryEventStore{kv: make(map[string][]byte)}
+}
+
+func (m *memoryEventStore) Broadcast(_ context.Context, _ string, data []byte) error {
+	m.broadcast = append(m.broadcast, data)
+	return nil
+}
+
+func (m *memoryEventStore) Set(_ context.Context, key []byte, value []byte) error {
+	m.kv[string(key)] = value
+	return nil
+}
+
+func (m *memoryEventStore) Get(_ context.Context, key []byte) ([]byte, error) {
+	return m.kv[string(key)], nil
+}
+
+func (m *memoryEventStore) Delete(_ context.Context, key []byte) error {
+	delete(m.kv, string(key))
+	return nil
+}
+
+func Test_Checkpoints(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryEventStore()
+
+	cps, err := loadCheckpoints(ctx, store, "stream")
+	require.NoError(t, err)
+	_, ok := cps.resendFrom()
+	require.False(t, ok)
+
+	a := chainKey{PublisherID: "0xa", MsgChainID: "chain"}
+	b := chainKey{PublisherID: "0xb", MsgChainID: "chain"}
+	require.NoError(t, cps.advance(ctx,
+		checkpoint{a, chainPosition{Timestamp: 10, Sequence: 1}},
+		checkpoint{b, chainPosition{Timestamp: 5, Sequence: 0}},
+		// checkpoints never move backwards
+		checkpoint{a, chainPosition{Timestamp: 10, Sequence: 0}},
+	))
+
+	// checkpoints survive a restart
+	cps, err = loadCheckpoints(ctx, store, "stream")
+	require.NoError(t, err)
+
+	// messages are resent from the earliest chain
+	pos, ok := cps.resendFrom()
+	require.True(t, ok)
+	require.Equal(t, chainPosition{Timestamp: 5, Sequence: 0}, pos)
+
+	// resent messages are skipped up to their own chain's checkpoint
+	require.True(t, cps.seen(a, chainPosition{Timestamp: 10, Sequence: 1}))
+	require.True(t, cps.seen(a, chainPosition{Timestamp: 6, Sequence: 0}))
+	require.False(t, cps.seen(a, chainPosition{Timestamp: 10, Sequence: 2}))
+	require.False(t, cps.seen(b, chainPosition{Timestamp: 6, Sequence: 0}))
+	require.False(t, cps.seen(chainKey{PublisherID: "0xc"}, chainPosition{}))
+
+	// checkpoints are per stream
+	other, err := loadCheckpoints(ctx, store, "other")
+	require.NoError(t, err)
+	_, ok = other.resendFrom()
+	require.False(t, ok)
+}
+
+func Test_CheckpointConfig(t *testing.T) {
+	enabled, err := parseCheckpointConfig(map[string]string{})
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	enabled, err = parseCheckpointConfig(map[string]string{"checkpoint": "true"})
+	require.NoError(t, err)
+	require.True(t, enabled)
+
+	_, err = parseCheckpointConfig(map[string]string{"checkpoint": "yes"})
+	require.Error(t, err)
+}
+
+func Test_CursorConfig(t *testing.T) {
+	conf, err := parseCursorConfig(map[string]string{})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	conf, err = parseCursorConfig(map[string]string{"cursor": "false"})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	// the defaults of kwild are used until the node's database is set
+	conf, err = parseCursorConfig(map[string]string{"cursor": "true"})
+	require.NoError(t, err)
+	require.Equal(t, &cursorConfig{Host: "127.0.0.1", Port: 5432, User: "kwild", Name: "kwild"}, conf)
+
+	defer SetNodeDatabase(nil)
+	SetNodeDatabase(func() (*NodeDatabase, error) { return &NodeDatabase{Port: "5433", Pass: "secret"}, nil })
+	conf, err = parseCursorConfig(map[string]string{"cursor": "true"})
+	require.NoError(t, err)
+	require.Equal(t, &cursorConfig{Host: "127.0.0.1", Port: 5433, User: "kwild", Pass: "secret", Name: "kwild"}, conf)
+
+	SetNodeDatabase(func() (*NodeDatabase, error) { return &NodeDatabase{Port: "port"}, nil })
+	_, err = parseCursorConfig(map[string]string{"cursor": "true"})
+	require.Error(t, err)
+
+	// the node's database is only resolved if the cursor is used
+	SetNodeDatabase(func() (*NodeDatabase, error) { return nil, errors.New("invalid config file") })
+	_, err = parseCursorConfig(map[string]string{"cursor": "true"})
+	require.ErrorContains(t, err, "invalid config file")
+	conf, err = parseCursorConfig(map[string]string{"cursor": "false"})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+}
+
+func Test_MemoryCheckpoints(t *testing.T) {
+	// checkpoints that are only kept in memory are still used to resume
+	// from the committed cursor.
+	cps := newCheckpoints()
+	key := chainKey{PublisherID: "0xa", MsgChainID: "chain"}
+	require.NoError(t, cps.advance(context.Background(), checkpoint{key, chainPosition{Timestamp: 10}}))
+
+	pos, ok := cps.resendFrom()
+	require.True(t, ok)
+	require.Equal(t, chainPosition{Timestamp: 10}, pos)
+	require.True(t, cps.seen(key, pos))
+}
+
+func Test_CheckpointPublisherCase(t *testing.T) {
+	// the committed cursor lowercases publishers, so checkpoints match
+	// messages regardless of the case of their publisher
+	cps := newCheckpoints()
+	require.NoError(t, cps.advance(context.Background(), checkpoint{newChainKey("0xa", "chain"), chainPosition{Timestamp: 10}}))
+
+	cp, ok := eventCheckpoint(&resolution.StreamrEvent{PublisherID: "0xA", MsgChainID: "chain", Timestamp: 10})
+	require.True(t, ok)
+	require.True(t, cps.seen(cp.chainKey, cp.chainPosition))
+	require.True(t, cps.seen(newChainKey("0xA", "chain"), chainPosition{Timestamp: 5}))
+}
+
+func Test_BroadcasterCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	ev := func(ts uint64) *resolution.StreamrEvent {
+		return &resolution.StreamrEvent{
+			TargetDBID:      "db",
+			TargetProcedure: "write",
+			Timestamp:       ts,
+			MsgChainID:      "chain",
+			PublisherID:     "0xa",
+		}
+	}
+	key := chainKey{PublisherID: "0xa", MsgChainID: "chain"}
+
+	store := newMemoryEventStore()
+	cps, err := loadCheckpoints(ctx, store, "stream")
+	require.NoError(t, err)
+
+	b := &broadcaster{
+		eventstore: store,
+		batcher:    newBatcher(&batchConfig{Window: time.Second}, resolution.LatestWireVersion),
+		// the legacy ID clears the publisher before the event is
+		// batched, so its position must be kept separately.
+		idVersion:   resolution.IDVersionLegacy,
+		wireVersion: resolution.LatestWireVersion,
+		checkpoints: cps,
+		pending:     make(map[*resolution.StreamrEvent]checkpoint),
+		messages:    make(map[checkpoint]*messageEvents),
+		logger:      log.NewNoOp().Sugar(),
+	}
+
+	// a batched event does not advance the checkpoint until its batch is
+	// broadcast.
+	b.send(ctx, ev(1000))
+	require.Empty(t, store.broadcast)
+	require.False(t, cps.seen(key, chainPosition{Timestamp: 1000}))
+
+	b.send(ctx, ev(2000))
+	require.Len(t, store.broadcast, 1)
+	require.True(t, cps.seen(key, chainPosition{Timestamp: 1000}))
+	require.False(t, cps.seen(key, chainPosition{Timestamp: 2000}))
+	require.Len(t, b.pending, 1)
+}
+
+func Test_MessageCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	ev := func(index uint64) *resolution.StreamrEvent {
+		return &resolution.StreamrEvent{
+			TargetDBID:      "db",
+			TargetProcedure: "write",
+			Timestamp:       1000,
+			MsgChainID:      "chain",
+			PublisherID:     "0xa",
+			ElementIndex:    index,
+			IsElement:       true,
+		}
+	}
+	cp := checkpoint{chainKey{PublisherID: "0xa", MsgChainID: "chain"}, chainPosition{Timestamp: 1000}}
+
+	cps := newCheckpoints()
+	b := &broadcaster{
+		eventstore:  newMemoryEventStore(),
+		idVersion:   resolution.LatestIDVersion,
+		wireVersion: resolution.LatestWireVersion,
+		checkpoints: cps,
+		pending:     make(map[*resolution.StreamrEvent]checkpoint),
+		messages:    make(map[checkpoint]*messageEvents),
+		logger:      log.NewNoOp().Sugar(),
+	}
+
+	// a message split into several events only advances its checkpoint
+	// after its last event
+	b.hold(cp)
+	require.NoError(t, b.send(ctx, ev(0)))
+	require.False(t, cps.seen(cp.chainKey, cp.chainPosition))
+	require.NoError(t, b.send(ctx, ev(1)))
+	require.False(t, cps.seen(cp.chainKey, cp.chainPosition))
+	b.release(ctx, cp)
+	require.True(t, cps.seen(cp.chainKey, cp.chainPosition))
+	require.Empty(t, b.messages)
+
+	// a message without events, such as one that is only aggregated, does
+	// not advance its checkpoint
+	later := checkpoint{cp.chainKey, chainPosition{Timestamp: 2000}}
+	b.hold(later)
+	b.release(ctx, later)
+	require.False(t, cps.seen(later.chainKey, later.chainPosition))
+	require.Empty(t, b.messages)
+}
+
+func Test_CheckpointStoreInterval(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryEventStore()
+	cps, err := loadCheckpoints(ctx, store, "stream")
+	require.NoError(t, err)
+	cps.storeInterval = time.Hour
+
+	stored := func() chainPosition {
+		loaded, err := loadCheckpoints(ctx, store, "stream")
+		require.NoError(t, err)
+		pos, _ := loaded.resendFrom()
+		return pos
+	}
+
+	// the first checkpoint is stored, and later ones wait for the interval
+	key := chainKey{PublisherID: "0xa", MsgChainID: "chain"}
+	require.NoError(t, cps.advance(ctx, checkpoint{key, chainPosition{Timestamp: 10}}))
+	require.NoError(t, cps.advance(ctx, checkpoint{key, chainPosition{Timestamp: 20}}))
+	require.Equal(t, chainPosition{Timestamp: 10}, stored())
+	require.True(t, cps.seen(key, chainPosition{Timestamp: 20}))
+
+	// they are stored when flushed, such as when the listener stops
+	require.NoError(t, cps.flush(ctx, time.Now()))
+	require.Equal(t, chainPosition{Timestamp: 20}, stored())
+}
@@ -0,0 +1,161 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// pgUndefinedTable is the Postgres error code of a table that does not
+// exist.
+const pgUndefinedTable = "42P01"
+
+// NodeDatabase is the connection to the node's own Postgres database, that
+// the committed cursor is read from. Listeners are not given access to the
+// node's database, so kwild must pass its database config with
+// SetNodeDatabase before it starts the listeners. Empty fields use the
+// defaults of kwild.
+type NodeDatabase struct {
+	Host string
+	Port string
+	User string
+	Pass string
+	Name string
+}
+
+// NodeDatabaseFunc resolves the node's database config.
+type NodeDatabaseFunc func() (*NodeDatabase, error)
+
+// nodeDatabase resolves the node's database, set by SetNodeDatabase.
+var nodeDatabase atomic.Pointer[NodeDatabaseFunc]
+
+// SetNodeDatabase sets how the connection to the node's database is
+// resolved. It must be called before kwild starts the listeners, and is
+// only used by listeners that resume from the committed cursor, so an
+// error resolving it only fails those.
+func SetNodeDatabase(fn NodeDatabaseFunc) {
+	if fn == nil {
+		nodeDatabase.Store(nil)
+		return
+	}
+	nodeDatabase.Store(&fn)
+}
+
+// cursorConfig configures resuming from the cursor that the resolution
+// commits for the subscription. The cursor is read from the node's own
+// Postgres database.
+type cursorConfig struct {
+	Host string
+	Port uint16
+	User string
+	Pass string
+	Name string
+}
+
+// parseCursorConfig parses the cursor configuration, using the database
+// set by SetNodeDatabase. It returns nil if resuming from the cursor is not
+// configured.
+func parseCursorConfig(m map[string]string) (*cursorConfig, error) {
+	v, ok := m["cursor"]
+	if !ok {
+		return nil, nil
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor config: %s", v)
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	conf := &cursorConfig{
+		Host: "127.0.0.1",
+		Port: 5432,
+		User: "kwild",
+		Name: "kwild",
+	}
+	fn := nodeDatabase.Load()
+	if fn == nil {
+		return conf, nil
+	}
+	db, err := (*fn)()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node database config: %w", err)
+	}
+
+	if db.Host != "" {
+		conf.Host = db.Host
+	}
+	if db.Port != "" {
+		port, err := strconv.ParseUint(db.Port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node database port: %s", db.Port)
+		}
+		conf.Port = uint16(port)
+	}
+	if db.User != "" {
+		conf.User = db.User
+	}
+	conf.Pass = db.Pass
+	if db.Name != "" {
+		conf.Name = db.Name
+	}
+
+	return conf, nil
+}
+
+// readCursors reads the committed cursors of a stream and target from the
+// node's database. It returns no cursors if none have been committed.
+func readCursors(ctx context.Context, conf *cursorConfig, stream, dbid, target string) ([]checkpoint, error) {
+	cfg, err := pgx.ParseConfig("")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Host, cfg.Port, cfg.User, cfg.Password, cfg.Database = conf.Host, conf.Port, conf.User, conf.Pass, conf.Name
+
+	conn, err := pgx.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Postgres: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	// the resolution creates its state when it applies its first event
+	rows, err := conn.Query(ctx, resolution.ListCursors, stream, dbid, strings.ToLower(target))
+	if isUndefinedTable(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cursors []checkpoint
+	for rows.Next() {
+		var streamID, targetDBID, tgt string
+		var cp checkpoint
+		if err := rows.Scan(&streamID, &targetDBID, &tgt, &cp.PublisherID, &cp.MsgChainID, &cp.Timestamp, &cp.Sequence); err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, cp)
+	}
+
+	if err := rows.Err(); isUndefinedTable(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
+
+func isUndefinedTable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable
+}
@@ -0,0 +1,276 @@
+package listener
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/client"
+)
+
+const (
+	// DeadLetterFile is the name of the file that dead letters are
+	// written to, in the dead letter directory. Rotated files are named
+	// dead_letter.<n>.jsonl, where higher numbers are older.
+	DeadLetterFile = "dead_letter.jsonl"
+	// DeadLetterReplayDir is the directory, in the dead letter directory,
+	// of the dead letter files that the listener re-processes when it
+	// starts.
+	DeadLetterReplayDir = "replay"
+
+	// defaultDeadLetterMaxSize is the default size, in bytes, at which the
+	// dead letter file is rotated.
+	defaultDeadLetterMaxSize = 64 << 20
+	// defaultDeadLetterMaxFiles is the default number of rotated dead
+	// letter files that are kept.
+	defaultDeadLetterMaxFiles = 5
+)
+
+// The stages at which a message can fail.
+const (
+	stageDecode    = "decode"
+	stageContent   = "content"
+	stageDedup     = "dedup"
+	stageMapping   = "mapping"
+	stageSteps     = "steps"
+	stageAggregate = "aggregate"
+	stageMarshal   = "marshal"
+)
+
+// DeadLetter is a message that the listener could not turn into an event.
+type DeadLetter struct {
+	// Time is when the message failed.
+	Time time.Time `json:"time"`
+	// Stage is the stage at which the message failed.
+	Stage string `json:"stage"`
+	// Mapping is the mapping that failed, as param:field. It is only set
+	// if a field could not be read from the message.
+	Mapping string `json:"mapping,omitempty"`
+	// Element is the index of the element that failed, if the message was
+	// exploded.
+	Element *int64 `json:"element,omitempty"`
+	// Error is the error of the message.
+	Error string `json:"error"`
+	// Message is the message, with its metadata. It is nil if the message
+	// could not be decoded.
+	Message *client.StreamrEvent `json:"message,omitempty"`
+	// Raw is the raw payload of a message that could not be decoded.
+	Raw string `json:"raw,omitempty"`
+}
+
+// deadLetterConfig configures the capture of messages that cannot be
+// turned into events.
+type deadLetterConfig struct {
+	// Dir is the directory that dead letters are written to.
+	Dir string
+	// MaxSize is the size, in bytes, at which the dead letter file is
+	// rotated.
+	MaxSize int64
+	// MaxFiles is the number of rotated dead letter files that are kept.
+	MaxFiles int
+}
+
+// parseDeadLetterConfig parses the dead letter configuration.
+// It returns nil if dead letters are not captured.
+func parseDeadLetterConfig(m map[string]string) (*deadLetterConfig, error) {
+	dir, ok := m["dead_letter_dir"]
+	if !ok {
+		if _, ok := m["dead_letter_max_size"]; ok {
+			return nil, errors.New("dead_letter_max_size requires dead_letter_dir")
+		}
+		if _, ok := m["dead_letter_max_files"]; ok {
+			return nil, errors.New("dead_letter_max_files requires dead_letter_dir")
+		}
+		return nil, nil
+	}
+	if dir == "" {
+		return nil, errors.New("invalid dead_letter_dir config: empty")
+	}
+
+	conf := &deadLetterConfig{
+		Dir:      dir,
+		MaxSize:  defaultDeadLetterMaxSize,
+		MaxFiles: defaultDeadLetterMaxFiles,
+	}
+
+	var err error
+	if v, ok := m["dead_letter_max_size"]; ok {
+		conf.MaxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || conf.MaxSize < 1 {
+			return nil, fmt.Errorf("invalid dead_letter_max_size config: %s", v)
+		}
+	}
+	if v, ok := m["dead_letter_max_files"]; ok {
+		conf.MaxFiles, err = strconv.Atoi(v)
+		if err != nil || conf.MaxFiles < 0 {
+			return nil, fmt.Errorf("invalid dead_letter_max_files config: %s", v)
+		}
+	}
+
+	return conf, nil
+}
+
+// deadLetters writes dead letters to a rotating JSONL file.
+type deadLetters struct {
+	conf *deadLetterConfig
+	file *os.File
+	size int64
+}
+
+// openDeadLetters opens the dead letter file, creating its directory if
+// needed. New dead letters are appended to the file.
+func openDeadLetters(conf *deadLetterConfig) (*deadLetters, error) {
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create dead letter directory: %w", err)
+	}
+
+	d := &deadLetters{conf: conf}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *deadLetters) open() error {
+	f, err := os.OpenFile(filepath.Join(d.conf.Dir, DeadLetterFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead letter file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	d.file, d.size = f, info.Size()
+	return nil
+}
+
+// write appends a dead letter to the file, rotating the file first if it
+// would exceed its maximum size.
+func (d *deadLetters) write(dl *DeadLetter) error {
+	bts, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+
+	if d.size > 0 && d.size+int64(len(bts)) > d.conf.MaxSize {
+		if err := d.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate dead letter file: %w", err)
+		}
+	}
+
+	n, err := d.file.Write(bts)
+	d.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to dead_letter.1.jsonl, shifting older
+// files up, and deletes the files beyond the maximum.
+func (d *deadLetters) rotate() error {
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+
+	rotated := func(n int) string {
+		return filepath.Join(d.conf.Dir, fmt.Sprintf("dead_letter.%d.jsonl", n))
+	}
+
+	if err := os.Remove(rotated(d.conf.MaxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for n := d.conf.MaxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(rotated(n), rotated(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	current := filepath.Join(d.conf.Dir, DeadLetterFile)
+	if d.conf.MaxFiles == 0 {
+		if err := os.Remove(current); err != nil {
+			return err
+		}
+	} else if err := os.Rename(current, rotated(1)); err != nil {
+		return err
+	}
+
+	return d.open()
+}
+
+func (d *deadLetters) Close() error {
+	return d.file.Close()
+}
+
+// DeadLetterFiles returns the dead letter files of a directory, oldest
+// first. The replay directory is not included.
+func DeadLetterFiles(dir string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(dir, "dead_letter.*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	numbered := make(map[string]int, len(rotated))
+	for _, file := range rotated {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "dead_letter."), ".jsonl"))
+		if err != nil {
+			continue // not a rotated file
+		}
+		numbered[file] = n
+	}
+
+	files := make([]string, 0, len(numbered)+1)
+	for file := range numbered {
+		files = append(files, file)
+	}
+	// higher numbers are older
+	slices.SortFunc(files, func(a, b string) int {
+		return numbered[b] - numbered[a]
+	})
+
+	current := filepath.Join(dir, DeadLetterFile)
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// ReadDeadLetters reads the dead letters of a file, in the order they were
+// written, and calls fn for each of them.
+func ReadDeadLetters(path string, fn func(*DeadLetter) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// dead letters hold whole messages, which can be larger than the
+	// default maximum line.
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		dl := &DeadLetter{}
+		if err := json.Unmarshal(scanner.Bytes(), dl); err != nil {
+			return fmt.Errorf("invalid dead letter at %s:%d: %w", path, line, err)
+		}
+		if err := fn(dl); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,140 @@
+package listener
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/kwilteam/kwil-streamr/client"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DeadLetterConfig(t *testing.T) {
+	conf, err := parseDeadLetterConfig(map[string]string{})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	conf, err = parseDeadLetterConfig(map[string]string{"dead_letter_dir": "/tmp/dl", "dead_letter_max_files": "0"})
+	require.NoError(t, err)
+	require.Equal(t, &deadLetterConfig{Dir: "/tmp/dl", MaxSize: defaultDeadLetterMaxSize}, conf)
+
+	_, err = parseDeadLetterConfig(map[string]string{"dead_letter_max_size": "100"})
+	require.Error(t, err)
+
+	_, err = parseDeadLetterConfig(map[string]string{"dead_letter_dir": "/tmp/dl", "dead_letter_max_size": "0"})
+	require.Error(t, err)
+}
+
+func Test_DeadLetterRotation(t *testing.T) {
+	dir := t.TempDir()
+	d, err := openDeadLetters(&deadLetterConfig{Dir: dir, MaxSize: 100, MaxFiles: 2})
+	require.NoError(t, err)
+	defer d.Close()
+
+	// each dead letter is larger than half the maximum size, so each is
+	// written to its own file.
+	for _, e := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, d.write(&DeadLetter{Stage: stageDecode, Error: e, Raw: strings.Repeat(e, 40)}))
+	}
+
+	files, err := DeadLetterFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "dead_letter.2.jsonl"),
+		filepath.Join(dir, "dead_letter.1.jsonl"),
+		filepath.Join(dir, DeadLetterFile),
+	}, files)
+
+	// the oldest file was deleted
+	var errs []string
+	for _, file := range files {
+		require.NoError(t, ReadDeadLetters(file, func(dl *DeadLetter) error {
+			errs = append(errs, dl.Error)
+			return nil
+		}))
+	}
+	require.Equal(t, []string{"b", "c", "d"}, errs)
+}
+
+func Test_DeadLetterReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := newMemoryEventStore()
+
+	newListener := func(mappings map[string]string) *streamrListener {
+		conf := &listenerConfig{
+			Stream:          "stream",
+			TargetDB:        "db",
+			TargetProcedure: "write",
+			InputMappings:   mappings,
+			Explode:         "records",
+			DeadLetter:      &deadLetterConfig{Dir: dir, MaxSize: defaultDeadLetterMaxSize},
+		}
+		d, err := openDeadLetters(conf.DeadLetter)
+		require.NoError(t, err)
+		t.Cleanup(func() { d.Close() })
+
+		return &streamrListener{
+			config: conf,
+			broadcaster: &broadcaster{
+				eventstore:  store,
+				idVersion:   resolution.LatestIDVersion,
+				wireVersion: resolution.LatestWireVersion,
+				logger:      log.NewNoOp().Sugar(),
+			},
+			deadLetters: d,
+			logger:      log.NewNoOp().Sugar(),
+		}
+	}
+
+	msg := &client.StreamrEvent{
+		Content: map[string]any{"records": []any{
+			map[string]any{"temp": 1.5},
+			map[string]any{"temperature": 2.5},
+		}},
+	}
+	msg.Metadata.PublisherID = "0xa"
+	msg.Metadata.Timestamp = 1000
+
+	// the second element was renamed by the publisher
+	l := newListener(map[string]string{"temp": "temp"})
+	l.apply(ctx, l.parse(&delivery{msg: msg}))
+	require.Len(t, store.broadcast, 1)
+
+	var dls []*DeadLetter
+	require.NoError(t, ReadDeadLetters(filepath.Join(dir, DeadLetterFile), func(dl *DeadLetter) error {
+		dls = append(dls, dl)
+		return nil
+	}))
+	require.Len(t, dls, 1)
+	require.Equal(t, stageMapping, dls[0].Stage)
+	require.Equal(t, "temp:temp", dls[0].Mapping)
+	require.EqualValues(t, 1, *dls[0].Element)
+	require.Equal(t, "0xa", dls[0].Message.Metadata.PublisherID)
+
+	// queue the file, and replay it with the fixed mapping. Only the
+	// failed element is replayed.
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, DeadLetterReplayDir), 0o755))
+	require.NoError(t, os.Rename(filepath.Join(dir, DeadLetterFile), filepath.Join(dir, DeadLetterReplayDir, "1.jsonl")))
+
+	l = newListener(map[string]string{"temp": "temperature"})
+	l.replay(ctx)
+	require.Len(t, store.broadcast, 2)
+
+	ev := &resolution.StreamrEvent{}
+	require.NoError(t, ev.UnmarshalBinary(store.broadcast[1]))
+	require.EqualValues(t, 1, ev.ElementIndex)
+	require.Equal(t, "2.5", ev.Values[0].Value)
+
+	// replayed files are deleted, and nothing failed again
+	files, err := filepath.Glob(filepath.Join(dir, DeadLetterReplayDir, "*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+	info, err := os.Stat(filepath.Join(dir, DeadLetterFile))
+	require.NoError(t, err)
+	require.Zero(t, info.Size())
+}
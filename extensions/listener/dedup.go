@@ -0,0 +1,177 @@
+package listener
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// defaultDedupSize is the default maximum number of keys in the dedup
+// cache.
+const defaultDedupSize = 100000
+
+// dedupLogInterval is how often the number of dropped messages is logged.
+const dedupLogInterval = time.Minute
+
+// dedupConfig configures the dropping of repeated messages.
+type dedupConfig struct {
+	// TTL is how long a message's key is remembered.
+	TTL time.Duration
+	// Size is the maximum number of keys that are remembered. If it is
+	// exceeded, the oldest keys are forgotten early.
+	Size int
+	// Fields are the mapping fields whose values are a message's key. If
+	// it is empty, the key is the message's event ID.
+	Fields map[string]string
+}
+
+// parseDedupConfig parses the dedup configuration.
+// It returns nil if dedup is not configured.
+func parseDedupConfig(m map[string]string) (*dedupConfig, error) {
+	ttl, hasTTL := m["dedup_ttl"]
+	size, hasSize := m["dedup_size"]
+	key, hasKey := m["dedup_key"]
+	if !hasTTL && !hasSize && !hasKey {
+		return nil, nil
+	}
+	if !hasTTL {
+		return nil, errors.New("missing required dedup_ttl config")
+	}
+
+	conf := &dedupConfig{
+		Size: defaultDedupSize,
+	}
+
+	var err error
+	conf.TTL, err = time.ParseDuration(ttl)
+	if err != nil || conf.TTL <= 0 {
+		return nil, fmt.Errorf("invalid dedup_ttl config: %s", ttl)
+	}
+
+	if hasSize {
+		conf.Size, err = strconv.Atoi(size)
+		if err != nil || conf.Size < 1 {
+			return nil, fmt.Errorf("invalid dedup_size config: %s", size)
+		}
+	}
+
+	if hasKey {
+		fields, err := splitUnquoted(key, '+')
+		if err != nil {
+			return nil, fmt.Errorf("invalid dedup_key config: %w", err)
+		}
+
+		conf.Fields = make(map[string]string)
+		for i, field := range fields {
+			_, mods, err := parseField(field)
+			if err != nil || field == "" {
+				return nil, fmt.Errorf("invalid dedup_key config: %s", key)
+			}
+			if mods.Optional {
+				return nil, fmt.Errorf("invalid dedup_key config: field %s cannot be optional, use a default instead", field)
+			}
+			// the fields are named by position, so that the key keeps
+			// their order once the values are sorted by name.
+			conf.Fields[fmt.Sprintf("%04d", i)] = field
+		}
+	}
+
+	return conf, nil
+}
+
+// dedupEntry is a remembered key.
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// dedupCache remembers the keys of recent messages, so that messages that
+// are received again are dropped. Since every key is remembered for the
+// same time, keys expire in the order they were added.
+type dedupCache struct {
+	conf *dedupConfig
+	// order holds the entries in the order they were added.
+	order *list.List
+	keys  map[string]*list.Element
+	// duplicates is the number of dropped messages.
+	duplicates int64
+	// reported is the number of dropped messages that were last logged,
+	// at lastReport.
+	reported   int64
+	lastReport time.Time
+}
+
+func newDedupCache(conf *dedupConfig) *dedupCache {
+	return &dedupCache{
+		conf:  conf,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+	}
+}
+
+// key returns the dedup key of a message.
+func (d *dedupCache) key(m *message) (string, error) {
+	if len(d.conf.Fields) == 0 {
+		ev := m.event(nil, "", "")
+		ev.IDVersion = resolution.IDVersion1
+		return ev.TxID(), nil
+	}
+
+	values, err := m.parse(d.conf.Fields)
+	if err != nil {
+		return "", err
+	}
+
+	// values are sorted by name, which is their position in the key
+	parts := make([]string, len(values))
+	for i, v := range values {
+		if v.IsArray {
+			parts[i] = strings.Join(v.ValueArray, ",")
+		} else {
+			parts[i] = v.Value
+		}
+	}
+	return strings.Join(parts, "\x00"), nil
+}
+
+// seen remembers a key, and returns true if it was already remembered.
+func (d *dedupCache) seen(key string, now time.Time) bool {
+	for front := d.order.Front(); front != nil && !now.Before(front.Value.(*dedupEntry).expires); front = d.order.Front() {
+		d.forget(front)
+	}
+
+	if _, ok := d.keys[key]; ok {
+		d.duplicates++
+		return true
+	}
+
+	// if the cache is full, the oldest keys are forgotten early
+	for d.order.Len() >= d.conf.Size {
+		d.forget(d.order.Front())
+	}
+
+	d.keys[key] = d.order.PushBack(&dedupEntry{key: key, expires: now.Add(d.conf.TTL)})
+	return false
+}
+
+func (d *dedupCache) forget(e *list.Element) {
+	d.order.Remove(e)
+	delete(d.keys, e.Value.(*dedupEntry).key)
+}
+
+// report returns the number of messages dropped since the last report, if
+// a report is due.
+func (d *dedupCache) report(now time.Time) (int64, bool) {
+	if d.duplicates == d.reported || now.Sub(d.lastReport) < dedupLogInterval {
+		return 0, false
+	}
+
+	n := d.duplicates - d.reported
+	d.reported, d.lastReport = d.duplicates, now
+	return n, true
+}
@@ -0,0 +1,99 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DedupConfig(t *testing.T) {
+	conf, err := parseDedupConfig(map[string]string{})
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	conf, err = parseDedupConfig(map[string]string{"dedup_ttl": "10m", "dedup_key": "device_id+time"})
+	require.NoError(t, err)
+	require.Equal(t, &dedupConfig{
+		TTL:    10 * time.Minute,
+		Size:   defaultDedupSize,
+		Fields: map[string]string{"0000": "device_id", "0001": "time"},
+	}, conf)
+
+	_, err = parseDedupConfig(map[string]string{"dedup_key": "device_id"})
+	require.Error(t, err)
+
+	_, err = parseDedupConfig(map[string]string{"dedup_ttl": "10m", "dedup_size": "0"})
+	require.Error(t, err)
+
+	_, err = parseDedupConfig(map[string]string{"dedup_ttl": "10m", "dedup_key": "device_id++time"})
+	require.Error(t, err)
+
+	// keys cannot be null, but they can be defaulted
+	_, err = parseDedupConfig(map[string]string{"dedup_ttl": "10m", "dedup_key": "device_id+time|optional"})
+	require.Error(t, err)
+
+	_, err = parseDedupConfig(map[string]string{"dedup_ttl": "10m", "dedup_key": "device_id+time|default=0"})
+	require.NoError(t, err)
+}
+
+func Test_DedupCache(t *testing.T) {
+	now := time.Now()
+	d := newDedupCache(&dedupConfig{TTL: time.Minute, Size: 2})
+
+	require.False(t, d.seen("a", now))
+	require.True(t, d.seen("a", now.Add(time.Second)))
+
+	// keys are forgotten once they expire
+	require.False(t, d.seen("a", now.Add(time.Minute)))
+
+	// the oldest keys are forgotten early if the cache is full
+	require.False(t, d.seen("b", now.Add(time.Minute)))
+	require.False(t, d.seen("c", now.Add(time.Minute)))
+	require.False(t, d.seen("a", now.Add(time.Minute)))
+	require.True(t, d.seen("c", now.Add(time.Minute)))
+
+	require.EqualValues(t, 2, d.duplicates)
+	n, ok := d.report(now.Add(time.Minute))
+	require.True(t, ok)
+	require.EqualValues(t, 2, n)
+	_, ok = d.report(now.Add(time.Minute))
+	require.False(t, ok)
+}
+
+func Test_DedupKey(t *testing.T) {
+	msg := func(seq int64, index int64, content map[string]any) *message {
+		return &message{
+			position: position{streamID: "s", publisherID: "p", chainID: "c", timestamp: 1, sequence: seq},
+			content:  content,
+			exploded: index >= 0,
+			index:    index,
+		}
+	}
+
+	// by default, the key is the event ID, which tells apart the
+	// elements of a message
+	d := newDedupCache(&dedupConfig{TTL: time.Minute, Size: 10})
+	a, err := d.key(msg(0, 0, nil))
+	require.NoError(t, err)
+	b, err := d.key(msg(0, 1, nil))
+	require.NoError(t, err)
+	require.NotEqual(t, a, b)
+	again, err := d.key(msg(0, 0, nil))
+	require.NoError(t, err)
+	require.Equal(t, a, again)
+
+	// a content key ignores the position, and keeps the order of fields
+	conf, err := parseDedupConfig(map[string]string{"dedup_ttl": "1m", "dedup_key": "device_id+time"})
+	require.NoError(t, err)
+	d = newDedupCache(conf)
+	a, err = d.key(msg(0, -1, map[string]any{"device_id": "d1", "time": "t1"}))
+	require.NoError(t, err)
+	b, err = d.key(msg(5, -1, map[string]any{"device_id": "d1", "time": "t1", "temp": 2}))
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+	require.Equal(t, "d1\x00t1", a)
+
+	_, err = d.key(msg(0, -1, map[string]any{"device_id": "d1"}))
+	require.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// modifierSeparator separates a mapping's field path from its modifiers,
+// e.g. "data.readings|json".
+const modifierSeparator = "|"
+
+// fieldModifiers are the modifiers that can be applied to a mapped field.
+type fieldModifiers struct {
+	// JSON serializes the field as canonical JSON text, instead of
+	// requiring it to be a scalar or an array of scalars. It allows
+	// objects and arrays of objects to be mapped to text parameters.
+	JSON bool
+	// Optional maps a field that is missing or null to a null value,
+	// instead of failing the message.
+	Optional bool
+	// Default is the value of a field that is missing or null, instead of
+	// failing the message. It is nil if the field has no default.
+	Default *string
+	// Required fails the message if the field is missing. It is the
+	// behavior of fields without modifiers, and only makes it explicit.
+	Required bool
+}
+
+// checkNotOptional returns an error if a mapping is optional. It is used
+// for mappings whose values cannot be null.
+func checkNotOptional(mappings map[string]string) error {
+	for param, field := range mappings {
+		_, mods, err := parseField(field)
+		if err != nil {
+			return err
+		}
+		if mods.Optional {
+			return fmt.Errorf("mapping %s:%s cannot be optional, use a default instead", param, field)
+		}
+	}
+	return nil
+}
+
+// hasAbsentMappings returns true if any of the mappings is optional or has
+// a default.
+func hasAbsentMappings(mappings map[string]string) bool {
+	for _, field := range mappings {
+		if _, mods, err := parseField(field); err == nil && mods.absent() {
+			return true
+		}
+	}
+	return false
+}
+
+// absent returns true if the field may be missing or null.
+func (m *fieldModifiers) absent() bool {
+	return m.Optional || m.Default != nil
+}
+
+// splitUnquoted splits s around each sep that is not within double quotes.
+// Within quotes, a backslash escapes the next character. It returns an
+// error if a quote is not closed.
+func splitUnquoted(s string, sep byte) ([]string, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in %s", s)
+	}
+
+	return append(parts, s[start:]), nil
+}
+
+// parseDefault parses the value of a default modifier. A value in double
+// quotes is unquoted with Go's string syntax, so that it can contain the
+// separators of mappings and modifiers.
+func parseDefault(value string) (string, error) {
+	if !strings.HasPrefix(value, `"`) {
+		if strings.Contains(value, `"`) {
+			return "", fmt.Errorf("default value %s must be quoted as a whole", value)
+		}
+		return value, nil
+	}
+
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted default value %s", value)
+	}
+	return unquoted, nil
+}
+
+// parseField splits a mapping's field into its path and modifiers.
+func parseField(field string) (path string, mods *fieldModifiers, err error) {
+	parts, err := splitUnquoted(field, modifierSeparator[0])
+	if err != nil {
+		return "", nil, err
+	}
+	mods = &fieldModifiers{}
+	presence := 0
+	for _, mod := range parts[1:] {
+		name, value, hasValue := strings.Cut(mod, "=")
+		switch strings.ToLower(name) {
+		case "json":
+			mods.JSON = true
+		case "optional":
+			mods.Optional = true
+			presence++
+		case "required":
+			mods.Required = true
+			presence++
+		case "default":
+			if !hasValue {
+				return "", nil, fmt.Errorf("missing value of default modifier for field %s", parts[0])
+			}
+			value, err = parseDefault(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("field %s: %w", parts[0], err)
+			}
+			mods.Default = &value
+			presence++
+			continue
+		default:
+			return "", nil, fmt.Errorf("unknown modifier %s for field %s", mod, parts[0])
+		}
+		if hasValue {
+			return "", nil, fmt.Errorf("modifier %s for field %s does not take a value", name, parts[0])
+		}
+	}
+	if presence > 1 {
+		return "", nil, fmt.Errorf("field %s can only have one of the optional, default and required modifiers", parts[0])
+	}
+
+	return parts[0], mods, nil
+}
+
+// searchJSON searches for a field in a JSON object, and returns it
+// serialized as canonical JSON.
+func searchJSON(obj map[string]any, field string) (string, error) {
+	v, err := lookupField(obj, field)
+	if err != nil {
+		return "", err
+	}
+
+	return canonicalJSON(v)
+}
+
+// canonicalJSON serializes a decoded JSON value so that all validators
+// produce byte-identical text for the same value. Object keys are sorted,
+// numbers are written in their shortest form (switching to exponent
+// notation at 1e21, as in RFC 8785), negative zero is written as 0, there is
+// no insignificant whitespace, and HTML characters are not escaped.
+func canonicalJSON(v any) (string, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(normalizeJSON(v)); err != nil {
+		return "", fmt.Errorf("failed to serialize JSON: %w", err)
+	}
+
+	// Encode always appends a newline
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// normalizeJSON returns a copy of a decoded JSON value with all negative
+// zeros replaced by zero. encoding/json already sorts map keys and
+// formats floats in their shortest form.
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, val := range v {
+			res[k] = normalizeJSON(val)
+		}
+		return res
+	case []any:
+		res := make([]any, len(v))
+		for i, val := range v {
+			res[i] = normalizeJSON(val)
+		}
+		return res
+	case float64:
+		if v == 0 {
+			return float64(0)
+		}
+		return v
+	case float32:
+		if v == 0 {
+			return float32(0)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,107 @@
+package listener
+
+import (
+	"fmt"
+	"time"
+)
+
+// freshnessLogInterval is how often the number of stale and future
+// messages is logged.
+const freshnessLogInterval = time.Minute
+
+// defaultMaxFutureSkew is the max_future_skew used with replay protection,
+// if it is not configured. The resolution advances the replay horizon of a
+// scope to the latest timestamp it applied, and is not given the block
+// time to bound it with, so events from the future must not be voted on.
+const defaultMaxFutureSkew = time.Minute
+
+// freshnessConfig configures the dropping of messages whose timestamp is
+// too far from the local time.
+type freshnessConfig struct {
+	// MaxAge is how far in the past a message's timestamp may be. If it is
+	// 0, old messages are accepted.
+	MaxAge time.Duration
+	// MaxFutureSkew is how far in the future a message's timestamp may be.
+	// If it is 0, future messages are accepted.
+	MaxFutureSkew time.Duration
+}
+
+// parseFreshnessConfig parses the freshness configuration. With replay
+// protection, max_future_skew defaults to defaultMaxFutureSkew. Otherwise,
+// it returns nil if neither check is configured.
+func parseFreshnessConfig(m map[string]string, replay bool) (*freshnessConfig, error) {
+	maxAge, hasAge := m["max_message_age"]
+	maxSkew, hasSkew := m["max_future_skew"]
+	if !hasAge && !hasSkew && !replay {
+		return nil, nil
+	}
+
+	conf := &freshnessConfig{}
+	if replay {
+		conf.MaxFutureSkew = defaultMaxFutureSkew
+	}
+	var err error
+	if hasAge {
+		conf.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil || conf.MaxAge <= 0 {
+			return nil, fmt.Errorf("invalid max_message_age config: %s", maxAge)
+		}
+	}
+	if hasSkew {
+		conf.MaxFutureSkew, err = time.ParseDuration(maxSkew)
+		if err != nil || conf.MaxFutureSkew <= 0 {
+			return nil, fmt.Errorf("invalid max_future_skew config: %s", maxSkew)
+		}
+	}
+
+	return conf, nil
+}
+
+// The reasons that messages fail the freshness checks.
+const (
+	filterStale  = "stale"
+	filterFuture = "future"
+)
+
+// freshness checks the timestamps of messages against the local time.
+type freshness struct {
+	conf *freshnessConfig
+	// stale and future are the number of dropped messages.
+	stale  int64
+	future int64
+	// reported is the number of dropped messages that were last logged,
+	// at lastReport.
+	reported   int64
+	lastReport time.Time
+}
+
+func newFreshness(conf *freshnessConfig) *freshness {
+	return &freshness{conf: conf}
+}
+
+// check returns the reason that a message with the given timestamp, in
+// milliseconds, must be dropped, or "" if it is accepted.
+func (f *freshness) check(timestamp int64, now time.Time) string {
+	age := now.Sub(time.UnixMilli(timestamp))
+	if f.conf.MaxAge > 0 && age > f.conf.MaxAge {
+		f.stale++
+		return filterStale
+	}
+	if f.conf.MaxFutureSkew > 0 && -age > f.conf.MaxFutureSkew {
+		f.future++
+		return filterFuture
+	}
+	return ""
+}
+
+// report returns the total number of stale and future messages dropped,
+// if more were dropped since the last report and a report is due.
+func (f *freshness) report(now time.Time) (stale, future int64, ok bool) {
+	total := f.stale + f.future
+	if total == f.reported || now.Sub(f.lastReport) < freshnessLogInterval {
+		return 0, 0, false
+	}
+
+	f.reported, f.lastReport = total, now
+	return f.stale, f.future, true
+}
@@ -0,0 +1,67 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FreshnessConfig(t *testing.T) {
+	conf, err := parseFreshnessConfig(map[string]string{}, false)
+	require.NoError(t, err)
+	require.Nil(t, conf)
+
+	conf, err = parseFreshnessConfig(map[string]string{"max_message_age": "1h"}, false)
+	require.NoError(t, err)
+	require.Equal(t, &freshnessConfig{MaxAge: time.Hour}, conf)
+
+	// replay protection refuses future messages by default.
+	conf, err = parseFreshnessConfig(map[string]string{}, true)
+	require.NoError(t, err)
+	require.Equal(t, &freshnessConfig{MaxFutureSkew: defaultMaxFutureSkew}, conf)
+	conf, err = parseFreshnessConfig(map[string]string{"max_future_skew": "1h"}, true)
+	require.NoError(t, err)
+	require.Equal(t, &freshnessConfig{MaxFutureSkew: time.Hour}, conf)
+
+	_, err = parseFreshnessConfig(map[string]string{"max_future_skew": "0s"}, false)
+	require.Error(t, err)
+	_, err = parseFreshnessConfig(map[string]string{"max_message_age": "hour"}, false)
+	require.Error(t, err)
+}
+
+func Test_Freshness(t *testing.T) {
+	now := time.UnixMilli(1_000_000_000)
+	ms := func(d time.Duration) int64 { return now.Add(d).UnixMilli() }
+
+	type testcase struct {
+		name      string
+		conf      freshnessConfig
+		timestamp int64
+		want      string
+	}
+	for _, tc := range []testcase{
+		{name: "no checks", timestamp: ms(-24 * time.Hour)},
+		{name: "recent", conf: freshnessConfig{MaxAge: time.Minute, MaxFutureSkew: time.Second}, timestamp: ms(-time.Minute)},
+		{name: "stale", conf: freshnessConfig{MaxAge: time.Minute}, timestamp: ms(-time.Minute - time.Millisecond), want: filterStale},
+		{name: "slightly ahead", conf: freshnessConfig{MaxFutureSkew: time.Second}, timestamp: ms(time.Second)},
+		{name: "future", conf: freshnessConfig{MaxFutureSkew: time.Second}, timestamp: ms(time.Second + time.Millisecond), want: filterFuture},
+		{name: "future without skew check", conf: freshnessConfig{MaxAge: time.Minute}, timestamp: ms(time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := tc.conf
+			require.Equal(t, tc.want, newFreshness(&conf).check(tc.timestamp, now))
+		})
+	}
+
+	f := newFreshness(&freshnessConfig{MaxAge: time.Minute, MaxFutureSkew: time.Minute})
+	f.check(ms(-time.Hour), now)
+	f.check(ms(time.Hour), now)
+	f.check(ms(time.Hour), now)
+	stale, future, ok := f.report(now)
+	require.True(t, ok)
+	require.EqualValues(t, 1, stale)
+	require.EqualValues(t, 2, future)
+	_, _, ok = f.report(now)
+	require.False(t, ok)
+}
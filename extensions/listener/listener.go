@@ -7,21 +7,32 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/kwilteam/kwil-streamr/client"
 	"github.com/kwilteam/kwil-streamr/extensions/resolution"
 
 	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/core/log"
 	"github.com/kwilteam/kwil-db/core/utils"
 	"github.com/kwilteam/kwil-db/extensions/listeners"
+	"github.com/kwilteam/kwil-db/extensions/resolutions"
 )
 
 const ExtensionName = "streamr_listener"
 
+// shutdownFlushTimeout is how long the listener may take to broadcast the
+// windows that have ended when it stops.
+const shutdownFlushTimeout = 5 * time.Second
+
 // StartStreamrListener starts the local nodes listener for Streamr events.
+// It only returns if its context is cancelled, or if its configuration is
+// invalid: a subscription that fails is restarted.
 func StartStreamrListener(ctx context.Context, service *common.Service, eventstore listeners.EventStore) error {
 	service.Logger.Info("starting Streamr listener")
 	listenerConf, ok := service.ExtensionConfigs["streamr"]
@@ -36,7 +47,8 @@ func StartStreamrListener(ctx context.Context, service *common.Service, eventsto
 	}
 
 	clientOpts := &client.ClientConfig{
-		Logger: &service.Logger,
+		Logger:      &service.Logger,
+		OnReconnect: reconnects.Inc,
 	}
 	if config.StreamrApiKey != "" {
 		clientOpts.ApiKey = &config.StreamrApiKey
@@ -45,58 +57,476 @@ func StartStreamrListener(ctx context.Context, service *common.Service, eventsto
 		clientOpts.MaxRetrys = &config.MaxReconnects
 	}
 
+	var cps *checkpoints
+	if config.Checkpoint {
+		var err error
+		cps, err = loadCheckpoints(ctx, eventstore, config.Stream)
+		if err != nil {
+			return err
+		}
+	} else if config.Cursor != nil {
+		cps = newCheckpoints()
+	}
+
+	broadcaster := &broadcaster{
+		eventstore:      eventstore,
+		resolutionType:  config.ResolutionType,
+		idVersion:       config.IDVersion,
+		wireVersion:     config.WireVersion,
+		replayRetention: config.ReplayRetention,
+		recordFailures:  config.RecordFailures,
+		shadow:          config.Shadow,
+		trackCursor:     config.Cursor != nil,
+		checkpoints:     cps,
+		pending:         make(map[*resolution.StreamrEvent]checkpoint),
+		messages:        make(map[checkpoint]*messageEvents),
+		logger:          service.Logger,
+	}
+	if config.Batch != nil {
+		broadcaster.batcher = newBatcher(config.Batch, config.WireVersion)
+	}
+
+	l := &streamrListener{
+		config:      config,
+		clientOpts:  clientOpts,
+		checkpoints: cps,
+		broadcaster: broadcaster,
+		logger:      service.Logger,
+	}
+	if config.Dedup != nil {
+		l.dedup = newDedupCache(config.Dedup)
+	}
+	if config.Freshness != nil {
+		l.freshness = newFreshness(config.Freshness)
+	}
+	if config.Aggregate != nil {
+		l.aggregator = newAggregator(config.Aggregate, config.Stream, config.TargetDB)
+	}
+	if config.DeadLetter != nil {
+		var err error
+		l.deadLetters, err = openDeadLetters(config.DeadLetter)
+		if err != nil {
+			return err
+		}
+		defer l.deadLetters.Close()
+
+		l.replay(ctx)
+	}
+
+	if config.ProposeAllow {
+		broadcaster.proposeAllow(ctx, config.allowProposal())
+	}
+
+	if config.MetricsListenAddr != "" {
+		go serveMetrics(ctx, config.MetricsListenAddr, service.Logger)
+	}
+
 	service.Logger.Info(fmt.Sprintf("starting Streamr listener for stream %s", config.Stream))
 
-	client, err := client.NewClient(ctx, config.StreamrNodeUrl, config.Stream, clientOpts)
+	// the state of the listener is kept across subscriptions, so that a
+	// restarted subscription resumes where the failed one stopped.
+	newSupervisor(config.RestartDelay, config.RestartMaxDelay, service.Logger).run(ctx, l.subscribe)
+
+	// the windows that have ended are still broadcast, although the
+	// context is cancelled, since they would otherwise be lost.
+	flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownFlushTimeout)
+	defer cancel()
+	l.shutdown(flushCtx, time.Now())
+	return nil
+}
+
+// streamrListener holds the state of the listener that outlives a single
+// subscription.
+type streamrListener struct {
+	config     *listenerConfig
+	clientOpts *client.ClientConfig
+	// checkpoints are the positions that subscriptions resume from. They
+	// are nil if neither checkpoints nor the cursor are configured.
+	checkpoints *checkpoints
+	broadcaster *broadcaster
+	// dedup and aggregator are optional.
+	dedup      *dedupCache
+	freshness  *freshness
+	aggregator *aggregator
+	// deadLetters are where rejected messages are written. It is nil if
+	// dead letters are not captured.
+	deadLetters *deadLetters
+	logger      log.SugaredLogger
+	// subscribed is true once a subscription has connected, after which
+	// the configured start is not used again.
+	subscribed bool
+}
+
+// resume sets the resend options of a new subscription, so that it resumes
+// from the latest checkpoint or cursor, or else from the configured start.
+// It returns true if the subscription resends messages.
+func (l *streamrListener) resume(ctx context.Context, opts *client.ClientConfig) (bool, error) {
+	if l.config.Cursor != nil {
+		cursors, err := readCursors(ctx, l.config.Cursor, l.config.Stream, l.config.TargetDB, l.config.target())
+		if err != nil {
+			return false, fmt.Errorf("failed to read Streamr cursor: %w", err)
+		}
+		// the committed cursor can be ahead of the local checkpoint, or
+		// replace it if the node's data was lost.
+		if err := l.checkpoints.advance(ctx, cursors...); err != nil {
+			return false, err
+		}
+	}
+
+	if l.checkpoints != nil {
+		// a reconnect of the client resumes from the latest checkpoint,
+		// rather than repeating the resend of the subscription.
+		opts.ReconnectFrom = l.reconnectFrom
+
+		if pos, ok := l.checkpoints.resendFrom(); ok {
+			l.logger.Info("resuming Streamr stream from checkpoint", "timestamp", pos.Timestamp, "sequence", pos.Sequence)
+			opts.ResendFrom = &client.ResendPosition{
+				Timestamp:      pos.Timestamp,
+				SequenceNumber: pos.Sequence,
+			}
+			return true, nil
+		}
+	}
+
+	// the start is only used if there is nothing to resume from, so that
+	// a restart does not read the backfill again.
+	if !l.subscribed && l.config.StartFrom != nil {
+		l.logger.Info("backfilling Streamr stream", "timestamp", l.config.StartFrom.Timestamp, "last", l.config.StartFrom.Last)
+		l.config.StartFrom.resend(opts)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// reconnectFrom returns the position that a reconnecting client resends
+// from, which is the latest checkpoint.
+func (l *streamrListener) reconnectFrom() *client.ResendPosition {
+	pos, ok := l.checkpoints.resendFrom()
+	if !ok {
+		return nil
+	}
+	return &client.ResendPosition{Timestamp: pos.Timestamp, SequenceNumber: pos.Sequence}
+}
+
+// subscribe runs a single subscription to the stream. It returns an error
+// if the subscription fails, and nil once the context is cancelled.
+func (l *streamrListener) subscribe(ctx context.Context, connected func()) error {
+	opts := *l.clientOpts
+	resuming, err := l.resume(ctx, &opts)
 	if err != nil {
-		return fmt.Errorf("failed to create Streamr client: %v", err)
+		return err
 	}
-	defer client.Close()
 
-	for {
-		select {
-		case <-ctx.Done():
-			service.Logger.Info("context cancelled, stopping streamr listener")
-			return nil
-		default:
+	var catchUp *backfill
+	if resuming {
+		catchUp = newBackfill(time.Now(), l.config.BackfillRate, l.logger)
+	}
+
+	conn, err := client.NewClient(ctx, l.config.StreamrNodeUrl, l.config.Stream, &opts)
+	if err != nil {
+		return fmt.Errorf("failed to create Streamr client: %w", err)
+	}
+	defer conn.Close()
+
+	l.subscribed = true
+	connected()
+
+	// the pipeline is per subscription, so that the messages that were
+	// read before a subscription failed are applied before it restarts.
+	pl := newPipeline(l.config.Pipeline, l.config.Stream, l.parse, func(p *parsed) { l.apply(ctx, p) })
+	pl.tick = func(now time.Time) { l.tick(ctx, now) }
+	return pl.run(ctx, func(push func(*delivery) error) error {
+		for {
+			if ctx.Err() != nil {
+				return nil
+			}
+
 			// ReadMessage has built-in retry logic, so we don't need to do anything here.
-			msg, err := client.ReadMessage()
-			if err != nil {
-				service.Logger.Error("connection lost with Streamr node: %w", err)
-				return nil // return nil as to not shutdown the node
+			msg, err := conn.ReadMessage()
+			var invalid *client.InvalidMessageError
+			if err == nil || errors.As(err, &invalid) {
+				messagesReceived.Inc()
 			}
+			if errors.As(err, &invalid) {
+				// the message is still queued, so that it is rejected in
+				// order with the others.
+				if err := push(&delivery{invalid: invalid}); err != nil {
+					return nil
+				}
+				continue
+			} else if err != nil {
+				return fmt.Errorf("connection lost with Streamr node: %w", err)
+			}
+			streamLag.Set(time.Since(time.UnixMilli(msg.Metadata.Timestamp)).Seconds())
 
-			obj, ok := msg.Content.(map[string]any)
-			if !ok {
-				service.Logger.Error("invalid message content: %v", msg.Content)
-				continue // don't fail on invalid event, just skip it
+			if l.checkpoints != nil && l.checkpoints.seen(
+				newChainKey(msg.Metadata.PublisherID, msg.Metadata.MsgChainID),
+				chainPosition{Timestamp: msg.Metadata.Timestamp, Sequence: msg.Metadata.SequenceNumber},
+			) {
+				// the message was resent, and was already broadcast
+				// before the listener restarted.
+				messagesFiltered.WithLabelValues(filterResent).Inc()
+				continue
 			}
 
-			values, err := parseEvent(config.InputMappings, obj)
-			if err != nil {
-				service.Logger.Error("failed to parse event: %v", err)
-				continue // don't fail on invalid event, just skip it
+			if l.freshness != nil {
+				now := time.Now()
+				if reason := l.freshness.check(msg.Metadata.Timestamp, now); reason != "" {
+					messagesFiltered.WithLabelValues(reason).Inc()
+					l.logger.Debug("dropping Streamr message", "reason", reason, "publisher", msg.Metadata.PublisherID, "timestamp", msg.Metadata.Timestamp)
+					if stale, future, ok := l.freshness.report(now); ok {
+						l.logger.Warn("dropped Streamr messages with timestamps out of range", "stale", stale, "future", future)
+					}
+					continue
+				}
 			}
 
-			event := &resolution.StreamrEvent{
-				Timestamp:       uint64(msg.Metadata.Timestamp),
-				SequenceID:      uint64(msg.Metadata.SequenceNumber),
-				Values:          values,
-				TargetDBID:      config.TargetDB,
-				TargetProcedure: config.TargetProcedure,
-				MsgChainID:      msg.Metadata.MsgChainID,
+			if catchUp != nil {
+				if err := catchUp.wait(ctx, msg.Metadata.Timestamp); err != nil {
+					return nil
+				}
+			}
+
+			if err := push(&delivery{msg: msg}); err != nil {
+				return nil
 			}
-			bts, err := event.MarshalBinary()
+			if n, ok := pl.queue.report(time.Now()); ok {
+				l.logger.Warn("dropped Streamr messages, the queue is full", "count", n, "total", pl.queue.dropped.Load(), "policy", l.config.Pipeline.Overflow)
+			}
+		}
+	})
+}
+
+// parse parses a delivery into the events of its messages. It does not
+// use any state of the listener, so that deliveries can be parsed
+// concurrently.
+func (l *streamrListener) parse(d *delivery) *parsed {
+	if d.invalid != nil {
+		return &parsed{stage: stageDecode, err: d.invalid.Err, raw: d.invalid.Payload}
+	}
+
+	p := &parsed{msg: d.msg}
+	msgs, err := l.split(d.msg)
+	if err != nil {
+		p.stage, p.err = stageContent, err
+		return p
+	}
+
+	config := l.config
+	for _, m := range msgs {
+		e := &parsedElement{m: m}
+		p.elements = append(p.elements, e)
+
+		if l.dedup != nil {
+			e.key, e.keyErr = l.dedup.key(m)
+			if e.keyErr != nil {
+				continue
+			}
+		}
+
+		if config.TargetProcedure != "" || config.TargetTable != "" {
+			values, err := m.parse(config.InputMappings)
 			if err != nil {
-				service.Logger.Error("failed to marshal event: %v", err)
-				continue // don't fail on invalid event, just skip it
+				e.evStage, e.evErr = stageMapping, err
+				continue
+			}
+
+			e.ev = m.event(values, config.TargetDB, config.TargetProcedure)
+			e.ev.TargetTable, e.ev.OnConflict, e.ev.KeyColumn = config.TargetTable, config.OnConflict, config.KeyColumn
+			e.ev.Ordering, e.ev.LateProcedure = config.Ordering, config.LateProcedure
+			e.ev.ShadowProcedure = config.ShadowProcedure
+		}
+
+		if config.Steps != nil {
+			e.ev, e.evErr = stepsEvent(m, config.Steps, config.TargetDB)
+			if e.evErr != nil {
+				e.evStage = stageSteps
+				continue
+			}
+			e.ev.Ordering = config.Ordering
+		}
+	}
+
+	return p
+}
+
+// apply broadcasts the events of a parsed delivery, and rejects the
+// messages that failed. Deliveries must be applied in the order they were
+// read, since dedup, aggregation and batching depend on it.
+func (l *streamrListener) apply(ctx context.Context, p *parsed) {
+	if p.err != nil {
+		l.reject(&DeadLetter{Stage: p.stage, Error: p.err.Error(), Message: p.msg, Raw: string(p.raw)})
+		return // don't fail on invalid event, just skip it
+	}
+
+	// the message's checkpoint advances once all of its events are
+	// broadcast, and not with its first one.
+	cp := checkpoint{
+		chainKey:      newChainKey(p.msg.Metadata.PublisherID, p.msg.Metadata.MsgChainID),
+		chainPosition: chainPosition{Timestamp: p.msg.Metadata.Timestamp, Sequence: p.msg.Metadata.SequenceNumber},
+	}
+	l.broadcaster.hold(cp)
+	defer l.broadcaster.release(ctx, cp)
+
+	for _, e := range p.elements {
+		m := e.m
+		if l.dedup != nil {
+			if e.keyErr != nil {
+				// a message without a key cannot be handled consistently
+				l.rejectMessage(p.msg, m, stageDedup, e.keyErr)
+				continue
+			}
+
+			now := time.Now()
+			if l.dedup.seen(e.key, now) {
+				messagesFiltered.WithLabelValues(filterDuplicate).Inc()
+				l.logger.Debug("dropping duplicate Streamr message", "publisher", m.publisherID, "timestamp", m.timestamp, "sequence", m.sequence)
+				if n, ok := l.dedup.report(now); ok {
+					l.logger.Info("dropped duplicate Streamr messages", "count", n, "total", l.dedup.duplicates)
+				}
+				continue
+			}
+		}
+
+		if e.evErr != nil {
+			l.rejectMessage(p.msg, m, e.evStage, e.evErr)
+		} else if e.ev != nil {
+			if err := l.broadcaster.send(ctx, e.ev); err != nil {
+				l.rejectMessage(p.msg, m, stageMarshal, err)
 			}
+		}
 
-			err = eventstore.Broadcast(ctx, resolution.StreamrResolutionName, bts)
+		if l.aggregator != nil {
+			events, err := l.aggregator.add(m)
 			if err != nil {
-				service.Logger.Error("failed to broadcast event: %v", err)
+				l.rejectMessage(p.msg, m, stageAggregate, err)
 				continue // don't fail on invalid event, just skip it
 			}
+			l.sendAggregates(ctx, events)
+		}
+	}
+}
+
+// sendAggregates broadcasts the events of emitted windows. Aggregates do
+// not belong to a single message, so they are only logged if they cannot
+// be broadcast.
+func (l *streamrListener) sendAggregates(ctx context.Context, events []*resolution.StreamrEvent) {
+	for _, ev := range events {
+		if err := l.broadcaster.send(ctx, ev); err != nil {
+			l.logger.Error("failed to marshal aggregate", "error", err)
+		}
+	}
+}
+
+// tick flushes the windows of a stream that has gone quiet. It is called
+// by the apply stage of the pipeline.
+func (l *streamrListener) tick(ctx context.Context, now time.Time) {
+	if l.aggregator != nil {
+		l.sendAggregates(ctx, l.aggregator.flushIdle(now))
+	}
+	l.broadcaster.flushIdle(ctx, now)
+}
+
+// shutdown flushes the windows that have ended when the listener stops.
+// The aggregation windows that are still open are lost, since their
+// messages do not hold back the checkpoints.
+func (l *streamrListener) shutdown(ctx context.Context, now time.Time) {
+	if l.aggregator != nil {
+		l.sendAggregates(ctx, l.aggregator.flushDue(now, 0))
+		if open := l.aggregator.openWindows(); open > 0 {
+			l.logger.Warn("dropping open aggregation windows on shutdown", "windows", open)
+		}
+	}
+	l.broadcaster.shutdown(ctx, now)
+}
+
+// split returns the messages contained in a Streamr message.
+func (l *streamrListener) split(msg *client.StreamrEvent) ([]*message, error) {
+	streamID := msg.Metadata.StreamID
+	if streamID == "" {
+		// older Streamr nodes may not include the stream ID
+		streamID = l.config.Stream
+	}
+
+	return splitMessage(l.config.Explode, position{
+		streamID:    streamID,
+		partition:   msg.Metadata.StreamPartition,
+		publisherID: msg.Metadata.PublisherID,
+		chainID:     msg.Metadata.MsgChainID,
+		timestamp:   msg.Metadata.Timestamp,
+		sequence:    msg.Metadata.SequenceNumber,
+	}, msg.Content)
+}
+
+// rejectMessage rejects a single message of a Streamr message.
+func (l *streamrListener) rejectMessage(msg *client.StreamrEvent, m *message, stage string, err error) {
+	dl := &DeadLetter{Stage: stage, Error: err.Error(), Message: msg}
+	if m.exploded {
+		index := m.index
+		dl.Element = &index
+	}
+	var mErr *mappingError
+	if errors.As(err, &mErr) {
+		dl.Mapping = mErr.mapping()
+	}
+
+	l.reject(dl)
+}
+
+// reject logs a message that cannot be turned into an event, and writes it
+// to the dead letter file, if there is one.
+func (l *streamrListener) reject(dl *DeadLetter) {
+	parseFailures.WithLabelValues(dl.Stage).Inc()
+	l.logger.Error("dropping Streamr message", "stage", dl.Stage, "mapping", dl.Mapping, "error", dl.Error)
+	if l.deadLetters == nil {
+		return
+	}
+
+	dl.Time = time.Now().UTC()
+	if err := l.deadLetters.write(dl); err != nil {
+		l.logger.Error("failed to write dead letter", "error", err)
+	}
+}
+
+// replay re-processes the dead letter files in the replay directory, in
+// the order of their names, and deletes them. Messages that fail again are
+// written to the dead letter file.
+func (l *streamrListener) replay(ctx context.Context) {
+	dir := filepath.Join(l.config.DeadLetter.Dir, DeadLetterReplayDir)
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	slices.Sort(files)
+
+	for _, file := range files {
+		var replayed, skipped int
+		err := ReadDeadLetters(file, func(dl *DeadLetter) error {
+			if dl.Message == nil {
+				// messages that could not be decoded cannot be replayed
+				skipped++
+				return nil
+			}
+
+			p := l.parse(&delivery{msg: dl.Message})
+			if dl.Element != nil {
+				p.elements = slices.DeleteFunc(p.elements, func(e *parsedElement) bool {
+					return e.m.index != *dl.Element
+				})
+			}
+			l.apply(ctx, p)
+			replayed++
+			return nil
+		})
+		if err != nil {
+			l.logger.Error("failed to replay dead letters", "file", file, "error", err)
+			continue // leave the file, so that it can be fixed and replayed
+		}
+
+		l.logger.Info("replayed dead letters", "file", file, "replayed", replayed, "skipped", skipped)
+		if err := os.Remove(file); err != nil {
+			l.logger.Error("failed to remove replayed dead letters", "file", file, "error", err)
 		}
 	}
 }
@@ -105,14 +535,41 @@ func StartStreamrListener(ctx context.Context, service *common.Service, eventsto
 func parseEvent(inputMappings map[string]string, obj map[string]any) ([]*resolution.ParamValue, error) {
 	values := make([]*resolution.ParamValue, 0, len(inputMappings))
 	for param, field := range inputMappings {
-		value, err := searchField(obj, field)
+		path, mods, err := parseField(field)
 		if err != nil {
-			return nil, fmt.Errorf("failed to search field %s: %v", field, err)
+			return nil, err
 		}
 
 		pVal := &resolution.ParamValue{
 			Param: param,
 		}
+
+		if mods.absent() {
+			absent, err := isAbsent(obj, path)
+			if err != nil {
+				return nil, &mappingError{Param: param, Field: field, err: fmt.Errorf("failed to search field %s: %v", path, err)}
+			}
+			if absent {
+				if mods.Optional {
+					pVal.IsNull = true
+				} else {
+					pVal.Value, pVal.Defaulted = *mods.Default, true
+				}
+				values = append(values, pVal)
+				continue
+			}
+		}
+
+		var value any
+		if mods.JSON {
+			value, err = searchJSON(obj, path)
+		} else {
+			value, err = searchField(obj, path)
+		}
+		if err != nil {
+			return nil, &mappingError{Param: param, Field: field, err: fmt.Errorf("failed to search field %s: %v", path, err)}
+		}
+
 		switch v := value.(type) {
 		case string:
 			pVal.Value = v
@@ -135,6 +592,27 @@ func parseEvent(inputMappings map[string]string, obj map[string]any) ([]*resolut
 	return values, nil
 }
 
+// mappingError is the error of a mapping whose field cannot be read from a
+// message.
+type mappingError struct {
+	Param string
+	Field string
+	err   error
+}
+
+func (e *mappingError) Error() string {
+	return e.err.Error()
+}
+
+func (e *mappingError) Unwrap() error {
+	return e.err
+}
+
+// mapping returns the mapping in the form it is configured in.
+func (e *mappingError) mapping() string {
+	return e.Param + ":" + e.Field
+}
+
 // searchField searches for a field in a JSON object.
 // It returns the value of the field, or an error if the field is not found
 // or if the object does not have the expected structure.
@@ -218,14 +696,119 @@ type listenerConfig struct {
 	// The deployer address should be the hex-encoded address of the deployer.
 	TargetDB string
 	// TargetProcedure is the procedure to call on the target database.
-	// It can also point to an action.
+	// It can also point to an action. It is optional if TargetTable or
+	// Aggregate is set; if neither is, only aggregates are broadcast.
 	TargetProcedure string
+	// TargetTable is a table of the target database that messages are
+	// inserted into, instead of calling a procedure. It cannot be set
+	// together with TargetProcedure.
+	TargetTable string
+	// OnConflict is what happens if a message is inserted into
+	// TargetTable and a row with the same primary key already exists.
+	OnConflict resolution.ConflictPolicy
+	// KeyColumn is a column of TargetTable that is set to a UUID derived
+	// from the message's transaction ID. It is optional.
+	KeyColumn string
 	// InputMappings is a comma-separated list of mappings for JSON fields.
 	// It is used to map procedure parameter names to JSON field names.
 	// For example, for a JSON object {"key1": 1, "key2": {"key2.1": "value"}}, and a procedure
 	// with parameter names $param1 and $param2, the input mappings could be
 	// param1:key1,param2:key2.key2.1
+	// If TargetTable is set, it maps column names instead.
 	InputMappings map[string]string
+	// ResolutionType is the resolution type that events are broadcast
+	// with. It decides the voting thresholds and expiration of events.
+	ResolutionType string
+	// IDVersion is the version of the scheme used to derive the
+	// transaction IDs of events. See resolution.StreamrEvent.TxID.
+	// All validators must use the same version for their events to match.
+	IDVersion uint8
+	// WireVersion is the version of the encoding that events are
+	// broadcast with. All validators must use the same version for their
+	// events to match, and all of them must be able to decode it.
+	WireVersion resolution.WireVersion
+	// ReplayRetention is how long, in stream time, the resolution
+	// remembers the IDs of applied events, so that messages that are
+	// received again are not applied twice. If it is 0, events are not
+	// remembered.
+	ReplayRetention time.Duration
+	// RecordFailures is a flag to record messages whose procedure fails
+	// in the failure ledger, so that they can be re-driven.
+	RecordFailures bool
+	// Shadow is a flag to resolve messages in shadow mode: they are voted
+	// on, but their procedure is not executed. Only statistics about them
+	// are recorded.
+	Shadow bool
+	// ShadowProcedure is a procedure that messages are sent to instead of
+	// TargetProcedure in shadow mode. It is optional, and only applies to
+	// messages sent to TargetProcedure.
+	ShadowProcedure string
+	// Ordering is how the resolution handles messages that are older than
+	// the latest message applied from the same message chain. It only
+	// applies to messages sent to TargetProcedure.
+	Ordering resolution.OrderingMode
+	// LateProcedure is the procedure that out of order messages are sent
+	// to. It is required if Ordering is resolution.OrderingLate.
+	LateProcedure string
+	// RestartDelay is the delay before the first restart of a failed
+	// subscription. The delay doubles with each failure, up to
+	// RestartMaxDelay.
+	RestartDelay time.Duration
+	// RestartMaxDelay is the maximum delay between the restarts of a
+	// failed subscription.
+	RestartMaxDelay time.Duration
+	// Checkpoint is a flag to store the position of the latest message of
+	// each message chain that was broadcast, and to resume from it when
+	// the listener starts.
+	Checkpoint bool
+	// StartFrom is where the subscription starts reading its stream, if
+	// there is no checkpoint or cursor to resume from. If it is nil, the
+	// subscription starts with live messages.
+	StartFrom *startFrom
+	// BackfillRate is the maximum number of messages per second that are
+	// read while the subscription backfills or resumes. If it is 0, there
+	// is no limit.
+	BackfillRate float64
+	// Cursor configures resuming from the cursor that the resolution
+	// commits for the subscription. If it is nil, events do not track the
+	// cursor.
+	Cursor *cursorConfig
+	// Steps are procedures that messages are sent to in order, instead of
+	// TargetProcedure. Either all of them are applied, or none are.
+	Steps []*stepConfig
+	// Freshness configures the dropping of messages whose timestamp is too
+	// old, or too far in the future. If it is nil, all timestamps are
+	// accepted.
+	Freshness *freshnessConfig
+	// Dedup configures the dropping of messages that are received more
+	// than once. If it is nil, messages are not deduplicated.
+	Dedup *dedupConfig
+	// MetricsListenAddr is the address that the listener serves its
+	// metrics on, in addition to the node's metrics endpoint. It is
+	// optional.
+	MetricsListenAddr string
+	// Pipeline configures the queue and the workers between reading
+	// messages and broadcasting their events.
+	Pipeline *pipelineConfig
+	// DeadLetter configures the capture of messages that cannot be turned
+	// into events. If it is nil, they are only logged.
+	DeadLetter *deadLetterConfig
+	// Explode is the path of an array of objects in the message content.
+	// If set, each element of the array is handled as its own message, with
+	// mappings relative to the element. Mappings prefixed with "^" are
+	// relative to the original message. The path "$" means that the
+	// message content itself is the array. It is optional.
+	Explode string
+	// Aggregate configures windowed aggregation of messages.
+	// If it is nil, no aggregates are broadcast.
+	Aggregate *aggregateConfig
+	// Batch configures the grouping of messages into batches.
+	// If it is nil, each message is broadcast as its own resolution.
+	Batch *batchConfig
+	// ProposeAllow is a flag to propose, when the listener starts, that
+	// the targets of the subscription are allowed for its stream. They
+	// are allowed once enough validators propose the same.
+	ProposeAllow bool
 }
 
 // setConfig sets the configuration for the listener.
@@ -248,6 +831,12 @@ func (l *listenerConfig) setConfig(m map[string]string) error {
 		l.MaxReconnects = 3
 	}
 
+	var err error
+	l.RestartDelay, l.RestartMaxDelay, err = parseRestartDelays(m)
+	if err != nil {
+		return err
+	}
+
 	l.Stream, ok = m["stream"]
 	if !ok {
 		return errors.New("missing required streams config")
@@ -273,27 +862,327 @@ func (l *listenerConfig) setConfig(m map[string]string) error {
 		l.TargetDB = targetDB
 	}
 
+	l.ResolutionType = resolution.StreamrResolutionName
+	if v, ok := m["resolution_type"]; ok {
+		l.ResolutionType = v
+	}
+	if _, err := resolutions.GetResolution(l.ResolutionType); err != nil {
+		return fmt.Errorf("invalid resolution_type config: %v", err)
+	}
+	if _, err := resolutions.GetResolution(resolution.BatchResolutionName(l.ResolutionType)); err != nil {
+		return fmt.Errorf("invalid resolution_type config: %v", err)
+	}
+
+	// the legacy ID is the default, so that a node that is upgraded
+	// without changing its config keeps producing the same IDs as the
+	// nodes that have not been upgraded yet.
+	l.IDVersion = resolution.IDVersionLegacy
+	if v, ok := m["txid_version"]; ok {
+		version, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || uint8(version) > resolution.LatestIDVersion {
+			return fmt.Errorf("invalid txid_version config: %s", v)
+		}
+		l.IDVersion = uint8(version)
+	}
+
+	// the legacy encoding is the default, for the same reason as the
+	// legacy ID.
+	l.WireVersion = resolution.WireVersionLegacy
+	if v, ok := m["wire_version"]; ok {
+		version, err := strconv.ParseUint(v, 10, 8)
+		if err != nil || resolution.WireVersion(version) > resolution.LatestWireVersion {
+			return fmt.Errorf("invalid wire_version config: %s", v)
+		}
+		l.WireVersion = resolution.WireVersion(version)
+	}
+
+	if v, ok := m["replay_retention"]; ok {
+		l.ReplayRetention, err = time.ParseDuration(v)
+		if err != nil || l.ReplayRetention < time.Millisecond {
+			return fmt.Errorf("invalid replay_retention config: %s", v)
+		}
+		// legacy IDs are not unique across streams and publishers, and
+		// the legacy encoding cannot carry the retention.
+		if l.IDVersion == resolution.IDVersionLegacy || l.WireVersion == resolution.WireVersionLegacy {
+			return errors.New("replay_retention requires txid_version and wire_version 1 or later")
+		}
+	}
+
+	if v, ok := m["failure_ledger"]; ok {
+		l.RecordFailures, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid failure_ledger config: %s", v)
+		}
+		if l.RecordFailures && l.WireVersion == resolution.WireVersionLegacy {
+			return errors.New("failure_ledger requires wire_version 1 or later")
+		}
+	}
+
+	if v, ok := m["shadow"]; ok {
+		l.Shadow, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid shadow config: %s", v)
+		}
+	}
+	if v, ok := m["shadow_procedure"]; ok {
+		if !l.Shadow {
+			return errors.New("shadow_procedure requires shadow to be true")
+		}
+		l.ShadowProcedure = v
+	}
+	if l.Shadow && l.WireVersion == resolution.WireVersionLegacy {
+		return errors.New("shadow requires wire_version 1 or later")
+	}
+
+	switch v := m["ordering"]; v {
+	case "", "none":
+		l.Ordering = resolution.OrderingNone
+	case "reject":
+		l.Ordering = resolution.OrderingReject
+	case "late":
+		l.Ordering = resolution.OrderingLate
+		l.LateProcedure, ok = m["late_procedure"]
+		if !ok {
+			return errors.New("missing required late_procedure config")
+		}
+	default:
+		return fmt.Errorf("invalid ordering config: %s", v)
+	}
+	if l.Ordering != resolution.OrderingNone && l.WireVersion == resolution.WireVersionLegacy {
+		return errors.New("ordering requires wire_version 1 or later")
+	}
+
+	l.Checkpoint, err = parseCheckpointConfig(m)
+	if err != nil {
+		return err
+	}
+
+	l.StartFrom, err = parseStartFrom(m)
+	if err != nil {
+		return err
+	}
+
+	l.BackfillRate, err = parseBackfillRate(m)
+	if err != nil {
+		return err
+	}
+
+	l.Cursor, err = parseCursorConfig(m)
+	if err != nil {
+		return err
+	}
+	// legacy IDs leave out the stream and publisher of events, and the
+	// legacy encoding cannot carry the flag.
+	if l.Cursor != nil && (l.IDVersion == resolution.IDVersionLegacy || l.WireVersion == resolution.WireVersionLegacy) {
+		return errors.New("cursor requires txid_version and wire_version 1 or later")
+	}
+
+	l.Freshness, err = parseFreshnessConfig(m, l.ReplayRetention > 0)
+	if err != nil {
+		return err
+	}
+
+	l.Dedup, err = parseDedupConfig(m)
+	if err != nil {
+		return err
+	}
+
+	l.MetricsListenAddr = m["metrics_listen_addr"]
+
+	l.Pipeline, err = parsePipelineConfig(m)
+	if err != nil {
+		return err
+	}
+	if err := l.Pipeline.checkResume(l.Checkpoint || l.Cursor != nil); err != nil {
+		return err
+	}
+
+	l.DeadLetter, err = parseDeadLetterConfig(m)
+	if err != nil {
+		return err
+	}
+
+	l.Explode = m["explode"]
+
+	aggregate, err := parseAggregateConfig(m)
+	if err != nil {
+		return err
+	}
+	l.Aggregate = aggregate
+
+	steps, err := parseStepsConfig(m)
+	if err != nil {
+		return err
+	}
+	l.Steps = steps
+
+	// the target procedure is only optional if the listener writes to a
+	// table or to steps, or only broadcasts aggregates.
 	l.TargetProcedure, ok = m["target_procedure"]
-	if !ok {
+	l.TargetTable = m["target_table"]
+	if ok && l.TargetTable != "" {
+		return errors.New("target_procedure and target_table cannot both be set")
+	}
+	if l.Steps != nil && (ok || l.TargetTable != "") {
+		return errors.New("steps cannot be set together with target_procedure or target_table")
+	}
+	if !ok && l.TargetTable == "" && l.Steps == nil && l.Aggregate == nil {
 		return errors.New("missing required target_procedure config")
 	}
 
-	mappings, ok := m["input_mappings"]
-	if !ok {
-		return errors.New("missing required input_mappings config")
+	if l.Steps != nil {
+		if l.WireVersion == resolution.WireVersionLegacy {
+			return errors.New("steps require wire_version 1 or later")
+		}
+		// late messages and shadow procedures are passed the message's
+		// values, which are split between the steps.
+		if l.Ordering == resolution.OrderingLate {
+			return errors.New("steps cannot be used with ordering late")
+		}
+		if l.ShadowProcedure != "" {
+			return errors.New("steps cannot be used with shadow_procedure")
+		}
 	}
 
-	l.InputMappings = make(map[string]string)
-	for _, mapping := range strings.Split(mappings, ",") {
-		parts := strings.Split(mapping, ":")
+	if err := l.setTableConfig(m); err != nil {
+		return err
+	}
+
+	if l.TargetProcedure != "" || l.TargetTable != "" {
+		mappings, ok := m["input_mappings"]
+		if !ok {
+			return errors.New("missing required input_mappings config")
+		}
+
+		l.InputMappings, err = parseMappings(mappings)
+		if err != nil {
+			return fmt.Errorf("invalid input_mappings config: %v", err)
+		}
+		if l.WireVersion == resolution.WireVersionLegacy && hasAbsentMappings(l.InputMappings) {
+			return errors.New("optional and default input_mappings require wire_version 1 or later")
+		}
+		if _, ok := l.InputMappings[l.KeyColumn]; ok && l.KeyColumn != "" {
+			return fmt.Errorf("key_column %s cannot also be in input_mappings", l.KeyColumn)
+		}
+	}
+
+	if l.Cursor != nil && l.target() == "" {
+		return errors.New("cursor requires target_procedure, target_table or steps")
+	}
+
+	batch, err := parseBatchConfig(m)
+	if err != nil {
+		return err
+	}
+	l.Batch = batch
+
+	if v, ok := m["propose_allow"]; ok {
+		l.ProposeAllow, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid propose_allow config: %s", v)
+		}
+	}
+
+	return nil
+}
+
+// allowProposal returns the proposal to allow every target that the
+// events of the subscription are applied to.
+func (l *listenerConfig) allowProposal() *resolution.AllowProposal {
+	p := &resolution.AllowProposal{StreamID: l.Stream, TargetDBID: l.TargetDB}
+	if l.IDVersion == resolution.IDVersionLegacy {
+		// legacy events do not carry their stream, so they are only
+		// allowed by any stream.
+		p.StreamID = "*"
+	}
+
+	for _, target := range []string{l.TargetProcedure, l.TargetTable, l.LateProcedure, l.ShadowProcedure} {
+		if target != "" {
+			p.Targets = append(p.Targets, target)
+		}
+	}
+	for _, step := range l.Steps {
+		p.Targets = append(p.Targets, step.Procedure)
+	}
+	if l.Aggregate != nil {
+		p.Targets = append(p.Targets, l.Aggregate.Procedure)
+	}
+
+	return p
+}
+
+// target returns the target of the events of messages, as the resolution
+// names it. It is empty if only aggregates are broadcast.
+func (l *listenerConfig) target() string {
+	ev := &resolution.StreamrEvent{TargetProcedure: l.TargetProcedure, TargetTable: l.TargetTable}
+	for _, step := range l.Steps {
+		ev.Steps = append(ev.Steps, &resolution.Step{Procedure: step.Procedure})
+	}
+	return ev.Target()
+}
+
+// setTableConfig sets the configuration that is specific to a target
+// table.
+func (l *listenerConfig) setTableConfig(m map[string]string) error {
+	conflict, hasConflict := m["on_conflict"]
+	key, hasKey := m["key_column"]
+	if l.TargetTable == "" {
+		if hasConflict || hasKey {
+			return errors.New("on_conflict and key_column require target_table")
+		}
+		return nil
+	}
+
+	if l.WireVersion == resolution.WireVersionLegacy {
+		return errors.New("target_table requires wire_version 1 or later")
+	}
+
+	switch conflict {
+	case "", "error":
+		l.OnConflict = resolution.ConflictError
+	case "ignore":
+		l.OnConflict = resolution.ConflictIgnore
+	case "update":
+		l.OnConflict = resolution.ConflictUpdate
+	default:
+		return fmt.Errorf("invalid on_conflict config: %s", conflict)
+	}
+
+	if hasKey {
+		if key == "" {
+			return errors.New("invalid key_column config: empty column name")
+		}
+		// we lowercase the column because columns are case-insensitive
+		l.KeyColumn = strings.ToLower(key)
+	}
+
+	return nil
+}
+
+// parseMappings parses a comma-separated list of param:field mappings.
+func parseMappings(mappings string) (map[string]string, error) {
+	res := make(map[string]string)
+	// default values may contain the separators if they are quoted
+	split, err := splitUnquoted(mappings, ',')
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range split {
+		parts, err := splitUnquoted(mapping, ':')
+		if err != nil {
+			return nil, err
+		}
 		if len(parts) != 2 {
-			return fmt.Errorf("invalid input mapping: %s", mapping)
+			return nil, fmt.Errorf("invalid input mapping: %s", mapping)
+		}
+		if _, _, err := parseField(parts[1]); err != nil {
+			return nil, err
 		}
 		// we lowercase the key because parameters are case-insensitive
-		l.InputMappings[strings.TrimPrefix(strings.ToLower(parts[0]), "$")] = parts[1]
+		res[strings.TrimPrefix(strings.ToLower(parts[0]), "$")] = parts[1]
 	}
 
-	return nil
+	return res, nil
 }
 
 func decodeHex(s string) ([]byte, error) {
@@ -105,6 +105,159 @@ func Test_ParseEvent(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "object as json",
+			params: map[string]string{
+				"param1": "key1|json",
+			},
+			obj: map[string]any{
+				"key1": map[string]any{
+					"b":   []any{1e21, 0.000001, -0.0, 100.0},
+					"a":   "<&>",
+					"c":   nil,
+					"ä":   true,
+					"1.5": 1.5,
+				},
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param: "param1",
+					Value: `{"1.5":1.5,"a":"<&>","b":[1e+21,0.000001,0,100],"c":null,"ä":true}`,
+				},
+			},
+		},
+		{
+			name: "array of objects as json",
+			params: map[string]string{
+				"param1": "key1.key2|json",
+			},
+			obj: map[string]any{
+				"key1": map[string]any{
+					"key2": []any{
+						map[string]any{"y": 2, "x": 1},
+					},
+				},
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param: "param1",
+					Value: `[{"x":1,"y":2}]`,
+				},
+			},
+		},
+		{
+			name: "unknown modifier",
+			params: map[string]string{
+				"param1": "key1|xml",
+			},
+			obj: map[string]any{
+				"key1": 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "optional field missing",
+			params: map[string]string{
+				"param1": "key1|optional",
+				"param2": "key2",
+			},
+			obj: map[string]any{
+				"key2": 2,
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param:  "param1",
+					IsNull: true,
+				},
+				{
+					Param: "param2",
+					Value: "2",
+				},
+			},
+		},
+		{
+			name: "optional field present",
+			params: map[string]string{
+				"param1": "key1|optional",
+			},
+			obj: map[string]any{
+				"key1": 1,
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param: "param1",
+					Value: "1",
+				},
+			},
+		},
+		{
+			name: "optional field under null object",
+			params: map[string]string{
+				"param1": "key1.key2|optional",
+			},
+			obj: map[string]any{
+				"key1": nil,
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param:  "param1",
+					IsNull: true,
+				},
+			},
+		},
+		{
+			name: "default of null field",
+			params: map[string]string{
+				"param1": "key1.key2|default=0",
+			},
+			obj: map[string]any{
+				"key1": map[string]any{
+					"key2": nil,
+				},
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param:     "param1",
+					Value:     "0",
+					Defaulted: true,
+				},
+			},
+		},
+		{
+			name: "default of present field",
+			params: map[string]string{
+				"param1": "key1|default=0",
+			},
+			obj: map[string]any{
+				"key1": 5,
+			},
+			want: []*resolution.ParamValue{
+				{
+					Param: "param1",
+					Value: "5",
+				},
+			},
+		},
+		{
+			name: "optional field of a scalar",
+			params: map[string]string{
+				"param1": "key1.key2|optional",
+			},
+			obj: map[string]any{
+				"key1": 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "required field missing",
+			params: map[string]string{
+				"param1": "key1|required",
+			},
+			obj: map[string]any{
+				"key2": 2,
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -120,3 +273,130 @@ func Test_ParseEvent(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseField(t *testing.T) {
+	defaultValue := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		field    string
+		wantPath string
+		want     *fieldModifiers
+		wantErr  bool
+	}{
+		{
+			name:     "no modifiers",
+			field:    "key1.key2",
+			wantPath: "key1.key2",
+			want:     &fieldModifiers{},
+		},
+		{
+			name:     "optional json",
+			field:    "key1|json|optional",
+			wantPath: "key1",
+			want:     &fieldModifiers{JSON: true, Optional: true},
+		},
+		{
+			name:     "default",
+			field:    "key1|default=Unknown",
+			wantPath: "key1",
+			want:     &fieldModifiers{Default: defaultValue("Unknown")},
+		},
+		{
+			name:     "empty default",
+			field:    "key1|default=",
+			wantPath: "key1",
+			want:     &fieldModifiers{Default: defaultValue("")},
+		},
+		{
+			name:     "required",
+			field:    "key1|REQUIRED",
+			wantPath: "key1",
+			want:     &fieldModifiers{Required: true},
+		},
+		{
+			name:    "default without value",
+			field:   "key1|default",
+			wantErr: true,
+		},
+		{
+			name:    "optional with value",
+			field:   "key1|optional=1",
+			wantErr: true,
+		},
+		{
+			name:    "optional and default",
+			field:   "key1|optional|default=0",
+			wantErr: true,
+		},
+		{
+			name:    "optional and required",
+			field:   "key1|optional|required",
+			wantErr: true,
+		},
+		{
+			name:     "quoted default",
+			field:    `key1|default="a|b, \"c\": d"|json`,
+			wantPath: "key1",
+			want:     &fieldModifiers{JSON: true, Default: defaultValue(`a|b, "c": d`)},
+		},
+		{
+			name:    "unterminated quote",
+			field:   `key1|default="a`,
+			wantErr: true,
+		},
+		{
+			name:    "partly quoted default",
+			field:   `key1|default=a"b"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, mods, err := parseField(tt.field)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, tt.wantPath, path)
+			require.Equal(t, tt.want, mods)
+		})
+	}
+}
+
+func Test_ParseMappings(t *testing.T) {
+	// separators within quoted default values do not split the mappings
+	mappings, err := parseMappings(`tags:data.tags|default="a,b",Time:data.time|default="12:00"`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"tags": `data.tags|default="a,b"`,
+		"time": `data.time|default="12:00"`,
+	}, mappings)
+
+	_, err = parseMappings(`time:data.time|default=12:00`)
+	require.Error(t, err)
+}
+
+func Test_AllowProposal(t *testing.T) {
+	conf := &listenerConfig{
+		Stream:          "0xabc/weather",
+		TargetDB:        "xdb",
+		TargetProcedure: "write_temp",
+		LateProcedure:   "write_late",
+		ShadowProcedure: "write_shadow",
+		IDVersion:       resolution.IDVersion1,
+		Aggregate:       &aggregateConfig{Procedure: "write_agg"},
+	}
+
+	p := conf.allowProposal()
+	require.Equal(t, "0xabc/weather", p.StreamID)
+	require.Equal(t, "xdb", p.TargetDBID)
+	require.Equal(t, []string{"write_temp", "write_late", "write_shadow", "write_agg"}, p.Targets)
+
+	// legacy events do not carry their stream
+	conf.IDVersion = resolution.IDVersionLegacy
+	require.Equal(t, "*", conf.allowProposal().StreamID)
+}
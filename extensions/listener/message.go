@@ -0,0 +1,217 @@
+package listener
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// parentPrefix is the prefix of a mapping field that refers to the
+// original message, rather than the exploded element.
+const parentPrefix = "^"
+
+// position is the position of a message in a Streamr stream.
+type position struct {
+	streamID    string
+	partition   int64
+	publisherID string
+	chainID     string
+	timestamp   int64
+	sequence    int64
+}
+
+// message is the position and content of a single Streamr message, or of
+// a single element of an exploded Streamr message.
+type message struct {
+	position
+	content map[string]any
+	// exploded is true if the message is an element of an exploded array.
+	exploded bool
+	// parent is the original message content if the message is an
+	// element of an exploded array. It is nil if the message is not
+	// exploded, or if the message content itself was the array.
+	parent map[string]any
+	// index is the position of the element in the exploded array.
+	index int64
+}
+
+// splitMessage returns the messages contained in a Streamr message.
+// If explode is empty, the Streamr message content must be a JSON object,
+// and a single message is returned. Otherwise, explode is the path of
+// an array of objects, and a message is returned for each element.
+// The path "$" refers to the content itself being an array.
+func splitMessage(explode string, pos position, content any) ([]*message, error) {
+	obj, isObj := content.(map[string]any)
+	if explode == "" {
+		if !isObj {
+			return nil, fmt.Errorf("invalid message content: %v", content)
+		}
+
+		return []*message{{
+			position: pos,
+			content:  obj,
+		}}, nil
+	}
+
+	arr, isArr := content.([]any)
+	if explode != "$" {
+		if !isObj {
+			return nil, fmt.Errorf("invalid message content: %v", content)
+		}
+
+		v, err := lookupField(obj, explode)
+		if err != nil {
+			return nil, err
+		}
+
+		arr, isArr = v.([]any)
+	}
+	if !isArr {
+		return nil, fmt.Errorf("field %s in received JSON is not an array", explode)
+	}
+
+	msgs := make([]*message, 0, len(arr))
+	for i, elem := range arr {
+		elemObj, ok := elem.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("element %d of exploded array is not an object", i)
+		}
+
+		msgs = append(msgs, &message{
+			position: pos,
+			content:  elemObj,
+			exploded: true,
+			parent:   obj, // nil if the content itself is the array
+			index:    int64(i),
+		})
+	}
+
+	return msgs, nil
+}
+
+// parse parses the mapped parameter values out of the message.
+// For exploded messages, mappings are relative to the element, unless
+// the field is prefixed with "^", in which case it is relative to the
+// original message.
+func (m *message) parse(mappings map[string]string) ([]*resolution.ParamValue, error) {
+	if !m.exploded {
+		return parseEvent(mappings, m.content)
+	}
+
+	elemMappings := make(map[string]string)
+	parentMappings := make(map[string]string)
+	for param, field := range mappings {
+		if parentField, ok := strings.CutPrefix(field, parentPrefix); ok {
+			parentMappings[param] = parentField
+			continue
+		}
+		elemMappings[param] = field
+	}
+
+	values, err := parseEvent(elemMappings, m.content)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parentMappings) > 0 {
+		if m.parent == nil {
+			return nil, errors.New("cannot map parent fields when the message content is an array")
+		}
+
+		parentValues, err := parseEvent(parentMappings, m.parent)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, parentValues...)
+
+		slices.SortFunc(values, func(a, b *resolution.ParamValue) int {
+			return strings.Compare(a.Param, b.Param)
+		})
+	}
+
+	return values, nil
+}
+
+// compare orders messages by their position in the stream.
+func (m *message) compare(other *message) int {
+	if c := cmp.Compare(m.timestamp, other.timestamp); c != 0 {
+		return c
+	}
+	if c := strings.Compare(m.publisherID, other.publisherID); c != 0 {
+		return c
+	}
+	if c := strings.Compare(m.chainID, other.chainID); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(m.sequence, other.sequence); c != 0 {
+		return c
+	}
+	return cmp.Compare(m.index, other.index)
+}
+
+// fieldNotFoundError is the error of a field that is missing from a JSON
+// object.
+type fieldNotFoundError struct {
+	field string
+}
+
+func (e *fieldNotFoundError) Error() string {
+	return fmt.Sprintf("field %s not found in received JSON", e.field)
+}
+
+// lookupField returns the raw value of a field in a JSON object.
+func lookupField(obj map[string]any, field string) (any, error) {
+	keys := strings.SplitN(field, ".", 2)
+	v, ok := obj[keys[0]]
+	if !ok {
+		return nil, &fieldNotFoundError{field: keys[0]}
+	}
+	if len(keys) == 1 {
+		return v, nil
+	}
+	if v == nil {
+		// the fields of a null object are missing
+		return nil, &fieldNotFoundError{field: keys[1]}
+	}
+
+	inner, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("field %s in received JSON is not an object", keys[0])
+	}
+
+	return lookupField(inner, keys[1])
+}
+
+// isAbsent returns true if a field is missing from a JSON object, or is
+// null.
+func isAbsent(obj map[string]any, field string) (bool, error) {
+	v, err := lookupField(obj, field)
+	var notFound *fieldNotFoundError
+	if errors.As(err, &notFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return v == nil, nil
+}
+
+// event creates an event for the message.
+func (m *message) event(values []*resolution.ParamValue, targetDB, targetProcedure string) *resolution.StreamrEvent {
+	return &resolution.StreamrEvent{
+		Values:          values,
+		TargetDBID:      targetDB,
+		TargetProcedure: targetProcedure,
+		Timestamp:       uint64(m.timestamp),
+		SequenceID:      uint64(m.sequence),
+		MsgChainID:      m.chainID,
+		ElementIndex:    uint64(m.index),
+		IsElement:       m.exploded,
+		StreamID:        m.streamID,
+		Partition:       uint64(m.partition),
+		PublisherID:     m.publisherID,
+	}
+}
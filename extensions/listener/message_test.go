@@ -0,0 +1,115 @@
+package listener
+
+import (
+	"testing"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SplitMessage(t *testing.T) {
+	type testcase struct {
+		name     string
+		explode  string
+		content  any
+		mappings map[string]string
+		// want is the parsed values of each returned message
+		want    [][]*resolution.ParamValue
+		wantErr bool
+	}
+
+	tests := []testcase{
+		{
+			name:     "no explode",
+			content:  map[string]any{"a": 1},
+			mappings: map[string]string{"a": "a"},
+			want: [][]*resolution.ParamValue{
+				{{Param: "a", Value: "1"}},
+			},
+		},
+		{
+			name:    "explode nested records with parent fields",
+			explode: "data.records",
+			content: map[string]any{
+				"device": "d1",
+				"data": map[string]any{
+					"records": []any{
+						map[string]any{"temp": 1},
+						map[string]any{"temp": 2},
+					},
+				},
+			},
+			mappings: map[string]string{"temp": "temp", "device": "^device"},
+			want: [][]*resolution.ParamValue{
+				{{Param: "device", Value: "d1"}, {Param: "temp", Value: "1"}},
+				{{Param: "device", Value: "d1"}, {Param: "temp", Value: "2"}},
+			},
+		},
+		{
+			name:    "explode top-level array",
+			explode: "$",
+			content: []any{
+				map[string]any{"temp": 1},
+			},
+			mappings: map[string]string{"temp": "temp"},
+			want: [][]*resolution.ParamValue{
+				{{Param: "temp", Value: "1"}},
+			},
+		},
+		{
+			name:    "top-level array has no parent",
+			explode: "$",
+			content: []any{
+				map[string]any{"temp": 1},
+			},
+			mappings: map[string]string{"device": "^device"},
+			wantErr:  true,
+		},
+		{
+			name:    "array of scalars",
+			explode: "records",
+			content: map[string]any{
+				"records": []any{1, 2},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "not an array",
+			explode: "records",
+			content: map[string]any{
+				"records": map[string]any{"temp": 1},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "array without explode",
+			content: []any{map[string]any{"temp": 1}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := splitMessage(tt.explode, position{timestamp: 1, chainID: "chain"}, tt.content)
+			var got [][]*resolution.ParamValue
+			for i, m := range msgs {
+				require.Equal(t, tt.explode != "", m.exploded)
+				require.EqualValues(t, i, m.index)
+
+				values, err2 := m.parse(tt.mappings)
+				if err2 != nil {
+					err = err2
+					break
+				}
+				got = append(got, values)
+			}
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.EqualValues(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The reasons that messages are filtered out, rather than rejected.
+const (
+	filterResent    = "resent"
+	filterDuplicate = "duplicate"
+)
+
+// The kinds of bodies that are broadcast.
+const (
+	broadcastEvent = "event"
+	broadcastBatch = "batch"
+	broadcastAllow = "allow"
+)
+
+// The metrics of the listener are registered with the default registry,
+// which is served by the node's metrics endpoint, and by the listener's
+// own metrics server if one is configured.
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "messages_received_total",
+		Help:      "Number of messages read from the Streamr node.",
+	})
+	messagesFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "messages_filtered_total",
+		Help:      "Number of messages that were skipped, by reason.",
+	}, []string{"reason"})
+	parseFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "parse_failures_total",
+		Help:      "Number of messages that could not be turned into events, by the stage that failed.",
+	}, []string{"stage"})
+	broadcasts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "broadcasts_total",
+		Help:      "Number of events and batches broadcast to the network.",
+	}, []string{"kind"})
+	broadcastErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "broadcast_errors_total",
+		Help:      "Number of events and batches that failed to be broadcast.",
+	}, []string{"kind"})
+	reconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "reconnects_total",
+		Help:      "Number of times the client reconnected to the Streamr node.",
+	})
+	restarts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "restarts_total",
+		Help:      "Number of times a failed subscription was restarted.",
+	})
+	connectionState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "state",
+		Help:      "State of the subscription. The gauge of the current state is 1.",
+	}, []string{"state"})
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "queue_depth",
+		Help:      "Number of messages waiting to be parsed.",
+	})
+	queueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "queue_dropped_total",
+		Help:      "Number of messages dropped because the queue was full, by stream.",
+	}, []string{"stream"})
+	streamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "streamr",
+		Subsystem: "listener",
+		Name:      "stream_lag_seconds",
+		Help:      "Local time minus the Streamr timestamp of the latest message read.",
+	})
+)
+
+// setState sets the state gauges.
+func setState(state listenerState) {
+	for _, s := range []listenerState{stateStarting, stateRunning, stateDegraded} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		connectionState.WithLabelValues(s.String()).Set(v)
+	}
+}
+
+// serveMetrics serves the default registry on addr until the context is
+// cancelled.
+func serveMetrics(ctx context.Context, addr string, logger log.SugaredLogger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("serving Streamr metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		// metrics are not worth stopping the listener for
+		logger.Error("failed to serve Streamr metrics", "error", err)
+	}
+}
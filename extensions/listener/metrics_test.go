@@ -0,0 +1,62 @@
+package listener
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/kwilteam/kwil-streamr/client"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StateMetrics(t *testing.T) {
+	s := newSupervisor(0, 0, log.NewNoOp().Sugar())
+	require.Equal(t, 1.0, testutil.ToFloat64(connectionState.WithLabelValues("starting")))
+
+	restarted := testutil.ToFloat64(restarts)
+	s.degrade(nil, 0)
+	require.Equal(t, 0.0, testutil.ToFloat64(connectionState.WithLabelValues("starting")))
+	require.Equal(t, 1.0, testutil.ToFloat64(connectionState.WithLabelValues("degraded")))
+	require.Equal(t, restarted+1, testutil.ToFloat64(restarts))
+
+	s.connected()
+	require.Equal(t, 0.0, testutil.ToFloat64(connectionState.WithLabelValues("degraded")))
+	require.Equal(t, 1.0, testutil.ToFloat64(connectionState.WithLabelValues("running")))
+}
+
+func Test_ListenerMetrics(t *testing.T) {
+	ctx := context.Background()
+	l := &streamrListener{
+		config: &listenerConfig{
+			Stream:          "stream",
+			TargetDB:        "db",
+			TargetProcedure: "write",
+			InputMappings:   map[string]string{"temp": "temp"},
+		},
+		broadcaster: &broadcaster{
+			eventstore:  newMemoryEventStore(),
+			idVersion:   resolution.LatestIDVersion,
+			wireVersion: resolution.LatestWireVersion,
+			logger:      log.NewNoOp().Sugar(),
+		},
+		logger: log.NewNoOp().Sugar(),
+	}
+
+	sent := testutil.ToFloat64(broadcasts.WithLabelValues(broadcastEvent))
+	failed := testutil.ToFloat64(parseFailures.WithLabelValues(stageMapping))
+
+	l.apply(ctx, l.parse(&delivery{msg: &client.StreamrEvent{Content: map[string]any{"temp": 1}}}))
+	l.apply(ctx, l.parse(&delivery{msg: &client.StreamrEvent{Content: map[string]any{"humidity": 1}}}))
+
+	require.Equal(t, sent+1, testutil.ToFloat64(broadcasts.WithLabelValues(broadcastEvent)))
+	require.Equal(t, failed+1, testutil.ToFloat64(parseFailures.WithLabelValues(stageMapping)))
+
+	dropped := testutil.ToFloat64(queueDropped.WithLabelValues("stream"))
+	q := newQueue(1, overflowDropNewest, "stream")
+	require.NoError(t, q.push(ctx, &delivery{}))
+	require.NoError(t, q.push(ctx, &delivery{}))
+	require.Equal(t, dropped+1, testutil.ToFloat64(queueDropped.WithLabelValues("stream")))
+	require.Zero(t, testutil.ToFloat64(queueDropped.WithLabelValues("other")))
+}
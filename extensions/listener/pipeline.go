@@ -0,0 +1,367 @@
+package listener
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/kwilteam/kwil-streamr/client"
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+const (
+	// defaultQueueSize is the default number of messages that can wait
+	// between the reader and the parse workers.
+	defaultQueueSize = 1000
+	// defaultParseWorkers is the default number of messages that are
+	// parsed concurrently.
+	defaultParseWorkers = 4
+	// queueLogInterval is how often the number of dropped messages is
+	// logged.
+	queueLogInterval = time.Minute
+	// tickInterval is how often the apply stage is ticked while it waits
+	// for deliveries.
+	tickInterval = time.Second
+)
+
+// overflowPolicy is what the queue does with a message that arrives while
+// it is full.
+type overflowPolicy uint8
+
+const (
+	// overflowBlock stops reading until there is room in the queue.
+	overflowBlock overflowPolicy = iota
+	// overflowDropOldest drops the oldest message in the queue.
+	overflowDropOldest
+	// overflowDropNewest drops the message that arrived.
+	overflowDropNewest
+)
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case overflowBlock:
+		return "block"
+	case overflowDropOldest:
+		return "drop_oldest"
+	case overflowDropNewest:
+		return "drop_newest"
+	default:
+		return "unknown"
+	}
+}
+
+// pipelineConfig configures the stages between reading messages and
+// broadcasting their events.
+type pipelineConfig struct {
+	// QueueSize is the number of messages that can wait to be parsed.
+	QueueSize int
+	// Overflow is what happens to messages that arrive while the queue is
+	// full.
+	Overflow overflowPolicy
+	// Workers is the number of messages that are parsed concurrently.
+	Workers int
+}
+
+// parsePipelineConfig parses the pipeline configuration. Unlike most
+// configs, the pipeline is always used, so it is never nil.
+func parsePipelineConfig(m map[string]string) (*pipelineConfig, error) {
+	conf := &pipelineConfig{
+		QueueSize: defaultQueueSize,
+		Overflow:  overflowBlock,
+		Workers:   defaultParseWorkers,
+	}
+
+	var err error
+	if v, ok := m["queue_size"]; ok {
+		conf.QueueSize, err = strconv.Atoi(v)
+		if err != nil || conf.QueueSize < 1 {
+			return nil, fmt.Errorf("invalid queue_size config: %s", v)
+		}
+	}
+
+	switch v := m["queue_overflow"]; v {
+	case "", "block":
+		conf.Overflow = overflowBlock
+	case "drop_oldest":
+		conf.Overflow = overflowDropOldest
+	case "drop_newest":
+		conf.Overflow = overflowDropNewest
+	default:
+		return nil, fmt.Errorf("invalid queue_overflow config: %s", v)
+	}
+
+	if v, ok := m["parse_workers"]; ok {
+		conf.Workers, err = strconv.Atoi(v)
+		if err != nil || conf.Workers < 1 {
+			return nil, fmt.Errorf("invalid parse_workers config: %s", v)
+		}
+	}
+
+	return conf, nil
+}
+
+// checkResume returns an error if the queue drops messages while the
+// listener resumes from checkpoints or the cursor, since the positions of
+// later messages would move past the dropped ones, and they would never be
+// read again.
+func (c *pipelineConfig) checkResume(resumes bool) error {
+	if resumes && c.Overflow != overflowBlock {
+		return fmt.Errorf("queue_overflow %s cannot be used with checkpoint or cursor, since dropped messages would not be resent", c.Overflow)
+	}
+	return nil
+}
+
+// delivery is a message read from the Streamr node, or the error of a
+// message that could not be decoded.
+type delivery struct {
+	msg     *client.StreamrEvent
+	invalid *client.InvalidMessageError
+}
+
+// queue is a bounded queue of deliveries, with a single producer.
+type queue struct {
+	items  chan *delivery
+	policy overflowPolicy
+	// droppedTotal counts the dropped deliveries of the queue's stream.
+	droppedTotal prometheus.Counter
+
+	// dropped is the number of deliveries dropped because the queue was
+	// full.
+	dropped atomic.Int64
+	// reported is the number of dropped deliveries that were last
+	// logged, at lastReport. They are only used by the producer.
+	reported   int64
+	lastReport time.Time
+}
+
+func newQueue(size int, policy overflowPolicy, stream string) *queue {
+	return &queue{
+		items:        make(chan *delivery, size),
+		policy:       policy,
+		droppedTotal: queueDropped.WithLabelValues(stream),
+	}
+}
+
+// push adds a delivery to the queue, applying the overflow policy if the
+// queue is full. It only returns an error if the context is cancelled
+// while it blocks.
+func (q *queue) push(ctx context.Context, d *delivery) error {
+	switch q.policy {
+	case overflowDropNewest:
+		select {
+		case q.items <- d:
+		default:
+			q.drop()
+		}
+		return nil
+	case overflowDropOldest:
+		for {
+			select {
+			case q.items <- d:
+				return nil
+			default:
+			}
+
+			// the consumer may take the oldest delivery first, in which
+			// case there is room on the next attempt.
+			select {
+			case <-q.items:
+				q.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case q.items <- d:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (q *queue) drop() {
+	q.dropped.Add(1)
+	q.droppedTotal.Inc()
+}
+
+// depth returns the number of deliveries in the queue.
+func (q *queue) depth() int {
+	return len(q.items)
+}
+
+// report returns the number of deliveries dropped since the last report,
+// if a report is due.
+func (q *queue) report(now time.Time) (int64, bool) {
+	dropped := q.dropped.Load()
+	if dropped == q.reported || now.Sub(q.lastReport) < queueLogInterval {
+		return 0, false
+	}
+
+	n := dropped - q.reported
+	q.reported, q.lastReport = dropped, now
+	return n, true
+}
+
+// parsed is a delivery that was parsed by a worker.
+type parsed struct {
+	msg *client.StreamrEvent
+	// stage and err are set if the whole delivery failed.
+	stage string
+	err   error
+	// raw is the payload of a message that could not be decoded.
+	raw      []byte
+	elements []*parsedElement
+}
+
+// parsedElement is a single message of a parsed delivery.
+type parsedElement struct {
+	m *message
+	// key is the dedup key of the message, if dedup is configured.
+	key    string
+	keyErr error
+	// ev is the event of the message, if it is sent to a target. If the
+	// event could not be created, evErr is set, and evStage is the stage
+	// that failed.
+	ev      *resolution.StreamrEvent
+	evStage string
+	evErr   error
+}
+
+// pipeline runs the stages between reading messages and broadcasting
+// their events: deliveries are queued, parsed concurrently by the
+// workers, and applied in the order they were read. Everything that keeps
+// state across messages is only used by the apply stage.
+type pipeline struct {
+	conf  *pipelineConfig
+	queue *queue
+	// parse is called concurrently by the workers, and apply is called by
+	// a single goroutine, in order. tick is called by the same goroutine
+	// as apply, every tickInterval, so that it can use the same state. It
+	// is optional.
+	parse func(d *delivery) *parsed
+	apply func(p *parsed)
+	tick  func(now time.Time)
+}
+
+func newPipeline(conf *pipelineConfig, stream string, parse func(d *delivery) *parsed, apply func(p *parsed)) *pipeline {
+	return &pipeline{
+		conf:  conf,
+		queue: newQueue(conf.QueueSize, conf.Overflow, stream),
+		parse: parse,
+		apply: apply,
+	}
+}
+
+// run runs the pipeline. read is called in its own goroutine, and pushes
+// deliveries until it returns. Once it returns, the deliveries that were
+// already read are applied, unless the context is cancelled, and run
+// returns the error of read.
+func (p *pipeline) run(ctx context.Context, read func(push func(*delivery) error) error) error {
+	type job struct {
+		d      *delivery
+		result chan *parsed
+	}
+
+	jobs := make(chan *job, p.conf.Workers)
+	// ordered holds the jobs in the order they were read. Its capacity
+	// bounds the number of deliveries that are parsed ahead of the one
+	// that is applied next.
+	ordered := make(chan *job, 2*p.conf.Workers)
+
+	var wg sync.WaitGroup
+	var readErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(p.queue.items)
+		readErr = read(func(d *delivery) error {
+			err := p.queue.push(ctx, d)
+			queueDepth.Set(float64(p.queue.depth()))
+			return err
+		})
+	}()
+
+	// the dispatcher hands out the queued deliveries to the workers, and
+	// records their order.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		defer close(ordered)
+		for {
+			var d *delivery
+			select {
+			case d = <-p.queue.items:
+			case <-ctx.Done():
+				return
+			}
+			if d == nil {
+				return // the reader is done
+			}
+			queueDepth.Set(float64(p.queue.depth()))
+
+			j := &job{d: d, result: make(chan *parsed, 1)}
+			select {
+			case ordered <- j:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < p.conf.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.result <- p.parse(j.d)
+			}
+		}()
+	}
+
+	var ticks <-chan time.Time
+	if p.tick != nil {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	// the deliveries are applied in the order they were read
+apply:
+	for {
+		select {
+		case j, ok := <-ordered:
+			if !ok {
+				break apply
+			}
+			select {
+			case res := <-j.result:
+				p.apply(res)
+			case <-ctx.Done():
+			}
+		case now := <-ticks:
+			p.tick(now)
+		}
+	}
+
+	// if the context was cancelled, the reader may still be blocked on
+	// the Streamr node. It returns with its next message, which is not
+	// applied anymore.
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	wg.Wait()
+	return readErr
+}
@@ -0,0 +1,149 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-streamr/client"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PipelineConfig(t *testing.T) {
+	conf, err := parsePipelineConfig(map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, &pipelineConfig{QueueSize: defaultQueueSize, Overflow: overflowBlock, Workers: defaultParseWorkers}, conf)
+
+	conf, err = parsePipelineConfig(map[string]string{"queue_size": "10", "queue_overflow": "drop_oldest", "parse_workers": "1"})
+	require.NoError(t, err)
+	require.Equal(t, &pipelineConfig{QueueSize: 10, Overflow: overflowDropOldest, Workers: 1}, conf)
+
+	for _, m := range []map[string]string{
+		{"queue_size": "0"},
+		{"queue_overflow": "drop"},
+		{"parse_workers": "-1"},
+	} {
+		_, err := parsePipelineConfig(m)
+		require.Error(t, err)
+	}
+
+	// messages may only be dropped if the listener does not resume, since
+	// its positions would move past them
+	require.NoError(t, conf.checkResume(false))
+	require.Error(t, conf.checkResume(true))
+	require.NoError(t, (&pipelineConfig{Overflow: overflowBlock}).checkResume(true))
+}
+
+func Test_QueueOverflow(t *testing.T) {
+	ctx := context.Background()
+	deliveries := make([]*delivery, 4)
+	for i := range deliveries {
+		deliveries[i] = &delivery{msg: &client.StreamrEvent{}}
+		deliveries[i].msg.Metadata.SequenceNumber = int64(i)
+	}
+	drain := func(q *queue) []int64 {
+		var seqs []int64
+		for q.depth() > 0 {
+			seqs = append(seqs, (<-q.items).msg.Metadata.SequenceNumber)
+		}
+		return seqs
+	}
+
+	type testcase struct {
+		policy  overflowPolicy
+		want    []int64
+		dropped int64
+	}
+	for _, tc := range []testcase{
+		{policy: overflowDropNewest, want: []int64{0, 1}, dropped: 2},
+		{policy: overflowDropOldest, want: []int64{2, 3}, dropped: 2},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			q := newQueue(2, tc.policy, "stream")
+			for _, d := range deliveries {
+				require.NoError(t, q.push(ctx, d))
+			}
+			require.Equal(t, tc.want, drain(q))
+			require.Equal(t, tc.dropped, q.dropped.Load())
+
+			n, ok := q.report(time.Now())
+			require.True(t, ok)
+			require.Equal(t, tc.dropped, n)
+		})
+	}
+
+	// a blocked push returns once the context is cancelled
+	q := newQueue(1, overflowBlock, "stream")
+	require.NoError(t, q.push(ctx, deliveries[0]))
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.push(ctx, deliveries[1]), context.DeadlineExceeded)
+}
+
+func Test_PipelineOrder(t *testing.T) {
+	const n = 500
+	readErr := errors.New("connection lost")
+
+	var applied []int64
+	pl := newPipeline(&pipelineConfig{QueueSize: 10, Overflow: overflowBlock, Workers: 8}, "stream",
+		func(d *delivery) *parsed {
+			// workers finish out of order
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			return &parsed{msg: d.msg}
+		},
+		func(p *parsed) {
+			applied = append(applied, p.msg.Metadata.SequenceNumber)
+		},
+	)
+
+	err := pl.run(context.Background(), func(push func(*delivery) error) error {
+		for i := 0; i < n; i++ {
+			d := &delivery{msg: &client.StreamrEvent{}}
+			d.msg.Metadata.SequenceNumber = int64(i)
+			if err := push(d); err != nil {
+				return err
+			}
+		}
+		return readErr
+	})
+	// the deliveries that were read before the reader failed are applied
+	require.ErrorIs(t, err, readErr)
+	require.Len(t, applied, n)
+	for i, seq := range applied {
+		require.EqualValues(t, i, seq)
+	}
+}
+
+func Test_PipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	applied := 0
+	pl := newPipeline(&pipelineConfig{QueueSize: 1, Overflow: overflowBlock, Workers: 2}, "stream",
+		func(d *delivery) *parsed { return &parsed{msg: d.msg} },
+		func(p *parsed) {
+			applied++
+			cancel()
+		},
+	)
+
+	done := make(chan error)
+	go func() {
+		done <- pl.run(ctx, func(push func(*delivery) error) error {
+			for {
+				if err := push(&delivery{msg: &client.StreamrEvent{}}); err != nil {
+					return err
+				}
+			}
+		})
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline did not stop")
+	}
+	require.GreaterOrEqual(t, applied, 1)
+}
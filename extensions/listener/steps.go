@@ -0,0 +1,114 @@
+package listener
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+)
+
+// resultPrefix is the prefix of a step mapping field that refers to a
+// column returned by an earlier step, e.g. "@write_raw.id".
+const resultPrefix = "@"
+
+// stepMappingsPrefix is the prefix of the config that holds the input
+// mappings of a step, followed by the step's procedure.
+const stepMappingsPrefix = "step_mappings_"
+
+// stepConfig is one of the procedures that messages are sent to.
+type stepConfig struct {
+	// Procedure is the procedure to call on the target database.
+	Procedure string
+	// InputMappings maps the procedure's parameters to fields of the
+	// message, like listenerConfig.InputMappings.
+	InputMappings map[string]string
+	// Results are the procedure's parameters that are passed columns
+	// returned by earlier steps.
+	Results []*resolution.StepResult
+}
+
+// parseStepsConfig parses the steps configuration.
+// It returns nil if steps are not configured.
+func parseStepsConfig(m map[string]string) ([]*stepConfig, error) {
+	v, ok := m["steps"]
+	if !ok {
+		return nil, nil
+	}
+
+	var procedures []string
+	var steps []*stepConfig
+	for _, procedure := range strings.Split(v, ",") {
+		procedure = strings.ToLower(strings.TrimSpace(procedure))
+		if procedure == "" {
+			return nil, fmt.Errorf("invalid steps config: %s", v)
+		}
+		if slices.Contains(procedures, procedure) {
+			return nil, fmt.Errorf("invalid steps config: procedure %s is listed twice", procedure)
+		}
+
+		mappings, ok := m[stepMappingsPrefix+procedure]
+		if !ok {
+			return nil, fmt.Errorf("missing required %s%s config", stepMappingsPrefix, procedure)
+		}
+
+		inputs, err := parseMappings(mappings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s%s config: %v", stepMappingsPrefix, procedure, err)
+		}
+
+		step := &stepConfig{
+			Procedure:     procedure,
+			InputMappings: make(map[string]string),
+		}
+		for param, field := range inputs {
+			ref, ok := strings.CutPrefix(field, resultPrefix)
+			if !ok {
+				step.InputMappings[param] = field
+				continue
+			}
+
+			from, column, ok := strings.Cut(ref, ".")
+			idx := slices.Index(procedures, strings.ToLower(from))
+			if !ok || column == "" || idx < 0 {
+				return nil, fmt.Errorf("invalid %s%s config: %s does not refer to a column of an earlier step", stepMappingsPrefix, procedure, field)
+			}
+
+			step.Results = append(step.Results, &resolution.StepResult{
+				Param:  param,
+				Step:   uint64(idx),
+				Column: column,
+			})
+		}
+
+		// results are sorted by parameter, so that every validator
+		// produces the same event body.
+		slices.SortFunc(step.Results, func(a, b *resolution.StepResult) int {
+			return strings.Compare(a.Param, b.Param)
+		})
+
+		procedures = append(procedures, procedure)
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// stepsEvent creates an event that sends a message to each of the steps.
+func stepsEvent(m *message, steps []*stepConfig, targetDB string) (*resolution.StreamrEvent, error) {
+	ev := m.event(nil, targetDB, "")
+	for _, step := range steps {
+		values, err := m.parse(step.InputMappings)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", step.Procedure, err)
+		}
+
+		ev.Steps = append(ev.Steps, &resolution.Step{
+			Procedure: step.Procedure,
+			Values:    values,
+			Results:   step.Results,
+		})
+	}
+
+	return ev, nil
+}
@@ -0,0 +1,120 @@
+package listener
+
+import (
+	"testing"
+
+	"github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StepsConfig(t *testing.T) {
+	type testcase struct {
+		name    string
+		conf    map[string]string
+		want    []*stepConfig
+		wantErr bool
+	}
+
+	tests := []testcase{
+		{
+			name: "not configured",
+			conf: map[string]string{},
+		},
+		{
+			name: "later step consumes an earlier result",
+			conf: map[string]string{
+				"steps":                      "write_raw, Bump_Summary",
+				"step_mappings_write_raw":    "temp:data.temp,device:device_id",
+				"step_mappings_bump_summary": "device:device_id,raw_id:@write_raw.id,total:@WRITE_RAW.total",
+			},
+			want: []*stepConfig{
+				{
+					Procedure:     "write_raw",
+					InputMappings: map[string]string{"temp": "data.temp", "device": "device_id"},
+				},
+				{
+					Procedure:     "bump_summary",
+					InputMappings: map[string]string{"device": "device_id"},
+					Results: []*resolution.StepResult{
+						{Param: "raw_id", Step: 0, Column: "id"},
+						{Param: "total", Step: 0, Column: "total"},
+					},
+				},
+			},
+		},
+		{
+			name: "missing mappings",
+			conf: map[string]string{
+				"steps": "write_raw",
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicate step",
+			conf: map[string]string{
+				"steps":                   "write_raw,write_raw",
+				"step_mappings_write_raw": "temp:temp",
+			},
+			wantErr: true,
+		},
+		{
+			name: "result of a later step",
+			conf: map[string]string{
+				"steps":                      "write_raw,bump_summary",
+				"step_mappings_write_raw":    "id:@bump_summary.id",
+				"step_mappings_bump_summary": "temp:temp",
+			},
+			wantErr: true,
+		},
+		{
+			name: "result without a column",
+			conf: map[string]string{
+				"steps":                   "write_raw",
+				"step_mappings_write_raw": "id:@write_raw",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStepsConfig(tt.conf)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_StepsEvent(t *testing.T) {
+	steps, err := parseStepsConfig(map[string]string{
+		"steps":                      "write_raw,bump_summary",
+		"step_mappings_write_raw":    "temp:temp",
+		"step_mappings_bump_summary": "device:device_id,raw_id:@write_raw.id",
+	})
+	require.NoError(t, err)
+
+	m := &message{content: map[string]any{"temp": 20.5, "device_id": "d1"}}
+	ev, err := stepsEvent(m, steps, "db")
+	require.NoError(t, err)
+
+	require.Empty(t, ev.TargetProcedure)
+	require.Equal(t, []*resolution.Step{
+		{
+			Procedure: "write_raw",
+			Values:    []*resolution.ParamValue{{Param: "temp", Value: "20.5"}},
+		},
+		{
+			Procedure: "bump_summary",
+			Values:    []*resolution.ParamValue{{Param: "device", Value: "d1"}},
+			Results:   []*resolution.StepResult{{Param: "raw_id", Step: 0, Column: "id"}},
+		},
+	}, ev.Steps)
+
+	// a step whose field is missing fails the whole message
+	_, err = stepsEvent(&message{content: map[string]any{"temp": 1}}, steps, "db")
+	require.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/kwilteam/kwil-db/core/log"
+)
+
+const (
+	// defaultRestartDelay is the default delay before the first restart
+	// of a failed subscription.
+	defaultRestartDelay = time.Second
+	// defaultRestartMaxDelay is the default maximum delay between the
+	// restarts of a failed subscription.
+	defaultRestartMaxDelay = 5 * time.Minute
+	// supervisorStableAfter is how long a subscription must have run for
+	// its failure to be treated as a new failure, instead of a repeat of
+	// the previous one.
+	supervisorStableAfter = time.Minute
+)
+
+// parseRestartDelays parses the restart_delay and restart_max_delay
+// configs, which default to defaultRestartDelay and
+// defaultRestartMaxDelay.
+func parseRestartDelays(m map[string]string) (minDelay, maxDelay time.Duration, err error) {
+	minDelay, maxDelay = defaultRestartDelay, defaultRestartMaxDelay
+	if v, ok := m["restart_delay"]; ok {
+		minDelay, err = time.ParseDuration(v)
+		if err != nil || minDelay <= 0 {
+			return 0, 0, fmt.Errorf("invalid restart_delay config: %s", v)
+		}
+	}
+	if v, ok := m["restart_max_delay"]; ok {
+		maxDelay, err = time.ParseDuration(v)
+		if err != nil || maxDelay <= 0 {
+			return 0, 0, fmt.Errorf("invalid restart_max_delay config: %s", v)
+		}
+	}
+	if maxDelay < minDelay {
+		return 0, 0, errors.New("restart_max_delay must not be less than restart_delay")
+	}
+	return minDelay, maxDelay, nil
+}
+
+// listenerState is the state of the Streamr subscription.
+type listenerState int32
+
+const (
+	// stateStarting is the state until the first subscription connects.
+	stateStarting listenerState = iota
+	// stateRunning is the state while a subscription is connected.
+	stateRunning
+	// stateDegraded is the state after a subscription failed, until it is
+	// restarted successfully. No messages are read while degraded.
+	stateDegraded
+)
+
+func (s listenerState) String() string {
+	switch s {
+	case stateStarting:
+		return "starting"
+	case stateRunning:
+		return "running"
+	case stateDegraded:
+		return "degraded"
+	default:
+		return "unknown"
+	}
+}
+
+// session runs a single subscription until it fails or the context is
+// cancelled. It calls connected once it is connected to the Streamr node.
+type session func(ctx context.Context, connected func()) error
+
+// supervisor runs the subscription, and restarts it with an exponential,
+// capped backoff whenever it fails. A failed subscription should never
+// stop ingestion for good, so the supervisor only stops when its context
+// is cancelled.
+type supervisor struct {
+	minDelay time.Duration
+	maxDelay time.Duration
+	logger   log.SugaredLogger
+
+	state atomic.Int32
+	// failures is the number of failures since the subscription last
+	// connected.
+	failures int
+	// degradedSince is when the subscription last became degraded.
+	degradedSince time.Time
+}
+
+func newSupervisor(minDelay, maxDelay time.Duration, logger log.SugaredLogger) *supervisor {
+	s := &supervisor{
+		minDelay: minDelay,
+		maxDelay: maxDelay,
+		logger:   logger,
+	}
+	s.setState(stateStarting)
+	return s
+}
+
+// run runs the session until the context is cancelled.
+func (s *supervisor) run(ctx context.Context, run session) {
+	b := &backoff.Backoff{
+		Min:    s.minDelay,
+		Max:    s.maxDelay,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for {
+		start := time.Now()
+		err := run(ctx, s.connected)
+		if ctx.Err() != nil {
+			s.logger.Info("context cancelled, stopping streamr listener")
+			return
+		}
+		if time.Since(start) >= supervisorStableAfter {
+			b.Reset()
+		}
+
+		delay := b.Duration()
+		s.degrade(err, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.logger.Info("context cancelled, stopping streamr listener")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// connected is called by the session once it is connected.
+func (s *supervisor) connected() {
+	if s.getState() == stateDegraded {
+		s.logger.Info("Streamr listener recovered", "failures", s.failures, "degraded_for", time.Since(s.degradedSince).Round(time.Second))
+	}
+	s.failures = 0
+	s.setState(stateRunning)
+}
+
+// degrade is called when the session fails.
+func (s *supervisor) degrade(err error, delay time.Duration) {
+	if s.getState() != stateDegraded {
+		s.degradedSince = time.Now()
+	}
+	s.failures++
+	s.setState(stateDegraded)
+	restarts.Inc()
+
+	msg := "subscription ended"
+	if err != nil {
+		msg = err.Error()
+	}
+	s.logger.Error("Streamr listener degraded, restarting subscription", "error", msg, "failures", s.failures, "retry_in", delay.Round(time.Millisecond))
+}
+
+func (s *supervisor) setState(state listenerState) {
+	s.state.Store(int32(state))
+	setState(state)
+}
+
+// getState returns the current state of the subscription.
+func (s *supervisor) getState() listenerState {
+	return listenerState(s.state.Load())
+}
@@ -0,0 +1,96 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kwilteam/kwil-db/core/log"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RestartDelays(t *testing.T) {
+	minDelay, maxDelay, err := parseRestartDelays(map[string]string{})
+	require.NoError(t, err)
+	require.Equal(t, defaultRestartDelay, minDelay)
+	require.Equal(t, defaultRestartMaxDelay, maxDelay)
+
+	minDelay, maxDelay, err = parseRestartDelays(map[string]string{"restart_delay": "2s", "restart_max_delay": "1m"})
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, minDelay)
+	require.Equal(t, time.Minute, maxDelay)
+
+	_, _, err = parseRestartDelays(map[string]string{"restart_delay": "0s"})
+	require.Error(t, err)
+	_, _, err = parseRestartDelays(map[string]string{"restart_delay": "10m"})
+	require.Error(t, err)
+}
+
+func Test_Supervisor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newSupervisor(time.Millisecond, 4*time.Millisecond, log.NewNoOp().Sugar())
+	require.Equal(t, stateStarting, s.getState())
+
+	runs := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, func(ctx context.Context, connected func()) error {
+			runs++
+			switch runs {
+			case 1:
+				// fails before connecting
+				return errors.New("dial failed")
+			case 2:
+				// connects, then fails
+				connected()
+				require.Equal(t, stateRunning, s.getState())
+				return errors.New("connection lost")
+			case 3:
+				// a subscription that ends without an error is restarted
+				// as well
+				require.Equal(t, stateDegraded, s.getState())
+				require.Equal(t, 1, s.failures)
+				return nil
+			default:
+				connected()
+				cancel()
+				<-ctx.Done()
+				return nil
+			}
+		})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+	require.Equal(t, 4, runs)
+	require.Equal(t, stateRunning, s.getState())
+	require.Zero(t, s.failures)
+}
+
+func Test_SupervisorCancelWhileDegraded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSupervisor(time.Hour, time.Hour, log.NewNoOp().Sugar())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.run(ctx, func(ctx context.Context, connected func()) error {
+			return errors.New("dial failed")
+		})
+	}()
+
+	require.Eventually(t, func() bool { return s.getState() == stateDegraded }, 5*time.Second, time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop while waiting to restart")
+	}
+}
@@ -0,0 +1,60 @@
+package listener
+
+import "time"
+
+// defaultIdleTimeout is the default time that a stream must be quiet for
+// its windows to be closed by wall-clock time.
+const defaultIdleTimeout = time.Minute
+
+// tumblingWindow assigns Streamr message timestamps to fixed-size windows
+// that are aligned to the unix epoch. Because windows are derived from stream
+// time rather than wall-clock time, every validator assigns a message to the
+// same window, regardless of when it received the message.
+type tumblingWindow struct {
+	// size is the size of each window, in milliseconds.
+	size int64
+	// lateness is how far, in milliseconds, the watermark must pass the end
+	// of a window before the window is considered closed. It gives slightly
+	// out-of-order messages a chance to land in their window.
+	lateness int64
+	// watermark is the highest message timestamp seen so far.
+	watermark int64
+}
+
+// start returns the start of the window that the timestamp belongs to.
+func (w *tumblingWindow) start(ts int64) int64 {
+	if ts < 0 {
+		// Streamr timestamps are unix milliseconds, so this should never
+		// happen, but we still want negative timestamps to round down.
+		return ts - (w.size+ts%w.size)%w.size
+	}
+	return ts - ts%w.size
+}
+
+// observe advances the watermark to the given timestamp, if it is higher
+// than the current watermark.
+func (w *tumblingWindow) observe(ts int64) {
+	if ts > w.watermark {
+		w.watermark = ts
+	}
+}
+
+// closed returns true if the window starting at the given timestamp will
+// not receive any more messages.
+func (w *tumblingWindow) closed(start int64) bool {
+	return w.watermark >= start+w.size+w.lateness
+}
+
+// due returns true if the window starting at the given timestamp ended,
+// with its lateness, at least grace before now in wall-clock time. It is
+// used to close the windows of a stream that has gone quiet, since their
+// watermark does not move anymore.
+func (w *tumblingWindow) due(start int64, now time.Time, grace time.Duration) bool {
+	return now.UnixMilli() >= start+w.size+w.lateness+grace.Milliseconds()
+}
+
+// close advances the watermark so that the window starting at the given
+// timestamp, and every window before it, is closed.
+func (w *tumblingWindow) close(start int64) {
+	w.observe(start + w.size + w.lateness)
+}
@@ -1,20 +1,113 @@
 package extensions
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 
 	"github.com/kwilteam/kwil-db/extensions/listeners"
+	"github.com/kwilteam/kwil-db/extensions/precompiles"
 	"github.com/kwilteam/kwil-db/extensions/resolutions"
 	streamrListener "github.com/kwilteam/kwil-streamr/extensions/listener"
 	streamrResolution "github.com/kwilteam/kwil-streamr/extensions/resolution"
 )
 
-func RegisterExtensions() error {
+// ResolutionType is an additional resolution type that subscriptions can
+// choose with the resolution_type config. It is registered for single
+// events with Name, which must end in _res, and for batches with
+// resolution.BatchResolutionName(Name), so streamr_fast_res is batched as
+// streamr_fast_batch_res. All validators must register the same types.
+type ResolutionType struct {
+	// Name is the name of the resolution type.
+	Name string
+	// RefundThreshold is the share of voting power that must vote for an
+	// event for the voters to be refunded. It must be above 0, and at
+	// most ConfirmationThreshold, which must be at most 1.
+	RefundThreshold *big.Rat
+	// ConfirmationThreshold is the share of voting power that must vote
+	// for an event for it to be applied.
+	ConfirmationThreshold *big.Rat
+	// ExpirationPeriod is the number of blocks after which an event that
+	// has not been confirmed expires.
+	ExpirationPeriod int64
+}
+
+// Option configures the extensions that RegisterExtensions registers.
+type Option func(*registerOptions) error
+
+type registerOptions struct {
+	resolutionTypes []ResolutionType
+}
+
+// WithResolutionType registers an additional resolution type.
+func WithResolutionType(t ResolutionType) Option {
+	return func(o *registerOptions) error {
+		if t.Name == "" {
+			return errors.New("resolution type name is required")
+		}
+		if !strings.HasSuffix(t.Name, streamrResolution.ResolutionNameSuffix) {
+			return fmt.Errorf("resolution type %s: name must end in %s", t.Name, streamrResolution.ResolutionNameSuffix)
+		}
+		if t.RefundThreshold == nil || t.ConfirmationThreshold == nil {
+			return fmt.Errorf("resolution type %s: thresholds are required", t.Name)
+		}
+		if t.RefundThreshold.Sign() <= 0 || t.RefundThreshold.Cmp(t.ConfirmationThreshold) > 0 ||
+			t.ConfirmationThreshold.Cmp(big.NewRat(1, 1)) > 0 {
+			return fmt.Errorf("resolution type %s: thresholds must be 0 < refund <= confirmation <= 1", t.Name)
+		}
+		if t.ExpirationPeriod < 1 {
+			return fmt.Errorf("resolution type %s: expiration period must be at least 1 block", t.Name)
+		}
+
+		o.resolutionTypes = append(o.resolutionTypes, t)
+		return nil
+	}
+}
+
+func RegisterExtensions(opts ...Option) error {
+	options := &registerOptions{}
+	for _, opt := range opts {
+		if err := opt(options); err != nil {
+			return err
+		}
+	}
+
 	err := resolutions.RegisterResolution(streamrResolution.StreamrResolutionName, resolutions.ModAdd, streamrResolution.ResolutionConfig)
 	if err != nil {
 		return fmt.Errorf("failed to register Streamr resolution: %v", err)
 	}
 
+	err = resolutions.RegisterResolution(streamrResolution.StreamrBatchResolutionName, resolutions.ModAdd, streamrResolution.BatchResolutionConfig)
+	if err != nil {
+		return fmt.Errorf("failed to register Streamr batch resolution: %v", err)
+	}
+
+	err = resolutions.RegisterResolution(streamrResolution.StreamrAllowResolutionName, resolutions.ModAdd, streamrResolution.AllowResolutionConfig)
+	if err != nil {
+		return fmt.Errorf("failed to register Streamr allow resolution: %v", err)
+	}
+
+	for _, t := range options.resolutionTypes {
+		err = resolutions.RegisterResolution(t.Name, resolutions.ModAdd,
+			streamrResolution.NewResolutionConfig(t.RefundThreshold, t.ConfirmationThreshold, t.ExpirationPeriod))
+		if err != nil {
+			return fmt.Errorf("failed to register Streamr resolution type %s: %v", t.Name, err)
+		}
+
+		batchName := streamrResolution.BatchResolutionName(t.Name)
+		err = resolutions.RegisterResolution(batchName, resolutions.ModAdd,
+			streamrResolution.NewBatchResolutionConfig(t.RefundThreshold, t.ConfirmationThreshold, t.ExpirationPeriod))
+		if err != nil {
+			return fmt.Errorf("failed to register Streamr resolution type %s: %v", batchName, err)
+		}
+	}
+
+	err = precompiles.RegisterPrecompile(streamrResolution.StreamrPrecompileName, streamrResolution.InitializePrecompile)
+	if err != nil {
+		return fmt.Errorf("failed to register Streamr precompile: %v", err)
+	}
+
 	err = listeners.RegisterListener(streamrListener.ExtensionName, streamrListener.StartStreamrListener)
 	if err != nil {
 		return fmt.Errorf("failed to register Streamr listener: %v", err)
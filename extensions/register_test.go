@@ -0,0 +1,88 @@
+package extensions
+
+import (
+	"math/big"
+	"testing"
+
+	streamrResolution "github.com/kwilteam/kwil-streamr/extensions/resolution"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WithResolutionType(t *testing.T) {
+	type testcase struct {
+		name         string
+		typ          ResolutionType
+		wantErr      bool
+		wantBatchRes string
+	}
+
+	valid := func(refund, confirmation *big.Rat) ResolutionType {
+		return ResolutionType{
+			Name:                  "streamr_fast_res",
+			RefundThreshold:       refund,
+			ConfirmationThreshold: confirmation,
+			ExpirationPeriod:      100,
+		}
+	}
+
+	tests := []testcase{
+		{
+			name:         "valid",
+			typ:          valid(big.NewRat(1, 3), big.NewRat(1, 2)),
+			wantBatchRes: "streamr_fast_batch_res",
+		},
+		{
+			name:         "unanimous",
+			typ:          valid(big.NewRat(1, 1), big.NewRat(1, 1)),
+			wantBatchRes: "streamr_fast_batch_res",
+		},
+		{
+			name:    "zero refund",
+			typ:     valid(big.NewRat(0, 1), big.NewRat(1, 2)),
+			wantErr: true,
+		},
+		{
+			name:    "refund above confirmation",
+			typ:     valid(big.NewRat(2, 3), big.NewRat(1, 2)),
+			wantErr: true,
+		},
+		{
+			name:    "confirmation above 1",
+			typ:     valid(big.NewRat(1, 3), big.NewRat(3, 2)),
+			wantErr: true,
+		},
+		{
+			name:    "missing threshold",
+			typ:     valid(big.NewRat(1, 3), nil),
+			wantErr: true,
+		},
+		{
+			name: "name without suffix",
+			typ: ResolutionType{
+				Name:                  "streamr_fast",
+				RefundThreshold:       big.NewRat(1, 3),
+				ConfirmationThreshold: big.NewRat(1, 2),
+				ExpirationPeriod:      100,
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := &registerOptions{}
+			err := WithResolutionType(tt.typ)(options)
+			if tt.wantErr {
+				require.Error(t, err)
+				require.Empty(t, options.resolutionTypes)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantBatchRes, streamrResolution.BatchResolutionName(options.resolutionTypes[0].Name))
+		})
+	}
+
+	// the default types follow the same naming
+	require.Equal(t, streamrResolution.StreamrBatchResolutionName,
+		streamrResolution.BatchResolutionName(streamrResolution.StreamrResolutionName))
+}
@@ -0,0 +1,164 @@
+package resolution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/common/sql"
+	"github.com/kwilteam/kwil-db/core/types/serialize"
+	"github.com/kwilteam/kwil-db/extensions/resolutions"
+)
+
+// anyStream is the stream of an allowed target that allows every stream.
+// It is also the only stream that allows events with no stream ID, which
+// is the case for events that use the legacy transaction ID.
+const anyStream = "*"
+
+// errTargetNotAllowed is returned if an event's target is not allowed.
+var errTargetNotAllowed = errors.New("target is not allowed to receive Streamr events")
+
+// checkAllowed returns errTargetNotAllowed if events from the event's
+// stream may not be applied to the target procedure. If the target is the
+// event's steps, each of them must be allowed. Targets are refused unless
+// they are allowed, so a database that never allowed a target, or whose
+// last target was revoked, receives no events.
+func checkAllowed(ctx context.Context, db sql.Executor, ev *StreamrEvent, target string) error {
+	if len(ev.Steps) > 0 && strings.EqualFold(target, ev.Target()) {
+		for _, step := range ev.Steps {
+			if err := checkTarget(ctx, db, ev, step.Procedure); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return checkTarget(ctx, db, ev, target)
+}
+
+// checkTarget returns errTargetNotAllowed if events from the event's
+// stream may not be applied to a procedure or table.
+func checkTarget(ctx context.Context, db sql.Executor, ev *StreamrEvent, target string) error {
+	stream := ev.StreamID
+	if stream == "" {
+		stream = anyStream
+	}
+
+	res, err := db.Execute(ctx, isTargetAllowed, ev.TargetDBID, strings.ToLower(target), stream)
+	if err != nil {
+		return err
+	}
+	if len(res.Rows) == 0 {
+		return fmt.Errorf("%w: stream %q, database %s, procedure %s", errTargetNotAllowed, ev.StreamID, ev.TargetDBID, target)
+	}
+
+	return nil
+}
+
+// allowTarget allows events from a stream to be applied to a procedure.
+func allowTarget(ctx context.Context, db sql.Executor, stream, dbid, procedure string) error {
+	if stream == "" || procedure == "" {
+		return errors.New("stream and procedure are required")
+	}
+	_, err := db.Execute(ctx, insertAllowedTarget, stream, dbid, strings.ToLower(procedure))
+	return err
+}
+
+// revokeTarget removes a target that was allowed.
+func revokeTarget(ctx context.Context, db sql.Executor, stream, dbid, procedure string) error {
+	res, err := db.Execute(ctx, deleteAllowedTarget, stream, dbid, strings.ToLower(procedure))
+	if err != nil {
+		return err
+	}
+	if res.Status.RowsAffected == 0 {
+		return fmt.Errorf("stream %q is not allowed for procedure %s", stream, procedure)
+	}
+
+	return nil
+}
+
+// StreamrAllowResolutionName is the resolution type of allow proposals,
+// with which validators allow targets by vote. See AllowProposal.
+const StreamrAllowResolutionName = "streamr_allow_res"
+
+// AllowResolutionConfig is the resolution config for allow proposals. They
+// are applied once two thirds of the voting power has proposed them.
+var AllowResolutionConfig = resolutions.ResolutionConfig{
+	RefundThreshold:       big.NewRat(1, 3),
+	ConfirmationThreshold: big.NewRat(2, 3),
+	ExpirationPeriod:      14400,
+	ResolveFunc: func(ctx context.Context, app *common.App, resolution *resolutions.Resolution) error {
+		p := &AllowProposal{}
+		if err := p.UnmarshalBinary(resolution.Body); err != nil {
+			return err
+		}
+
+		return resolve(ctx, app, func() error {
+			app.Service.Logger.Info("allowing Streamr targets by vote", "stream", p.StreamID, "dbid", p.TargetDBID, "targets", p.Targets)
+			for _, target := range p.Targets {
+				if err := allowTarget(ctx, app.DB, p.StreamID, p.TargetDBID, target); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	},
+}
+
+// AllowProposal proposes to allow events from a stream to be applied to
+// procedures or tables of a database. It lets validators allow targets of
+// schemas that cannot use the precompile, such as schemas deployed before
+// it existed.
+type AllowProposal struct {
+	// StreamID is the stream that is allowed, or "*" for any stream.
+	StreamID string
+	// TargetDBID is the database of the targets.
+	TargetDBID string
+	// Targets are the procedures and tables that are allowed.
+	Targets []string
+}
+
+// MarshalBinary encodes the proposal. Targets are lowercased, sorted and
+// deduplicated first, so that validators that list them differently
+// propose identical bodies. Proposals are always versioned, since no node
+// that only knows the legacy encoding can resolve them.
+func (p *AllowProposal) MarshalBinary() ([]byte, error) {
+	if p.StreamID == "" || p.TargetDBID == "" || len(p.Targets) == 0 {
+		return nil, errors.New("allow proposal requires a stream, a database and targets")
+	}
+
+	targets := make([]string, 0, len(p.Targets))
+	for _, target := range p.Targets {
+		targets = append(targets, strings.ToLower(target))
+	}
+	slices.Sort(targets)
+
+	return encodeVersioned(WireVersion1, kindAllow, &allowV1{
+		StreamID:   p.StreamID,
+		TargetDBID: p.TargetDBID,
+		Targets:    slices.Compact(targets),
+	})
+}
+
+// UnmarshalBinary decodes a proposal.
+func (p *AllowProposal) UnmarshalBinary(data []byte) error {
+	version, payload, err := decodeHeader(data, kindAllow)
+	if err != nil {
+		return err
+	}
+	if version != WireVersion1 {
+		return fmt.Errorf("unsupported allow proposal version %d", version)
+	}
+
+	allow := &allowV1{}
+	if err := serialize.Decode(payload, allow); err != nil {
+		return err
+	}
+
+	p.StreamID, p.TargetDBID, p.Targets = allow.StreamID, allow.TargetDBID, allow.Targets
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/extensions/resolutions"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CheckAllowed(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+
+	// databases that have not allowed any target receive no events
+	require.ErrorIs(t, resolveEvent(t, app, liveEvent(100, 0)), errTargetNotAllowed)
+
+	// allowing a target of the database does not allow the others
+	allowLive(t, app, "0xabc/weather", "bump")
+	require.ErrorIs(t, resolveEvent(t, app, liveEvent(200, 0)), errTargetNotAllowed)
+
+	allowLive(t, app, "0xabc/weather", "WRITE")
+	require.NoError(t, resolveEvent(t, app, liveEvent(300, 0)))
+
+	// targets are allowed per stream, unless any stream is allowed
+	other := liveEvent(400, 0)
+	other.StreamID = "0xabc/wind"
+	require.ErrorIs(t, resolveEvent(t, app, other), errTargetNotAllowed)
+	allowLive(t, app, anyStream, "write")
+	require.NoError(t, resolveEvent(t, app, other))
+
+	// each step must be allowed
+	steps := liveEvent(500, 0)
+	steps.StreamID = "0xabc/wind"
+	steps.Steps = []*Step{
+		{Procedure: "write", Values: []*ParamValue{{Param: "temp", Value: "1"}}},
+		{Procedure: "bump", Values: []*ParamValue{{Param: "temp", Value: "2"}}},
+	}
+	require.ErrorIs(t, checkAllowed(ctx, app.DB, steps, steps.Target()), errTargetNotAllowed)
+	steps.StreamID = "0xabc/weather"
+	require.NoError(t, checkAllowed(ctx, app.DB, steps, steps.Target()))
+
+	require.Equal(t, []string{"write[300]", "write[400]"}, calls(t, app))
+
+	require.NoError(t, revokeTarget(ctx, app.DB, anyStream, liveDBID, "Write"))
+	require.ErrorIs(t, resolveEvent(t, app, other), errTargetNotAllowed)
+	require.Error(t, revokeTarget(ctx, app.DB, anyStream, liveDBID, "write"))
+}
+
+func Test_RevokeLastTarget(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+
+	allowLive(t, app, "0xabc/weather", "write")
+	require.NoError(t, resolveEvent(t, app, liveEvent(100, 0)))
+
+	// revoking the only allowed target does not open the database again
+	require.NoError(t, revokeTarget(ctx, app.DB, "0xabc/weather", liveDBID, "write"))
+	require.Empty(t, query(t, app, ListAllowedTargets, liveDBID))
+	require.ErrorIs(t, resolveEvent(t, app, liveEvent(200, 0)), errTargetNotAllowed)
+	require.Equal(t, []string{"write[100]"}, calls(t, app))
+}
+
+func Test_AllowResolution(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+
+	body, err := (&AllowProposal{
+		StreamID:   "0xabc/weather",
+		TargetDBID: liveDBID,
+		Targets:    []string{"Write", "bump"},
+	}).MarshalBinary()
+	require.NoError(t, err)
+
+	require.NoError(t, resolveLive(t, app, func(app *common.App) error {
+		return AllowResolutionConfig.ResolveFunc(ctx, app, &resolutions.Resolution{
+			Body: body,
+			Type: StreamrAllowResolutionName,
+		})
+	}))
+	require.Equal(t, [][]any{
+		{"0xabc/weather", liveDBID, "bump"},
+		{"0xabc/weather", liveDBID, "write"},
+	}, query(t, app, ListAllowedTargets, ""))
+
+	ev := liveEvent(100, 0)
+	ev.TargetProcedure = "write_late"
+	require.ErrorIs(t, resolveEvent(t, app, ev), errTargetNotAllowed)
+	require.NoError(t, resolveEvent(t, app, liveEvent(200, 0)))
+}
@@ -0,0 +1,153 @@
+package resolution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/common/sql"
+)
+
+// sqlstateRaise is the SQLSTATE of errors raised by a procedure, such as
+// with kwil's error function.
+const sqlstateRaise = "P0001"
+
+// errTargetNotFound is returned if an event's target database or
+// procedure does not exist, or does not match the event.
+var errTargetNotFound = errors.New("target not found")
+
+// failureClass is the kind of error that a failed event is recorded with.
+type failureClass string
+
+const (
+	// failureTarget is an event whose target does not exist.
+	failureTarget failureClass = "target"
+	// failureConstraint is an event that violated a constraint of a table.
+	failureConstraint failureClass = "constraint"
+	// failureData is an event with a value that could not be used, for
+	// example because it could not be cast to the parameter's type.
+	failureData failureClass = "data"
+	// failureProcedure is any other error returned by the procedure.
+	failureProcedure failureClass = "procedure"
+	// failureRetention is an event that was older than its replay
+	// retention, so it could not be checked for replays.
+	failureRetention failureClass = "retention"
+)
+
+// classifyError returns the failure class of an error.
+func classifyError(err error) failureClass {
+	if errors.Is(err, errTargetNotFound) {
+		return failureTarget
+	}
+	if errors.Is(err, errBeyondRetention) {
+		return failureRetention
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && len(pgErr.Code) >= 2 {
+		// https://www.postgresql.org/docs/current/errcodes-appendix.html
+		switch pgErr.Code[:2] {
+		case "23":
+			return failureConstraint
+		case "22":
+			return failureData
+		}
+	}
+
+	return failureProcedure
+}
+
+// failureMessage returns the message that an error is recorded with. It
+// must be the same on every node. The text of Postgres errors depends on
+// lc_messages and the version of Postgres, so only their SQLSTATE is kept,
+// except for errors raised by the procedure itself, whose message is the
+// procedure's own. Other errors come from the engine or the resolution,
+// such as an unknown procedure or a wrong number of arguments, and are
+// kept as they are.
+func failureMessage(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code != "" {
+		if pgErr.Code == sqlstateRaise {
+			return "SQLSTATE " + pgErr.Code + ": " + pgErr.Message
+		}
+		return "SQLSTATE " + pgErr.Code
+	}
+
+	return err.Error()
+}
+
+// recordFailure records a failed event in the failure ledger.
+func recordFailure(ctx context.Context, db sql.Executor, ev *StreamrEvent, target string, cause error) error {
+	body, err := ev.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	class := classifyError(cause)
+	_, err = db.Execute(ctx, upsertFailure, ev.TxID(), ev.TargetDBID, target,
+		string(class), failureMessage(cause), int64(ev.Timestamp), body)
+	return err
+}
+
+// redrive calls a procedure with the event of a failure, or inserts it
+// into its target table, and removes the failure if it succeeds. The
+// failure must target the given database, and the procedure must be
+// allowed, as it would be for the event itself.
+func redrive(ctx context.Context, app *common.App, dbid, id, procedure string) error {
+	res, err := app.DB.Execute(ctx, getFailure, id)
+	if err != nil {
+		return err
+	}
+	if len(res.Rows) == 0 {
+		return fmt.Errorf("failure %s not found", id)
+	}
+
+	targetDBID, ok1 := res.Rows[0][0].(string)
+	targetProcedure, ok2 := res.Rows[0][1].(string)
+	body, ok3 := res.Rows[0][2].([]byte)
+	if !ok1 || !ok2 || !ok3 {
+		return fmt.Errorf("unexpected failure types %T, %T, %T", res.Rows[0][0], res.Rows[0][1], res.Rows[0][2])
+	}
+	if targetDBID != dbid {
+		return fmt.Errorf("failure %s does not target this database", id)
+	}
+
+	ev := &StreamrEvent{}
+	if err := ev.UnmarshalBinary(body); err != nil {
+		return err
+	}
+	if procedure == "" {
+		procedure = targetProcedure
+	}
+
+	if err := checkAllowed(ctx, app.DB, ev, procedure); err != nil {
+		return err
+	}
+
+	// the procedure is executed in a savepoint, as it is by applyEvent, so
+	// that a failed redrive leaves none of its changes behind.
+	tx, err := app.DB.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = execute(ctx, &common.App{
+		Service: app.Service,
+		DB:      tx,
+		Engine:  app.Engine,
+	}, ev, procedure)
+	if err != nil {
+		if err2 := tx.Rollback(ctx); err2 != nil {
+			return err2
+		}
+		return fmt.Errorf("failed to redrive %s: %w", id, err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	_, err = app.DB.Execute(ctx, deleteFailure, id)
+	return err
+}
@@ -0,0 +1,93 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RecordFailure(t *testing.T) {
+	app, engine := newLiveApp(t)
+	engine.failing["write"] = raise("temperature out of range")
+	engine.failing["bump"] = `INSERT INTO streamr_test.calls (id, call) VALUES (0, 'a'), (0, 'b');`
+	allowLive(t, app, anyStream, "write", "bump", "missing")
+
+	ev := liveEvent(100, 0)
+	ev.RecordFailures = true
+	require.NoError(t, resolveEvent(t, app, ev))
+
+	// the changes of the failed procedure are rolled back, and the
+	// failure is recorded with the procedure's own message
+	require.Empty(t, calls(t, app))
+	body, err := ev.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, [][]any{{liveDBID, "write", body}}, query(t, app, getFailure, ev.TxID()))
+
+	constraint := liveEvent(200, 0)
+	constraint.RecordFailures = true
+	constraint.TargetProcedure = "bump"
+	require.NoError(t, resolveEvent(t, app, constraint))
+
+	missing := liveEvent(300, 0)
+	missing.RecordFailures = true
+	missing.TargetProcedure = "missing"
+	require.NoError(t, resolveEvent(t, app, missing))
+
+	// only the SQLSTATE of other Postgres errors is kept, since their
+	// text can differ between nodes
+	require.Equal(t, [][]any{
+		{ev.TxID(), liveDBID, "write", string(failureProcedure), "SQLSTATE P0001: temperature out of range", int64(100)},
+		{constraint.TxID(), liveDBID, "bump", string(failureConstraint), "SQLSTATE 23505", int64(200)},
+		{missing.TxID(), liveDBID, "missing", string(failureTarget), "target not found: could not find target procedure or action missing", int64(300)},
+	}, query(t, app, ListFailures, ""))
+
+	// without the failure ledger, the error fails the resolution
+	require.Error(t, resolveEvent(t, app, liveEvent(400, 0)))
+	require.Len(t, query(t, app, ListFailures, liveDBID), 3)
+}
+
+func Test_Redrive(t *testing.T) {
+	ctx := context.Background()
+	app, engine := newLiveApp(t)
+	engine.failing["write"] = raise("caller is not streamr")
+	allowLive(t, app, "0xabc/weather", "write")
+
+	ev := liveEvent(100, 0)
+	ev.RecordFailures = true
+	require.NoError(t, resolveEvent(t, app, ev))
+	require.Len(t, query(t, app, getFailure, ev.TxID()), 1)
+
+	require.ErrorContains(t, redrive(ctx, app, "otherdb", ev.TxID(), ""), "does not target this database")
+	require.ErrorContains(t, redrive(ctx, app, liveDBID, "unknown", ""), "not found")
+
+	// a failed redrive leaves none of its changes, and the failure is
+	// kept until a redrive succeeds
+	require.ErrorContains(t, redrive(ctx, app, liveDBID, ev.TxID(), ""), "caller is not streamr")
+	require.Empty(t, calls(t, app))
+	require.Len(t, query(t, app, getFailure, ev.TxID()), 1)
+
+	delete(engine.failing, "write")
+	require.NoError(t, resolveLive(t, app, func(app *common.App) error {
+		return redrive(ctx, app, liveDBID, ev.TxID(), "")
+	}))
+	require.Empty(t, query(t, app, getFailure, ev.TxID()))
+	require.Equal(t, []string{"write[100]"}, calls(t, app))
+
+	// a failure can be re-driven to another procedure, if it is allowed
+	engine.failing["write"] = raise("caller is not streamr")
+	ev = liveEvent(200, 0)
+	ev.RecordFailures = true
+	require.NoError(t, resolveEvent(t, app, ev))
+	require.ErrorIs(t, redrive(ctx, app, liveDBID, ev.TxID(), "bump"), errTargetNotAllowed)
+
+	allowLive(t, app, ev.StreamID, "bump")
+	require.NoError(t, resolveLive(t, app, func(app *common.App) error {
+		return redrive(ctx, app, liveDBID, ev.TxID(), "bump")
+	}))
+	require.Empty(t, query(t, app, ListFailures, ""))
+	require.Equal(t, []string{"write[100]", "bump[200]"}, calls(t, app))
+}
@@ -0,0 +1,67 @@
+package resolution
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics of the resolution are registered with the default registry,
+// which is served by the node's metrics endpoint. They are local to the
+// node, and never affect its state.
+var (
+	eventsExecuted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "resolution",
+		Name:      "events_executed_total",
+		Help:      "Number of Streamr events that were applied to their target.",
+	}, []string{"dbid", "target"})
+	eventsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "resolution",
+		Name:      "events_failed_total",
+		Help:      "Number of Streamr events whose target failed.",
+	}, []string{"dbid", "target"})
+	eventsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "streamr",
+		Subsystem: "resolution",
+		Name:      "events_skipped_total",
+		Help:      "Number of Streamr events that were not applied to their target, by reason.",
+	}, []string{"dbid", "target", "reason"})
+	executionSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "streamr",
+		Subsystem: "resolution",
+		Name:      "execution_seconds",
+		Help:      "Time taken to apply a Streamr event to its target.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"dbid", "target"})
+)
+
+// The reasons that events are skipped.
+const (
+	// skipReplayed is an event that has already been applied.
+	skipReplayed = "replayed"
+	// skipRetention is an event older than its replay retention.
+	skipRetention = "retention"
+	// skipOutOfOrder is an event older than the latest applied event of
+	// its message chain.
+	skipOutOfOrder = "out_of_order"
+)
+
+// observeSkipped records an event that was skipped.
+func observeSkipped(dbid, target, reason string) {
+	eventsSkipped.WithLabelValues(dbid, strings.ToLower(target), reason).Inc()
+}
+
+// observeExecution records the execution of an event's target.
+func observeExecution(dbid, target string, took time.Duration, err error) {
+	target = strings.ToLower(target)
+	executionSeconds.WithLabelValues(dbid, target).Observe(took.Seconds())
+	if err != nil {
+		eventsFailed.WithLabelValues(dbid, target).Inc()
+		return
+	}
+	eventsExecuted.WithLabelValues(dbid, target).Inc()
+}
@@ -0,0 +1,25 @@
+package resolution
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ObserveExecution(t *testing.T) {
+	// other tests apply events, which are observed too
+	executionSeconds.Reset()
+	eventsExecuted.Reset()
+	eventsFailed.Reset()
+
+	observeExecution("db", "Write", time.Millisecond, nil)
+	observeExecution("db", "write", time.Millisecond, errors.New("failed"))
+
+	// targets are case-insensitive
+	require.Equal(t, 1.0, testutil.ToFloat64(eventsExecuted.WithLabelValues("db", "write")))
+	require.Equal(t, 1.0, testutil.ToFloat64(eventsFailed.WithLabelValues("db", "write")))
+	require.Equal(t, 1, testutil.CollectAndCount(executionSeconds))
+}
@@ -0,0 +1,114 @@
+package resolution
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kwilteam/kwil-db/core/types"
+)
+
+// maxCachedPlans is the maximum number of binding plans that are cached.
+// If it is exceeded, the cache is cleared. It only bounds the memory used
+// by plans of targets that no longer exist.
+const maxCachedPlans = 4096
+
+// bindingPlan is the order in which event values are passed to the
+// parameters of a target procedure or action.
+type bindingPlan struct {
+	// schema is the schema that the plan was built from. The engine
+	// replaces a schema when its dataset is dropped and deployed again,
+	// so a plan is only valid while the engine returns the same schema.
+	schema *types.Schema
+	// params are the names of the target's parameters, without "$".
+	params []string
+}
+
+// newBindingPlan builds the binding plan of a target procedure or action.
+func newBindingPlan(schema *types.Schema, target string) (*bindingPlan, error) {
+	plan := &bindingPlan{schema: schema}
+
+	proc, ok := schema.FindProcedure(target)
+	if ok {
+		for _, p := range proc.Parameters {
+			plan.params = append(plan.params, strings.TrimPrefix(p.Name, "$"))
+		}
+		return plan, nil
+	}
+
+	// if not found, search for an action
+	act, ok := schema.FindAction(target)
+	if !ok {
+		return nil, fmt.Errorf("could not find target procedure or action %s", target)
+	}
+
+	for _, p := range act.Parameters {
+		plan.params = append(plan.params, strings.TrimPrefix(p, "$"))
+	}
+
+	return plan, nil
+}
+
+// bind returns the arguments for the target. Parameters that have no
+// value are passed nil.
+func (p *bindingPlan) bind(vals []*ParamValue) []any {
+	valMap := make(map[string]any, len(vals))
+	for _, v := range vals {
+		if v.IsNull {
+			valMap[v.Param] = nil
+		} else if v.IsArray {
+			valMap[v.Param] = v.ValueArray
+		} else {
+			valMap[v.Param] = v.Value
+		}
+	}
+
+	args := make([]any, len(p.params))
+	for i, param := range p.params {
+		args[i] = valMap[param]
+	}
+
+	return args
+}
+
+type planKey struct {
+	dbid   string
+	target string
+}
+
+// planCache caches binding plans by target. Since a cached plan is only
+// used if it was built from the schema that the engine currently returns,
+// the cache never changes the result of binding, only how long it takes.
+type planCache struct {
+	mu    sync.Mutex
+	plans map[planKey]*bindingPlan
+}
+
+// plans is the cache used by the resolutions.
+var plans = &planCache{plans: make(map[planKey]*bindingPlan)}
+
+// get returns the binding plan of a target in a schema.
+func (c *planCache) get(schema *types.Schema, dbid, target string) (*bindingPlan, error) {
+	// procedure and action names are case-insensitive
+	key := planKey{dbid: dbid, target: strings.ToLower(target)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if plan, ok := c.plans[key]; ok && plan.schema == schema {
+		return plan, nil
+	}
+
+	plan, err := newBindingPlan(schema, target)
+	if err != nil {
+		delete(c.plans, key)
+		return nil, err
+	}
+
+	if len(c.plans) >= maxCachedPlans {
+		clear(c.plans)
+	}
+	c.plans[key] = plan
+
+	return plan, nil
+}
@@ -0,0 +1,42 @@
+package resolution
+
+import (
+	"testing"
+
+	"github.com/kwilteam/kwil-db/core/types"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_PlanCache(t *testing.T) {
+	schema := func(params ...string) *types.Schema {
+		proc := &types.Procedure{Name: "write"}
+		for _, p := range params {
+			proc.Parameters = append(proc.Parameters, &types.ProcedureParameter{Name: p})
+		}
+		return &types.Schema{Procedures: []*types.Procedure{proc}}
+	}
+	vals := []*ParamValue{{Param: "a", Value: "1"}, {Param: "b", Value: "2"}}
+
+	c := &planCache{plans: make(map[planKey]*bindingPlan)}
+
+	// the plan is cached per target, case-insensitively
+	v1 := schema("$a", "$b")
+	plan, err := c.get(v1, "db", "write")
+	require.NoError(t, err)
+	require.Equal(t, []any{"1", "2"}, plan.bind(vals))
+
+	cached, err := c.get(v1, "db", "WRITE")
+	require.NoError(t, err)
+	require.Same(t, plan, cached)
+
+	// a redeployed schema invalidates the plan
+	v2 := schema("$b", "$c")
+	plan, err = c.get(v2, "db", "write")
+	require.NoError(t, err)
+	require.Equal(t, []any{"2", nil}, plan.bind(vals))
+
+	// a missing target removes the plan
+	_, err = c.get(&types.Schema{}, "db", "write")
+	require.Error(t, err)
+	require.Empty(t, c.plans)
+}
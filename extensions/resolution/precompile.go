@@ -0,0 +1,72 @@
+package resolution
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/extensions/precompiles"
+)
+
+// StreamrPrecompileName is the name of the precompile that schemas use
+// to manage their Streamr events, e.g. "use streamr as streamr;".
+const StreamrPrecompileName = "streamr"
+
+// InitializePrecompile initializes the Streamr precompile for a schema.
+func InitializePrecompile(_ *precompiles.DeploymentContext, _ *common.Service, _ map[string]string) (precompiles.Instance, error) {
+	return &streamrPrecompile{}, nil
+}
+
+// streamrPrecompile allows the owner of a schema to manage the Streamr
+// events that target it.
+type streamrPrecompile struct{}
+
+// Call executes a method of the precompile. All methods can only be
+// called by the schema owner. Supported methods are:
+//   - allow(stream, procedure): allows events from a stream to be applied
+//     to a procedure or table of the schema. The stream "*" allows any
+//     stream.
+//   - revoke(stream, procedure): removes a target that was allowed.
+//   - redrive(id, procedure): calls a procedure with the event of a failure
+//     in the failure ledger, and removes the failure if it succeeds. If
+//     procedure is empty, the procedure that failed is used.
+//   - reset_replay(stream, procedure): removes the replay horizons of a
+//     stream and procedure or table, so that the next event applied to
+//     them sets a new horizon.
+func (s *streamrPrecompile) Call(scoper *precompiles.ProcedureContext, app *common.App, method string, inputs []any) ([]any, error) {
+	schema, err := app.Engine.GetSchema(scoper.DBID)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(schema.Owner, scoper.Signer) {
+		return nil, errors.New("only the schema owner can manage Streamr events")
+	}
+
+	if len(inputs) != 2 {
+		return nil, fmt.Errorf("%s expects 2 arguments, got %d", method, len(inputs))
+	}
+	arg1, ok1 := inputs[0].(string)
+	arg2, ok2 := inputs[1].(string)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%s expects text arguments", method)
+	}
+	// the state is not marked ready here, since the call may still be
+	// rolled back with the transaction that made it.
+	if err := ensureState(scoper.Ctx, app.DB); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case "allow":
+		return nil, allowTarget(scoper.Ctx, app.DB, arg1, scoper.DBID, arg2)
+	case "revoke":
+		return nil, revokeTarget(scoper.Ctx, app.DB, arg1, scoper.DBID, arg2)
+	case "redrive":
+		return nil, redrive(scoper.Ctx, app, scoper.DBID, arg1, arg2)
+	case "reset_replay":
+		return nil, resetReplay(scoper.Ctx, app.DB, arg1, scoper.DBID, arg2)
+	default:
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+}
@@ -6,102 +6,287 @@ package resolution
 import (
 	"context"
 	"crypto"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math/big"
 	"strings"
+	"time"
 
 	"github.com/kwilteam/kwil-db/common"
 	"github.com/kwilteam/kwil-db/core/types"
-	"github.com/kwilteam/kwil-db/core/types/serialize"
 	"github.com/kwilteam/kwil-db/extensions/resolutions"
 )
 
-const StreamrResolutionName = "streamr_res"
+const (
+	StreamrResolutionName = "streamr_res"
+	// StreamrBatchResolutionName is the resolution type for bodies that carry
+	// many Streamr messages at once. See StreamrBatch.
+	StreamrBatchResolutionName = "streamr_batch_res"
+)
 
-var ResolutionConfig = resolutions.ResolutionConfig{
-	RefundThreshold:       big.NewRat(1, 3),
-	ConfirmationThreshold: big.NewRat(2, 3),
-	ExpirationPeriod:      14400,
-	ResolveFunc: func(ctx context.Context, app *common.App, resolution *resolutions.Resolution) error {
-		ev := &StreamrEvent{}
-		if err := ev.UnmarshalBinary(resolution.Body); err != nil {
-			return err
-		}
+var ResolutionConfig = NewResolutionConfig(big.NewRat(1, 3), big.NewRat(2, 3), 14400)
+
+// BatchResolutionConfig is the resolution config for batches of events.
+// It uses the same thresholds as ResolutionConfig, but applies every event
+// in the batch within a single resolution.
+var BatchResolutionConfig = NewBatchResolutionConfig(big.NewRat(1, 3), big.NewRat(2, 3), 14400)
+
+// ResolutionNameSuffix ends the name of every resolution type for single
+// events. The batch type of <base>_res is named <base>_batch_res, which is
+// the naming of streamr_res and streamr_batch_res.
+const ResolutionNameSuffix = "_res"
+
+// BatchResolutionName returns the name of the batch resolution type that
+// belongs to a resolution type.
+func BatchResolutionName(name string) string {
+	return strings.TrimSuffix(name, ResolutionNameSuffix) + "_batch" + ResolutionNameSuffix
+}
+
+// NewResolutionConfig creates the config of a resolution type for single
+// events, with the given thresholds and expiration period in blocks.
+func NewResolutionConfig(refundThreshold, confirmationThreshold *big.Rat, expirationPeriod int64) resolutions.ResolutionConfig {
+	return resolutions.ResolutionConfig{
+		RefundThreshold:       refundThreshold,
+		ConfirmationThreshold: confirmationThreshold,
+		ExpirationPeriod:      expirationPeriod,
+		ResolveFunc: func(ctx context.Context, app *common.App, resolution *resolutions.Resolution) error {
+			ev := &StreamrEvent{}
+			if err := ev.UnmarshalBinary(resolution.Body); err != nil {
+				return err
+			}
+
+			return resolve(ctx, app, func() error {
+				return applyEvent(ctx, app, ev)
+			})
+		},
+	}
+}
+
+// NewBatchResolutionConfig creates the config of a resolution type for
+// batches of events, with the given thresholds and expiration period in
+// blocks.
+func NewBatchResolutionConfig(refundThreshold, confirmationThreshold *big.Rat, expirationPeriod int64) resolutions.ResolutionConfig {
+	return resolutions.ResolutionConfig{
+		RefundThreshold:       refundThreshold,
+		ConfirmationThreshold: confirmationThreshold,
+		ExpirationPeriod:      expirationPeriod,
+		ResolveFunc: func(ctx context.Context, app *common.App, resolution *resolutions.Resolution) error {
+			batch := &StreamrBatch{}
+			if err := batch.UnmarshalBinary(resolution.Body); err != nil {
+				return err
+			}
+
+			return resolve(ctx, app, func() error {
+				return applyBatch(ctx, app, batch)
+			})
+		},
+	}
+}
+
+// resolve ensures the state of the resolution, and then applies a
+// resolution's body. The state is created outside of the savepoints of
+// the body's events, so that it is not rolled back with a failed event.
+func resolve(ctx context.Context, app *common.App, apply func() error) error {
+	if err := ensureState(ctx, app.DB); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+
+	// the resolution is committed once it returns without an error, so
+	// the state exists from now on.
+	stateReady.Store(true)
+	return nil
+}
 
-		// we need to get the schema to match the parameter names
-		schema, err := app.Engine.GetSchema(ev.TargetDBID)
+// applyBatch applies the events of a batch.
+func applyBatch(ctx context.Context, app *common.App, batch *StreamrBatch) error {
+	for i, ev := range batch.Events {
+		// each event gets its own savepoint, so that a failing row
+		// behaves the same as it would in its own resolution: it is
+		// rolled back, and the rest of the batch is still applied.
+		tx, err := app.DB.BeginTx(ctx)
 		if err != nil {
 			return err
 		}
 
-		args, err := matchParams(schema, ev.Values, ev.TargetProcedure)
+		err = applyEvent(ctx, &common.App{
+			Service: app.Service,
+			DB:      tx,
+			Engine:  app.Engine,
+		}, ev)
 		if err != nil {
+			app.Service.Logger.Warn("failed to apply event in Streamr batch", "index", i, "txid", ev.TxID(), "error", err)
+			if err2 := tx.Rollback(ctx); err2 != nil {
+				return err2
+			}
+			continue
+		}
+
+		if err = tx.Commit(ctx); err != nil {
 			return err
 		}
+	}
 
-		_, err = app.Engine.Procedure(ctx, app.DB, &common.ExecutionData{
-			TransactionData: common.TransactionData{
-				// this will be used by the deployed contract to verify that only streamr
-				// can call this procedure
-				Caller: "streamr",
-				Signer: []byte("streamr"),
-				TxID:   ev.TxID(),
-				Height: -1, // Kwil does not currently support accessing height in extensions
-			},
-			Dataset:   ev.TargetDBID,
-			Procedure: ev.TargetProcedure,
-			Args:      args,
-		})
-		return err
-	},
+	return nil
 }
 
-// matchParams matches the parameters of the event with the target procedure/action.
-func matchParams(schema *types.Schema, vals []*ParamValue, target string) ([]any, error) {
-	valMap := make(map[string]any)
-	for _, v := range vals {
-		if v.IsArray {
-			valMap[v.Param] = v.ValueArray
-		} else {
-			valMap[v.Param] = v.Value
+// applyEvent executes the target procedure of the event, or inserts it
+// into its target table.
+func applyEvent(ctx context.Context, app *common.App, ev *StreamrEvent) error {
+	if ev.IDVersion > LatestIDVersion {
+		return fmt.Errorf("unsupported event ID version %d", ev.IDVersion)
+	}
+
+	if ev.Shadow {
+		// shadow events leave no trace other than their statistics, so
+		// they are not recorded as applied.
+		return applyShadow(ctx, app, ev)
+	}
+
+	err := recordApplied(ctx, app.DB, ev)
+	if errors.Is(err, errAlreadyApplied) {
+		app.Service.Logger.Info("skipping replayed Streamr event", "txid", ev.TxID())
+		observeSkipped(ev.TargetDBID, ev.Target(), skipReplayed)
+		return nil
+	}
+	if errors.Is(err, errBeyondRetention) {
+		// the event may never have been applied, so it is not dropped
+		// silently: it is kept in the failure ledger if it is used, where
+		// it can be re-driven.
+		app.Service.Logger.Warn("skipping Streamr event beyond its replay retention", "txid", ev.TxID(),
+			"stream_time", ev.Timestamp, "retention", ev.ReplayRetention)
+		observeSkipped(ev.TargetDBID, ev.Target(), skipRetention)
+		if !ev.RecordFailures {
+			return nil
 		}
+		return recordFailure(ctx, app.DB, ev, ev.Target(), err)
 	}
-	args := make([]any, 0)
-
-	proc, ok := schema.FindProcedure(target)
-	if ok {
-		// if found, match the parameters
-		for _, p := range proc.Parameters {
-			if v, ok := valMap[strings.TrimPrefix(p.Name, "$")]; ok {
-				// if the parameter is found, add it to the list
-				args = append(args, v)
-			} else {
-				// if not found, simply append nil
-				args = append(args, nil)
+	if err != nil {
+		return err
+	}
+
+	if ev.TrackCursor {
+		if err := advanceCursor(ctx, app.DB, ev); err != nil {
+			return err
+		}
+	}
+
+	target := ev.Target()
+	if ev.Ordering != OrderingNone {
+		stale, err := advanceChain(ctx, app.DB, ev)
+		if err != nil {
+			return err
+		}
+
+		if stale {
+			switch ev.Ordering {
+			case OrderingReject:
+				app.Service.Logger.Info("skipping out of order Streamr event", "txid", ev.TxID())
+				observeSkipped(ev.TargetDBID, ev.Target(), skipOutOfOrder)
+				return nil
+			case OrderingLate:
+				target = ev.LateProcedure
+			default:
+				return fmt.Errorf("unknown ordering mode %d", ev.Ordering)
 			}
 		}
-		return args, nil
 	}
 
-	// if not found, search for an action
-	act, ok := schema.FindAction(target)
-	if !ok {
-		return nil, fmt.Errorf("could not find target procedure or action %s", target)
+	if err := checkAllowed(ctx, app.DB, ev, target); err != nil {
+		return err
+	}
+
+	if !ev.RecordFailures {
+		return execute(ctx, app, ev, target)
 	}
 
-	for _, p := range act.Parameters {
-		if v, ok := valMap[strings.TrimPrefix(p, "$")]; ok {
-			// if the parameter is found, add it to the list
-			args = append(args, v)
-		} else {
-			// if not found, simply append nil
-			args = append(args, nil)
-		}
+	// the target is executed in a savepoint, so that its failure can be
+	// recorded without keeping any of its changes.
+	tx, err := app.DB.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = execute(ctx, &common.App{
+		Service: app.Service,
+		DB:      tx,
+		Engine:  app.Engine,
+	}, ev, target)
+	if err == nil {
+		return tx.Commit(ctx)
+	}
+	if err2 := tx.Rollback(ctx); err2 != nil {
+		return err2
+	}
+
+	app.Service.Logger.Warn("recording failed Streamr event", "txid", ev.TxID(), "procedure", target, "error", err)
+	return recordFailure(ctx, app.DB, ev, target, err)
+}
+
+// execute applies the event to target, which is either its target table,
+// its steps, or a procedure.
+func execute(ctx context.Context, app *common.App, ev *StreamrEvent, target string) error {
+	start := time.Now()
+	err := executeTarget(ctx, app, ev, target)
+	observeExecution(ev.TargetDBID, target, time.Since(start), err)
+	return err
+}
+
+func executeTarget(ctx context.Context, app *common.App, ev *StreamrEvent, target string) error {
+	if ev.TargetTable != "" && strings.EqualFold(target, ev.TargetTable) {
+		return insertRow(ctx, app, ev)
+	}
+	if len(ev.Steps) > 0 && strings.EqualFold(target, ev.Target()) {
+		return callSteps(ctx, app, ev)
+	}
+
+	return callProcedure(ctx, app, ev, target)
+}
+
+// callProcedure executes a procedure of the event's target database with
+// the event's values.
+func callProcedure(ctx context.Context, app *common.App, ev *StreamrEvent, target string) error {
+	// we need to get the schema to match the parameter names
+	schema, err := app.Engine.GetSchema(ev.TargetDBID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errTargetNotFound, err)
+	}
+
+	plan, err := plans.get(schema, ev.TargetDBID, target)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errTargetNotFound, err)
+	}
+	args := plan.bind(ev.Values)
+
+	_, err = app.Engine.Procedure(ctx, app.DB, &common.ExecutionData{
+		TransactionData: common.TransactionData{
+			// this will be used by the deployed contract to verify that only streamr
+			// can call this procedure
+			Caller: "streamr",
+			Signer: []byte("streamr"),
+			TxID:   ev.TxID(),
+			Height: -1, // Kwil does not currently support accessing height in extensions
+		},
+		Dataset:   ev.TargetDBID,
+		Procedure: target,
+		Args:      args,
+	})
+	return err
+}
+
+// matchParams matches the parameters of the event with the target procedure/action.
+func matchParams(schema *types.Schema, vals []*ParamValue, target string) ([]any, error) {
+	plan, err := newBindingPlan(schema, target)
+	if err != nil {
+		return nil, err
 	}
 
-	return args, nil
+	return plan.bind(vals), nil
 }
 
 // StreamrEvent is the struct that passes messages to the resolution extension.
@@ -111,6 +296,7 @@ type StreamrEvent struct {
 	// TargetDBID is the database ID of the target schema.
 	TargetDBID string
 	// TargetProcedure is the name of the procedure/action to be executed.
+	// It is empty if the event has a TargetTable.
 	TargetProcedure string
 	// Timestamp is the timestamp of the event.
 	// It is uint64 to be RLP encodable.
@@ -120,8 +306,90 @@ type StreamrEvent struct {
 	SequenceID uint64
 	// MsgChainID is the chain ID of the message.
 	MsgChainID string
+	// AggregateKey is set for events that carry the aggregates of a
+	// stream-time window, rather than a single message. It identifies the
+	// key that the window was aggregated for, and Timestamp is the start
+	// of the window.
+	AggregateKey string
+	// ElementIndex is the position of the event's element in its message,
+	// if the message was an array that was exploded into many events.
+	ElementIndex uint64
+	// IsElement is a flag to indicate that the event is an element of an
+	// exploded message. It is needed since ElementIndex can be 0.
+	IsElement bool
+	// StreamID is the ID of the Streamr stream the event was read from.
+	StreamID string
+	// Partition is the partition of the stream the event was read from.
+	Partition uint64
+	// PublisherID is the ID of the publisher of the message.
+	PublisherID string
+	// IDVersion is the version of the scheme used to derive the event's
+	// transaction ID. See TxID.
+	IDVersion uint8
+	// ReplayRetention is how long, in stream-time milliseconds, the ID of
+	// the event is remembered after it is applied. An event whose ID is
+	// remembered is skipped. If it is 0, the event is always applied.
+	ReplayRetention uint64
+	// Ordering is how the event is handled if a later event of the same
+	// message chain has already been applied to the target procedure.
+	Ordering OrderingMode
+	// LateProcedure is the procedure that the event is sent to instead of
+	// TargetProcedure, if it is out of order and Ordering is OrderingLate.
+	LateProcedure string
+	// RecordFailures is a flag to record the event in the failure ledger
+	// if its procedure fails, instead of only logging the error.
+	RecordFailures bool
+	// Shadow is a flag to resolve the event in shadow mode. Its target
+	// procedure is not executed, and only the outcome of binding its
+	// values to the procedure is recorded.
+	Shadow bool
+	// ShadowProcedure is a procedure that is executed instead of
+	// TargetProcedure in shadow mode. It is optional.
+	ShadowProcedure string
+	// TargetTable is the name of a table that the event's values are
+	// inserted into, instead of executing a procedure. The values are
+	// keyed by column name.
+	TargetTable string
+	// OnConflict is what happens if a row with the same primary key
+	// already exists in TargetTable.
+	OnConflict ConflictPolicy
+	// KeyColumn is a column of TargetTable that is set to a UUID derived
+	// from the event's transaction ID. It is optional.
+	KeyColumn string
+	// Steps are procedures that are executed in order, instead of
+	// TargetProcedure. Either all of them are applied, or none are.
+	Steps []*Step
+	// TrackCursor is a flag to record the event's position in the cursor
+	// of its stream and target, so that listeners can resume from it.
+	TrackCursor bool
+}
+
+// Target returns the name of the event's target table or procedure, or
+// of its steps.
+func (s *StreamrEvent) Target() string {
+	if s.TargetTable != "" {
+		return s.TargetTable
+	}
+	if len(s.Steps) > 0 {
+		return stepsTarget(s.Steps)
+	}
+	return s.TargetProcedure
 }
 
+// OrderingMode is how an event is handled if it arrives out of order.
+type OrderingMode uint8
+
+const (
+	// OrderingNone applies events in the order they are resolved.
+	OrderingNone OrderingMode = 0
+	// OrderingReject skips events that are older than the latest
+	// event applied from the same message chain.
+	OrderingReject OrderingMode = 1
+	// OrderingLate sends events that are older than the latest event
+	// applied from the same message chain to a separate procedure.
+	OrderingLate OrderingMode = 2
+)
+
 // ParamValue is a key-value pair that can be used to store data in the resolution extension.
 // It is destructured from a map to make it RLP encodable.
 type ParamValue struct {
@@ -135,21 +403,104 @@ type ParamValue struct {
 	// IsArray is a flag to indicate if the value is an array.
 	// It is used to support empty strings arrays.
 	IsArray bool
+	// IsNull is a flag to indicate that the value is null. It is set for
+	// optional mappings whose field was missing from the message.
+	IsNull bool
+	// Defaulted is a flag to indicate that Value is the default of its
+	// mapping, since the field was missing from the message.
+	Defaulted bool
 }
 
-func (s *StreamrEvent) MarshalBinary() ([]byte, error) {
-	return serialize.Encode(s)
+// StreamrBatch is a group of events that are voted on and applied as a
+// single resolution. The listener decides the batch boundaries from the
+// stream timestamps of the events, so that all validators that saw the
+// same messages produce identical batches.
+type StreamrBatch struct {
+	// Events are the events in the batch, in the order they are applied.
+	Events []*StreamrEvent
 }
 
-func (s *StreamrEvent) UnmarshalBinary(data []byte) error {
-	return serialize.Decode(data, s)
-}
+const (
+	// IDVersionLegacy is the original transaction ID derivation. It is kept
+	// so that events that were committed with it, or are still pending
+	// with it, keep the same ID. It should not be used for new events,
+	// since it is not a 32 byte hash, and it does not include the stream,
+	// partition or publisher, so IDs can collide across streams and
+	// publishers.
+	IDVersionLegacy uint8 = 0
+	// IDVersion1 derives the ID from a SHA256 hash of the stream ID,
+	// partition, publisher ID, message chain ID, timestamp, and sequence
+	// number of the message.
+	IDVersion1 uint8 = 1
+
+	// LatestIDVersion is the latest supported ID version.
+	LatestIDVersion = IDVersion1
+)
 
-// TxID creates a hex encoded 32 byte transaction ID for the event.
-// It does this by relying on the timestamp, sequence ID, and message chain ID.
+// idDomainV1 separates version 1 IDs from any other hash of the same data.
+const idDomainV1 = "kwil-streamr/event-id/v1"
+
+// TxID returns the hex encoded transaction ID for the event, which is
+// unique to the Streamr message the event was created from. It is passed
+// to the target procedure as @txid. The scheme used to derive the ID is
+// determined by IDVersion.
 func (s *StreamrEvent) TxID() string {
+	switch s.IDVersion {
+	case IDVersionLegacy:
+		return s.legacyTxID()
+	default:
+		return s.txIDV1()
+	}
+}
+
+// txIDV1 derives a version 1 transaction ID. Each field is length
+// prefixed, so that no two different events can produce the same input.
+func (s *StreamrEvent) txIDV1() string {
+	b := []byte(idDomainV1)
+	appendString := func(str string) {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(str)))
+		b = append(b, str...)
+	}
+
+	appendString(s.StreamID)
+	b = binary.BigEndian.AppendUint64(b, s.Partition)
+	// publisher IDs are Ethereum addresses, which are case-insensitive
+	appendString(strings.ToLower(s.PublisherID))
+	appendString(s.MsgChainID)
+	b = binary.BigEndian.AppendUint64(b, s.Timestamp)
+	b = binary.BigEndian.AppendUint64(b, s.SequenceID)
+	appendString(s.AggregateKey)
+	if s.IsElement {
+		b = append(b, 1)
+		b = binary.BigEndian.AppendUint64(b, s.ElementIndex)
+	} else {
+		b = append(b, 0)
+	}
+
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
+
+// legacyTxID derives an ID using the legacy scheme. It must not be
+// changed, as events that have already been committed rely on it.
+//
+// It was intended to be a SHA256 hash of the timestamp, sequence ID, and
+// message chain ID, but it actually appends the hash of an empty input to
+// those values.
+func (s *StreamrEvent) legacyTxID() string {
 	var b [16]byte
 	binary.LittleEndian.PutUint64(b[:8], s.Timestamp)
 	binary.LittleEndian.PutUint64(b[8:], s.SequenceID)
-	return hex.EncodeToString(crypto.SHA256.New().Sum(append(b[:], []byte(s.MsgChainID)...)))
+	id := append(b[:], []byte(s.MsgChainID)...)
+	if s.AggregateKey != "" {
+		// aggregates of different keys share a window start, so the key
+		// is needed to tell them apart.
+		id = append(id, []byte(s.AggregateKey)...)
+	}
+	if s.IsElement {
+		// all elements of an exploded message share the message's
+		// position, so the element's index is needed to tell them apart.
+		id = binary.LittleEndian.AppendUint64(id, s.ElementIndex)
+	}
+	return hex.EncodeToString(crypto.SHA256.New().Sum(id))
 }
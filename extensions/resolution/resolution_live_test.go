@@ -0,0 +1,56 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/extensions/resolutions"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BatchResolution(t *testing.T) {
+	ctx := context.Background()
+	app, engine := newLiveApp(t)
+	engine.failing["write_late"] = raise("temperature out of range")
+	allowLive(t, app, anyStream, "write", "write_late", "bump")
+
+	ev := func(ts uint64) *StreamrEvent {
+		e := liveEvent(ts, 0)
+		e.ReplayRetention = 1000
+		return e
+	}
+	failing := ev(200)
+	failing.Steps = []*Step{
+		{Procedure: "bump", Values: []*ParamValue{{Param: "temp", Value: "1"}}},
+		{Procedure: "write_late", Values: []*ParamValue{{Param: "temp", Value: "2"}}},
+	}
+
+	body, err := (&StreamrBatch{Events: []*StreamrEvent{ev(100), failing, ev(300)}}).MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, resolveLive(t, app, func(app *common.App) error {
+		return BatchResolutionConfig.ResolveFunc(ctx, app, &resolutions.Resolution{
+			Body: body,
+			Type: StreamrBatchResolutionName,
+		})
+	}))
+
+	// the failed event is rolled back, including its replay record, and
+	// the rest of the batch is applied
+	require.Equal(t, []string{"write[100]", "write[300]"}, calls(t, app))
+	require.Equal(t, [][]any{{ev(100).TxID()}, {ev(300).TxID()}},
+		query(t, app, `SELECT id FROM kwild_streamr.applied_events ORDER BY stream_time;`))
+
+	// a single event fails its resolution, which leaves nothing behind
+	body, err = failing.MarshalBinary()
+	require.NoError(t, err)
+	require.Error(t, resolveLive(t, app, func(app *common.App) error {
+		return ResolutionConfig.ResolveFunc(ctx, app, &resolutions.Resolution{
+			Body: body,
+			Type: StreamrResolutionName,
+		})
+	}))
+	require.Len(t, calls(t, app), 2)
+}
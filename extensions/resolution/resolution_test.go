@@ -1,8 +1,11 @@
 package resolution
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/kwilteam/kwil-db/core/types"
 	"github.com/stretchr/testify/require"
 )
@@ -114,3 +117,107 @@ func Test_ParamMatching(t *testing.T) {
 		})
 	}
 }
+
+func Test_TxID(t *testing.T) {
+	ev := func(stream, publisher string, version uint8) *StreamrEvent {
+		return &StreamrEvent{
+			Timestamp:   1718146494844,
+			SequenceID:  3,
+			MsgChainID:  "chain1",
+			StreamID:    stream,
+			PublisherID: publisher,
+			IDVersion:   version,
+		}
+	}
+
+	// the legacy ID must never change, since committed events rely on it
+	legacy := ev("", "", IDVersionLegacy).TxID()
+	require.Equal(t, "7cf18209900100000300000000000000636861696e31e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", legacy)
+	require.Equal(t, legacy, ev("stream1", "0xabc", IDVersionLegacy).TxID())
+
+	v1 := ev("stream1", "0xabc", IDVersion1).TxID()
+	require.Len(t, v1, 64)
+	require.NotEqual(t, v1, ev("stream2", "0xabc", IDVersion1).TxID())
+	require.NotEqual(t, v1, ev("stream1", "0xdef", IDVersion1).TxID())
+	// publisher IDs are case-insensitive
+	require.Equal(t, v1, ev("stream1", "0xABC", IDVersion1).TxID())
+
+	// exploded elements have distinct IDs, including the first element
+	elem := ev("stream1", "0xabc", IDVersion1)
+	elem.IsElement = true
+	require.NotEqual(t, v1, elem.TxID())
+	elem2 := ev("stream1", "0xabc", IDVersion1)
+	elem2.IsElement, elem2.ElementIndex = true, 1
+	require.NotEqual(t, elem.TxID(), elem2.TxID())
+}
+
+func Test_ClassifyError(t *testing.T) {
+	type testcase struct {
+		name string
+		err  error
+		want failureClass
+	}
+
+	tests := []testcase{
+		{
+			name: "target not found",
+			err:  fmt.Errorf("%w: %w", errTargetNotFound, errors.New("dataset not found")),
+			want: failureTarget,
+		},
+		{
+			name: "unique violation",
+			err:  fmt.Errorf("failed to execute: %w", &pgconn.PgError{Code: "23505"}),
+			want: failureConstraint,
+		},
+		{
+			name: "invalid cast",
+			err:  &pgconn.PgError{Code: "22P02"},
+			want: failureData,
+		},
+		{
+			name: "other postgres error",
+			err:  &pgconn.PgError{Code: "42703"},
+			want: failureProcedure,
+		},
+		{
+			name: "procedure error",
+			err:  errors.New("caller is not streamr"),
+			want: failureProcedure,
+		},
+		{
+			name: "beyond retention",
+			err:  errBeyondRetention,
+			want: failureRetention,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, classifyError(tt.err))
+		})
+	}
+}
+
+func Test_FailureMessage(t *testing.T) {
+	// the text of Postgres errors is not recorded, since it can differ
+	// between nodes
+	err := fmt.Errorf("failed to execute on host-1: %w", &pgconn.PgError{Code: "23505", Message: "duplicate key"})
+	require.Equal(t, "SQLSTATE 23505", failureMessage(err))
+
+	// except for errors raised by the procedure, which are its own
+	err = fmt.Errorf("step 1 (write): %w", &pgconn.PgError{Code: "P0001", Message: "temperature out of range"})
+	require.Equal(t, "SQLSTATE P0001: temperature out of range", failureMessage(err))
+
+	err = fmt.Errorf("%w: %w", errTargetNotFound, errors.New("procedure write_temp not found"))
+	require.Equal(t, "target not found: procedure write_temp not found", failureMessage(err))
+}
+
+func Test_MatchesScope(t *testing.T) {
+	ev := &StreamrEvent{StreamID: "0xabc/weather", Partition: 3, TargetDBID: "xdb", TargetProcedure: "Write"}
+	scope := replayScope(ev)
+
+	require.True(t, matchesScope(scope, "0xabc/weather", "xdb", "write"))
+	require.False(t, matchesScope(scope, "0xabc", "xdb", "write"))
+	require.False(t, matchesScope(scope, "0xabc/weather", "ydb", "write"))
+	require.False(t, matchesScope(scope, "0xabc/weather", "xdb", "read"))
+}
@@ -0,0 +1,87 @@
+package resolution
+
+import (
+	"context"
+	"strings"
+
+	"github.com/kwilteam/kwil-db/common"
+)
+
+// applyShadow resolves an event in shadow mode. It binds the event to its
+// target without executing it, optionally executes the shadow procedure,
+// and records the outcome in the shadow statistics.
+func applyShadow(ctx context.Context, app *common.App, ev *StreamrEvent) error {
+	var bindingErrors, missingValues, shadowErrors int64
+
+	schema, err := app.Engine.GetSchema(ev.TargetDBID)
+	if err == nil && ev.TargetTable != "" {
+		_, _, err = sinkStatement(schema, ev)
+	} else if err == nil {
+		steps := ev.Steps
+		if len(steps) == 0 {
+			steps = []*Step{{Procedure: ev.TargetProcedure, Values: ev.Values}}
+		}
+
+		for _, step := range steps {
+			var plan *bindingPlan
+			plan, err = plans.get(schema, ev.TargetDBID, step.Procedure)
+			if err != nil {
+				break
+			}
+
+			// parameters bound to the results of earlier steps are not
+			// missing, even though the results are not known, and neither
+			// are optional values that are null.
+			present := make(map[string]bool, len(step.Results))
+			for _, r := range step.Results {
+				present[r.Param] = true
+			}
+			for _, v := range step.Values {
+				if v.IsNull {
+					present[v.Param] = true
+				}
+			}
+			for i, arg := range plan.bind(step.Values) {
+				if arg == nil && !present[plan.params[i]] {
+					missingValues = 1
+				}
+			}
+		}
+	}
+	if err != nil {
+		app.Service.Logger.Info("shadow Streamr event could not be bound", "txid", ev.TxID(), "error", err)
+		bindingErrors = 1
+	}
+
+	if bindingErrors == 0 && ev.ShadowProcedure != "" {
+		if err := checkAllowed(ctx, app.DB, ev, ev.ShadowProcedure); err != nil {
+			return err
+		}
+
+		// the shadow procedure is called in a savepoint, so that its
+		// failure does not discard the statistics.
+		tx, err := app.DB.BeginTx(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = callProcedure(ctx, &common.App{
+			Service: app.Service,
+			DB:      tx,
+			Engine:  app.Engine,
+		}, ev, ev.ShadowProcedure)
+		if err != nil {
+			app.Service.Logger.Info("shadow procedure failed", "txid", ev.TxID(), "procedure", ev.ShadowProcedure, "error", err)
+			shadowErrors = 1
+			if err2 := tx.Rollback(ctx); err2 != nil {
+				return err2
+			}
+		} else if err = tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	_, err = app.DB.Execute(ctx, upsertShadowStats, ev.StreamID, ev.TargetDBID, strings.ToLower(ev.Target()),
+		bindingErrors, missingValues, shadowErrors, int64(ev.Timestamp))
+	return err
+}
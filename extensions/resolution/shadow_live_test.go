@@ -0,0 +1,57 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ApplyShadow(t *testing.T) {
+	ctx := context.Background()
+	app, engine := newLiveApp(t)
+	allowLive(t, app, anyStream, "write", "write_shadow")
+	ev := func(ts uint64) *StreamrEvent {
+		e := liveEvent(ts, 0)
+		e.Shadow = true
+		e.ReplayRetention = 1000
+		return e
+	}
+
+	// shadow events are bound, but not executed
+	require.NoError(t, resolveEvent(t, app, ev(300)))
+
+	missing := ev(200)
+	missing.Values = nil
+	require.NoError(t, resolveEvent(t, app, missing))
+
+	unbound := ev(100)
+	unbound.TargetProcedure = "missing"
+	require.NoError(t, resolveEvent(t, app, unbound))
+
+	// the shadow procedure is called, and its failure is counted without
+	// keeping its changes
+	shadowed := ev(400)
+	shadowed.ShadowProcedure = "write_shadow"
+	require.NoError(t, resolveEvent(t, app, shadowed))
+
+	engine.failing["write_shadow"] = raise("caller is not streamr")
+	shadowed = ev(500)
+	shadowed.ShadowProcedure = "write_shadow"
+	require.NoError(t, resolveEvent(t, app, shadowed))
+
+	require.Equal(t, []string{"write_shadow[400]"}, calls(t, app))
+	require.Equal(t, [][]any{
+		{"0xabc/weather", liveDBID, "missing", int64(1), int64(1), int64(0), int64(0), int64(100), int64(100)},
+		{"0xabc/weather", liveDBID, "write", int64(4), int64(0), int64(1), int64(1), int64(200), int64(500)},
+	}, query(t, app, ListShadowStats, ""))
+
+	// shadow events are not recorded as applied, and are only refused if
+	// they call a shadow procedure that is not allowed
+	require.Empty(t, query(t, app, `SELECT id FROM kwild_streamr.applied_events;`))
+	require.NoError(t, revokeTarget(ctx, app.DB, anyStream, liveDBID, "write_shadow"))
+	require.NoError(t, resolveEvent(t, app, ev(600)))
+	require.ErrorIs(t, resolveEvent(t, app, shadowed), errTargetNotAllowed)
+}
@@ -0,0 +1,220 @@
+package resolution
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/core/types"
+	"github.com/kwilteam/kwil-db/core/types/decimal"
+)
+
+// ConflictPolicy is what a table sink does if a row with the same primary
+// key already exists.
+type ConflictPolicy uint8
+
+const (
+	// ConflictError fails the event.
+	ConflictError ConflictPolicy = 0
+	// ConflictIgnore keeps the existing row.
+	ConflictIgnore ConflictPolicy = 1
+	// ConflictUpdate overwrites the existing row with the event's values.
+	ConflictUpdate ConflictPolicy = 2
+)
+
+// insertRow inserts the event's values into its target table. Values are
+// converted to the types of their columns, and the key column, if any, is
+// set to a UUID derived from the event's transaction ID.
+func insertRow(ctx context.Context, app *common.App, ev *StreamrEvent) error {
+	schema, err := app.Engine.GetSchema(ev.TargetDBID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errTargetNotFound, err)
+	}
+
+	stmt, values, err := sinkStatement(schema, ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.Engine.Execute(ctx, app.DB, ev.TargetDBID, stmt, values)
+	return err
+}
+
+// sinkStatement builds the insert statement for an event and the values
+// for its parameters.
+func sinkStatement(schema *types.Schema, ev *StreamrEvent) (string, map[string]any, error) {
+	table, ok := schema.FindTable(ev.TargetTable)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: could not find target table %s", errTargetNotFound, ev.TargetTable)
+	}
+
+	raw := make(map[string]*ParamValue, len(ev.Values))
+	for _, v := range ev.Values {
+		raw[v.Param] = v
+	}
+
+	// columns are inserted in the order of the table, so that the
+	// statement does not depend on the order of the mappings.
+	var columns []string
+	values := make(map[string]any)
+	for _, col := range table.Columns {
+		name := strings.ToLower(col.Name)
+
+		if ev.KeyColumn != "" && strings.EqualFold(ev.KeyColumn, name) {
+			value, err := convertValue(col.Type, &ParamValue{Param: name, Value: types.NewUUIDV5([]byte(ev.TxID())).String()})
+			if err != nil {
+				return "", nil, fmt.Errorf("key column %s: %w", name, err)
+			}
+			columns = append(columns, name)
+			values["$"+name] = value
+			continue
+		}
+
+		v, ok := raw[name]
+		if !ok {
+			continue
+		}
+
+		value, err := convertValue(col.Type, v)
+		if err != nil {
+			return "", nil, fmt.Errorf("column %s: %w", name, err)
+		}
+		columns = append(columns, name)
+		values["$"+name] = value
+	}
+
+	for param := range raw {
+		if _, ok := table.FindColumn(param); !ok {
+			return "", nil, fmt.Errorf("%w: table %s has no column %s", errTargetNotFound, table.Name, param)
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("no values for table %s", table.Name)
+	}
+
+	params := make([]string, len(columns))
+	for i, col := range columns {
+		params[i] = "$" + col
+	}
+
+	stmt := strings.Builder{}
+	fmt.Fprintf(&stmt, "INSERT INTO %s (%s) VALUES (%s)", table.Name, strings.Join(columns, ", "), strings.Join(params, ", "))
+
+	switch ev.OnConflict {
+	case ConflictError:
+	case ConflictIgnore:
+		stmt.WriteString(" ON CONFLICT DO NOTHING")
+	case ConflictUpdate:
+		pk, err := table.GetPrimaryKey()
+		if err != nil {
+			return "", nil, err
+		}
+
+		var sets []string
+		for i, col := range columns {
+			if !slices.ContainsFunc(pk, func(k string) bool { return strings.EqualFold(k, col) }) {
+				sets = append(sets, col+" = "+params[i])
+			}
+		}
+
+		if len(sets) == 0 {
+			stmt.WriteString(" ON CONFLICT DO NOTHING")
+		} else {
+			fmt.Fprintf(&stmt, " ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(pk, ", "), strings.Join(sets, ", "))
+		}
+	default:
+		return "", nil, fmt.Errorf("unknown conflict policy %d", ev.OnConflict)
+	}
+	stmt.WriteString(";")
+
+	return stmt.String(), values, nil
+}
+
+// convertValue converts an event value to the Go type that the engine
+// uses for a column type.
+func convertValue(typ *types.DataType, v *ParamValue) (any, error) {
+	if v.IsNull {
+		return nil, nil
+	}
+	if !typ.IsArray {
+		if v.IsArray {
+			return nil, fmt.Errorf("cannot insert an array into a %s column", typ)
+		}
+		return convertScalar(typ, v.Value)
+	}
+
+	if !v.IsArray {
+		return nil, fmt.Errorf("cannot insert a scalar into a %s column", typ)
+	}
+
+	scalar := &types.DataType{Name: typ.Name, Metadata: typ.Metadata}
+	conv := make([]any, len(v.ValueArray))
+	for i, s := range v.ValueArray {
+		c, err := convertScalar(scalar, s)
+		if err != nil {
+			return nil, err
+		}
+		conv[i] = c
+	}
+
+	switch strings.ToLower(typ.Name) {
+	case "int":
+		return convertSlice[int64](conv), nil
+	case "text":
+		return convertSlice[string](conv), nil
+	case "bool":
+		return convertSlice[bool](conv), nil
+	case "blob":
+		return convertSlice[[]byte](conv), nil
+	case "uuid":
+		return types.UUIDArray(convertSlice[*types.UUID](conv)), nil
+	case "uint256":
+		return types.Uint256Array(convertSlice[*types.Uint256](conv)), nil
+	case types.DecimalStr:
+		return decimal.DecimalArray(convertSlice[*decimal.Decimal](conv)), nil
+	default:
+		return nil, fmt.Errorf("unsupported column type %s", typ)
+	}
+}
+
+func convertSlice[T any](vals []any) []T {
+	res := make([]T, len(vals))
+	for i, v := range vals {
+		res[i] = v.(T)
+	}
+	return res
+}
+
+// convertScalar converts a string to the Go type of a scalar column type.
+// Blobs are expected to be base64 encoded, like in Kwil's APIs.
+func convertScalar(typ *types.DataType, s string) (any, error) {
+	switch strings.ToLower(typ.Name) {
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "text":
+		return s, nil
+	case "bool":
+		return strconv.ParseBool(s)
+	case "blob":
+		return base64.StdEncoding.DecodeString(s)
+	case "uuid":
+		return types.ParseUUID(s)
+	case "uint256":
+		return types.Uint256FromString(s)
+	case types.DecimalStr:
+		d, err := decimal.NewFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := d.SetPrecisionAndScale(typ.Metadata[0], typ.Metadata[1]); err != nil {
+			return nil, err
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unsupported column type %s", typ)
+	}
+}
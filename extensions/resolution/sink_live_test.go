@@ -0,0 +1,230 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/kwilteam/kwil-db/cmd/kwild/config"
+	"github.com/kwilteam/kwil-db/cmd/kwild/server"
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/common/chain"
+	"github.com/kwilteam/kwil-db/core/client"
+	"github.com/kwilteam/kwil-db/core/crypto"
+	"github.com/kwilteam/kwil-db/core/crypto/auth"
+	"github.com/kwilteam/kwil-db/core/types"
+	clientType "github.com/kwilteam/kwil-db/core/types/client"
+	"github.com/kwilteam/kwil-db/core/types/transactions"
+	"github.com/kwilteam/kwil-db/extensions/precompiles"
+	"github.com/kwilteam/kwil-db/parse"
+	"github.com/stretchr/testify/require"
+)
+
+// sinkTestPrecompileName is a precompile whose put method inserts
+// sinkTestEvent with insertRow, so that table sinks can be tested with
+// the engine of a kwild node.
+const sinkTestPrecompileName = "streamr_sink_test"
+
+var sinkTestEvent atomic.Pointer[StreamrEvent]
+
+type sinkTestPrecompile struct{}
+
+func (sinkTestPrecompile) Call(scoper *precompiles.ProcedureContext, app *common.App, method string, _ []any) ([]any, error) {
+	if method != "put" {
+		return nil, fmt.Errorf("unknown method %s", method)
+	}
+	return nil, insertRow(scoper.Ctx, app, sinkTestEvent.Load())
+}
+
+func init() {
+	err := precompiles.RegisterPrecompile(sinkTestPrecompileName, func(*precompiles.DeploymentContext, *common.Service, map[string]string) (precompiles.Instance, error) {
+		return sinkTestPrecompile{}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+const sinkTestSchema = `database sink;
+
+use streamr_sink_test as sink;
+
+table readings {
+	id uuid primary key,
+	device text notnull,
+	temp decimal(6,2),
+	tags text[],
+	peers uuid[]
+}
+
+action put() public {
+	sink.put();
+}
+`
+
+// freeAddr returns a local address that is free to listen on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startLiveNode starts a kwild node in a new database of the test
+// Postgres, which is dropped when the test ends. It returns a client of
+// the node, and a connection to its database.
+func startLiveNode(t *testing.T) (*client.Client, *pgx.Conn) {
+	ctx := context.Background()
+
+	pgCfg, err := pgx.ParseConfig(liveDSN())
+	require.NoError(t, err)
+	admin, err := pgx.ConnectConfig(ctx, pgCfg)
+	require.NoError(t, err)
+	name := fmt.Sprintf("streamr_node_%d", time.Now().UnixNano())
+	_, err = admin.Exec(ctx, "CREATE DATABASE "+name)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		admin.Exec(ctx, "DROP DATABASE "+name+" WITH (FORCE)")
+		admin.Close(ctx)
+	})
+
+	root := t.TempDir()
+	flagCfg := config.EmptyConfig()
+	flagCfg.RootDir = root
+	flagCfg.AppCfg.DBHost = pgCfg.Host
+	flagCfg.AppCfg.DBPort = fmt.Sprint(pgCfg.Port)
+	flagCfg.AppCfg.DBUser = pgCfg.User
+	flagCfg.AppCfg.DBPass = pgCfg.Password
+	flagCfg.AppCfg.DBName = name
+	flagCfg.AppCfg.JSONRPCListenAddress = freeAddr(t)
+	flagCfg.AppCfg.HTTPListenAddress = freeAddr(t)
+	flagCfg.AppCfg.AdminListenAddress = filepath.Join(root, "admin.sock")
+	flagCfg.ChainCfg.RPC.ListenAddress = "tcp://" + freeAddr(t)
+	flagCfg.ChainCfg.P2P.ListenAddress = "tcp://" + freeAddr(t)
+	flagCfg.ChainCfg.Consensus.TimeoutCommit = config.Duration(100 * time.Millisecond)
+	flagCfg.Logging.Level = "warn"
+	flagCfg.Logging.OutputPaths = []string{"kwild.log"}
+
+	cfg, _, err := config.GetCfg(flagCfg)
+	require.NoError(t, err)
+	nodeKey, genesis, err := cfg.InitPrivateKeyAndGenesis(true)
+	require.NoError(t, err)
+	chain.SetForks(genesis.ForkHeights)
+
+	nodeCtx, cancel := context.WithCancel(ctx)
+	svr, err := server.New(nodeCtx, cfg, genesis, nodeKey, true)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		svr.Start(nodeCtx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	key, err := crypto.GenerateSecp256k1Key()
+	require.NoError(t, err)
+	opts := &clientType.Options{Signer: &auth.EthPersonalSigner{Key: *key}}
+	var cl *client.Client
+	require.Eventually(t, func() bool {
+		cl, err = client.NewClient(ctx, "http://"+cfg.AppCfg.JSONRPCListenAddress, opts)
+		return err == nil
+	}, 30*time.Second, 100*time.Millisecond)
+
+	pgCfg.Database = name
+	conn, err := pgx.ConnectConfig(ctx, pgCfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close(ctx) })
+
+	return cl, conn
+}
+
+// waitTx waits for a transaction to be committed, and returns its result.
+func waitTx(t *testing.T, cl *client.Client, hash []byte) transactions.TransactionResult {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := cl.WaitTx(ctx, hash, 100*time.Millisecond)
+	require.NoError(t, err)
+	return res.TxResult
+}
+
+func Test_InsertRowEngine(t *testing.T) {
+	ctx := context.Background()
+	cl, conn := startLiveNode(t)
+
+	schema, err := parse.Parse([]byte(sinkTestSchema))
+	require.NoError(t, err)
+	schema.Owner = cl.Signer.Identity()
+	dbid := schema.DBID()
+
+	hash, err := cl.DeployDatabase(ctx, schema)
+	require.NoError(t, err)
+	res := waitTx(t, cl, hash)
+	require.Zero(t, res.Code, res.Log)
+
+	// put applies the event to the table in a transaction, and returns
+	// its result.
+	put := func(ev *StreamrEvent) transactions.TransactionResult {
+		sinkTestEvent.Store(ev)
+		hash, err := cl.Execute(ctx, dbid, "put", nil)
+		require.NoError(t, err)
+		return waitTx(t, cl, hash)
+	}
+	// rows returns the rows of the table, as Postgres prints them.
+	rows := func() [][]any {
+		rows, err := conn.Query(ctx, fmt.Sprintf(`SELECT id::TEXT, device, temp::TEXT, tags::TEXT, peers::TEXT FROM ds_%s.readings ORDER BY id;`, dbid))
+		require.NoError(t, err)
+		res, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) ([]any, error) {
+			return row.Values()
+		})
+		require.NoError(t, err)
+		return res
+	}
+
+	peer1, peer2 := "3fd3bbb4-d05f-4b5c-8f8b-3d0e06f6fd4b", "f4b7e9d2-19b3-4c5e-9b3a-6c6bb5a1b8e0"
+	ev := liveEvent(100, 0)
+	ev.TargetDBID = dbid
+	ev.TargetProcedure = ""
+	ev.TargetTable = "readings"
+	ev.KeyColumn = "id"
+	ev.Values = []*ParamValue{
+		{Param: "device", Value: "sensor-1"},
+		{Param: "temp", Value: "21.5"},
+		{Param: "tags", IsArray: true, ValueArray: []string{"a", "b"}},
+		{Param: "peers", IsArray: true, ValueArray: []string{peer1, peer2}},
+	}
+	id := types.NewUUIDV5([]byte(ev.TxID())).String()
+
+	res = put(ev)
+	require.Zero(t, res.Code, res.Log)
+	require.Equal(t, [][]any{
+		{id, "sensor-1", "21.50", "{a,b}", "{" + peer1 + "," + peer2 + "}"},
+	}, rows())
+
+	// the same event fails on the existing row.
+	res = put(ev)
+	require.NotZero(t, res.Code)
+
+	// columns without a value are left out of the update.
+	update := *ev
+	update.OnConflict = ConflictUpdate
+	update.Values = []*ParamValue{
+		{Param: "device", Value: "sensor-1"},
+		{Param: "temp", Value: "22.25"},
+		{Param: "peers", IsNull: true},
+	}
+	res = put(&update)
+	require.Zero(t, res.Code, res.Log)
+	require.Equal(t, [][]any{
+		{id, "sensor-1", "22.25", "{a,b}", nil},
+	}, rows())
+}
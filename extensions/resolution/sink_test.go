@@ -0,0 +1,196 @@
+package resolution
+
+import (
+	"testing"
+
+	"github.com/kwilteam/kwil-db/core/types"
+	"github.com/kwilteam/kwil-db/core/types/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SinkStatement(t *testing.T) {
+	schema := &types.Schema{
+		Tables: []*types.Table{
+			{
+				Name: "records",
+				Columns: []*types.Column{
+					{Name: "id", Type: types.UUIDType, Attributes: []*types.Attribute{{Type: types.PRIMARY_KEY}}},
+					{Name: "temp", Type: &types.DataType{Name: "decimal", Metadata: [2]uint16{10, 5}}},
+					{Name: "count", Type: types.IntType},
+					{Name: "tags", Type: types.ArrayType(types.TextType)},
+				},
+			},
+		},
+	}
+
+	event := func(conflict ConflictPolicy, key string, vals ...*ParamValue) *StreamrEvent {
+		return &StreamrEvent{
+			Values:      vals,
+			TargetDBID:  "db",
+			TargetTable: "Records",
+			OnConflict:  conflict,
+			KeyColumn:   key,
+			Timestamp:   1,
+			StreamID:    "stream",
+			IDVersion:   IDVersion1,
+		}
+	}
+	temp := &ParamValue{Param: "temp", Value: "30.5"}
+	count := &ParamValue{Param: "count", Value: "2"}
+
+	type testcase struct {
+		name    string
+		event   *StreamrEvent
+		stmt    string
+		columns []string
+		wantErr bool
+	}
+
+	tests := []testcase{
+		{
+			name:    "insert in table order",
+			event:   event(ConflictError, "", count, temp),
+			stmt:    "INSERT INTO records (temp, count) VALUES ($temp, $count);",
+			columns: []string{"$temp", "$count"},
+		},
+		{
+			name:    "generated key",
+			event:   event(ConflictIgnore, "id", temp),
+			stmt:    "INSERT INTO records (id, temp) VALUES ($id, $temp) ON CONFLICT DO NOTHING;",
+			columns: []string{"$id", "$temp"},
+		},
+		{
+			name:    "upsert",
+			event:   event(ConflictUpdate, "id", temp, count),
+			stmt:    "INSERT INTO records (id, temp, count) VALUES ($id, $temp, $count) ON CONFLICT (id) DO UPDATE SET temp = $temp, count = $count;",
+			columns: []string{"$id", "$temp", "$count"},
+		},
+		{
+			name:    "upsert of only the key",
+			event:   event(ConflictUpdate, "id"),
+			stmt:    "INSERT INTO records (id) VALUES ($id) ON CONFLICT DO NOTHING;",
+			columns: []string{"$id"},
+		},
+		{
+			name:    "unknown column",
+			event:   event(ConflictError, "", &ParamValue{Param: "humidity", Value: "1"}),
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			event:   event(ConflictError, "", &ParamValue{Param: "count", Value: "two"}),
+			wantErr: true,
+		},
+		{
+			name:    "scalar into array",
+			event:   event(ConflictError, "", &ParamValue{Param: "tags", Value: "a"}),
+			wantErr: true,
+		},
+		{
+			name:    "no values",
+			event:   event(ConflictError, ""),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt, values, err := sinkStatement(schema, tt.event)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.stmt, stmt)
+
+			require.Len(t, values, len(tt.columns))
+			for _, col := range tt.columns {
+				require.Contains(t, values, col)
+			}
+		})
+	}
+
+	// the key is derived from the event ID, so it is the same for every
+	// validator and every replay of the event.
+	ev := event(ConflictError, "id", temp)
+	_, values, err := sinkStatement(schema, ev)
+	require.NoError(t, err)
+	require.Equal(t, types.NewUUIDV5([]byte(ev.TxID())), values["$id"])
+}
+
+func Test_ConvertValue(t *testing.T) {
+	dec, err := decimal.NewFromString("1.50")
+	require.NoError(t, err)
+	require.NoError(t, dec.SetPrecisionAndScale(4, 2))
+
+	type testcase struct {
+		name    string
+		typ     *types.DataType
+		value   *ParamValue
+		want    any
+		wantErr bool
+	}
+
+	tests := []testcase{
+		{
+			name:  "int",
+			typ:   types.IntType,
+			value: &ParamValue{Value: "-3"},
+			want:  int64(-3),
+		},
+		{
+			name:  "bool",
+			typ:   types.BoolType,
+			value: &ParamValue{Value: "true"},
+			want:  true,
+		},
+		{
+			name:  "blob",
+			typ:   types.BlobType,
+			value: &ParamValue{Value: "aGk="},
+			want:  []byte("hi"),
+		},
+		{
+			name:  "decimal",
+			typ:   &types.DataType{Name: "decimal", Metadata: [2]uint16{4, 2}},
+			value: &ParamValue{Value: "1.5"},
+			want:  dec,
+		},
+		{
+			name:    "decimal out of range",
+			typ:     &types.DataType{Name: "decimal", Metadata: [2]uint16{4, 2}},
+			value:   &ParamValue{Value: "123.5"},
+			wantErr: true,
+		},
+		{
+			name:  "int array",
+			typ:   types.ArrayType(types.IntType),
+			value: &ParamValue{ValueArray: []string{"1", "2"}, IsArray: true},
+			want:  []int64{1, 2},
+		},
+		{
+			name:  "null",
+			typ:   types.IntType,
+			value: &ParamValue{IsNull: true},
+			want:  nil,
+		},
+		{
+			name:    "array into scalar",
+			typ:     types.TextType,
+			value:   &ParamValue{ValueArray: []string{"a"}, IsArray: true},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertValue(tt.typ, tt.value)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package resolution
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kwilteam/kwil-db/common/sql"
+)
+
+/*
+	state.go contains the node state that the resolution keeps about the
+	events it has applied. It is only ever written from within resolutions,
+	so it is identical on every node.
+*/
+
+const (
+	streamrSchemaName = `kwild_streamr`
+
+	createStreamrSchema = `CREATE SCHEMA IF NOT EXISTS ` + streamrSchemaName + `;`
+
+	// tableAppliedEvents records the IDs of events that have been applied
+	// with replay protection, until they fall out of their retention period.
+	tableAppliedEvents = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.applied_events (
+		id TEXT PRIMARY KEY, -- id is the transaction ID of the event
+		scope TEXT NOT NULL, -- scope is the stream and target that the event was applied to
+		stream_time INT8 NOT NULL -- stream_time is the timestamp of the event
+	);`
+
+	appliedEventsScopeIndex = `CREATE INDEX IF NOT EXISTS applied_events_scope_time ON ` + streamrSchemaName + `.applied_events (scope, stream_time);`
+
+	// tableReplayHorizons records the latest timestamp that has been applied
+	// per scope. IDs are retained for a period relative to it.
+	tableReplayHorizons = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.replay_horizons (
+		scope TEXT PRIMARY KEY,
+		latest INT8 NOT NULL -- latest is the latest timestamp that has been applied
+	);`
+
+	insertAppliedEvent = `INSERT INTO ` + streamrSchemaName + `.applied_events (id, scope, stream_time)
+		VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING;`
+
+	getReplayHorizon = `SELECT latest FROM ` + streamrSchemaName + `.replay_horizons WHERE scope = $1;`
+
+	// listReplayHorizons lists the scopes of every horizon. Scopes contain
+	// stream IDs, which may contain any character, so they are matched by
+	// the caller rather than with a pattern.
+	listReplayHorizons = `SELECT scope FROM ` + streamrSchemaName + `.replay_horizons ORDER BY scope;`
+
+	deleteReplayHorizon = `DELETE FROM ` + streamrSchemaName + `.replay_horizons WHERE scope = $1;`
+
+	upsertReplayHorizon = `INSERT INTO ` + streamrSchemaName + `.replay_horizons (scope, latest)
+		VALUES ($1, $2) ON CONFLICT (scope) DO UPDATE SET latest = $2;`
+
+	// tableChainPositions records the position of the latest event applied
+	// per message chain and target, for events that enforce ordering.
+	tableChainPositions = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.chain_positions (
+		stream_id TEXT NOT NULL,
+		stream_partition INT8 NOT NULL,
+		publisher_id TEXT NOT NULL,
+		msg_chain_id TEXT NOT NULL,
+		aggregate_key TEXT NOT NULL, -- aggregate_key separates the keys of aggregated windows, which have no chain
+		target_dbid TEXT NOT NULL,
+		target_procedure TEXT NOT NULL,
+		stream_time INT8 NOT NULL, -- stream_time is the timestamp of the latest applied event
+		sequence INT8 NOT NULL, -- sequence is the sequence number of the latest applied event
+		PRIMARY KEY (stream_id, stream_partition, publisher_id, msg_chain_id, aggregate_key, target_dbid, target_procedure)
+	);`
+
+	getChainPosition = `SELECT stream_time, sequence FROM ` + streamrSchemaName + `.chain_positions
+		WHERE stream_id = $1 AND stream_partition = $2 AND publisher_id = $3 AND msg_chain_id = $4
+		AND aggregate_key = $5 AND target_dbid = $6 AND target_procedure = $7;`
+
+	upsertChainPosition = `INSERT INTO ` + streamrSchemaName + `.chain_positions (stream_id, stream_partition,
+		publisher_id, msg_chain_id, aggregate_key, target_dbid, target_procedure, stream_time, sequence)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (stream_id, stream_partition, publisher_id, msg_chain_id, aggregate_key, target_dbid, target_procedure)
+		DO UPDATE SET stream_time = $8, sequence = $9;`
+
+	// tableFailures is the failure ledger. It records events whose target
+	// procedure failed, until they are re-driven.
+	tableFailures = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.failures (
+		id TEXT PRIMARY KEY, -- id is the transaction ID of the event
+		target_dbid TEXT NOT NULL,
+		target_procedure TEXT NOT NULL,
+		error_class TEXT NOT NULL, -- error_class is the kind of error, see failureClass
+		error_message TEXT NOT NULL, -- error_message is the SQLSTATE of the error, or the error, see failureMessage
+		stream_time INT8 NOT NULL, -- stream_time is the timestamp of the event
+		body BYTEA NOT NULL -- body is the encoded event
+	);`
+
+	failuresTargetIndex = `CREATE INDEX IF NOT EXISTS failures_target ON ` + streamrSchemaName + `.failures (target_dbid, target_procedure);`
+
+	upsertFailure = `INSERT INTO ` + streamrSchemaName + `.failures (id, target_dbid, target_procedure, error_class, error_message, stream_time, body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET target_procedure = $3, error_class = $4, error_message = $5;`
+
+	getFailure = `SELECT target_dbid, target_procedure, body FROM ` + streamrSchemaName + `.failures WHERE id = $1;`
+
+	deleteFailure = `DELETE FROM ` + streamrSchemaName + `.failures WHERE id = $1;`
+
+	// ListFailures lists the failures in the ledger, optionally filtered
+	// by target database. It is used by the command line tools, which read
+	// the node's database directly.
+	ListFailures = `SELECT id, target_dbid, target_procedure, error_class, error_message, stream_time
+		FROM ` + streamrSchemaName + `.failures WHERE $1::TEXT = '' OR target_dbid = $1::TEXT
+		ORDER BY stream_time, id;`
+
+	// tableAllowedTargets is the allowlist of targets that events may be
+	// applied to. It is managed by the owners of the target schemas.
+	tableAllowedTargets = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.allowed_targets (
+		stream_id TEXT NOT NULL, -- stream_id is the allowed stream, or '*' for any stream
+		target_dbid TEXT NOT NULL,
+		target_procedure TEXT NOT NULL, -- target_procedure is lowercase, since procedure names are case-insensitive
+		PRIMARY KEY (target_dbid, target_procedure, stream_id)
+	);`
+
+	insertAllowedTarget = `INSERT INTO ` + streamrSchemaName + `.allowed_targets (stream_id, target_dbid, target_procedure)
+		VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`
+
+	deleteAllowedTarget = `DELETE FROM ` + streamrSchemaName + `.allowed_targets
+		WHERE stream_id = $1 AND target_dbid = $2 AND target_procedure = $3;`
+
+	isTargetAllowed = `SELECT 1 FROM ` + streamrSchemaName + `.allowed_targets
+		WHERE target_dbid = $1 AND target_procedure = $2 AND (stream_id = $3 OR stream_id = '*');`
+
+	// ListAllowedTargets lists the allowed targets, optionally filtered
+	// by target database. It is used by the command line tools.
+	ListAllowedTargets = `SELECT stream_id, target_dbid, target_procedure
+		FROM ` + streamrSchemaName + `.allowed_targets WHERE $1::TEXT = '' OR target_dbid = $1::TEXT
+		ORDER BY target_dbid, target_procedure, stream_id;`
+
+	// tableShadowStats records the outcome of events that are resolved in
+	// shadow mode, per stream and target.
+	tableShadowStats = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.shadow_stats (
+		stream_id TEXT NOT NULL,
+		target_dbid TEXT NOT NULL,
+		target_procedure TEXT NOT NULL,
+		confirmed INT8 NOT NULL, -- confirmed is the number of events that were confirmed
+		binding_errors INT8 NOT NULL, -- binding_errors is the number of events whose target could not be bound
+		missing_values INT8 NOT NULL, -- missing_values is the number of events with parameters that had no value
+		shadow_errors INT8 NOT NULL, -- shadow_errors is the number of events whose shadow procedure failed
+		first_stream_time INT8 NOT NULL,
+		last_stream_time INT8 NOT NULL,
+		PRIMARY KEY (stream_id, target_dbid, target_procedure)
+	);`
+
+	upsertShadowStats = `INSERT INTO ` + streamrSchemaName + `.shadow_stats (stream_id, target_dbid, target_procedure,
+		confirmed, binding_errors, missing_values, shadow_errors, first_stream_time, last_stream_time)
+		VALUES ($1, $2, $3, 1, $4, $5, $6, $7, $7)
+		ON CONFLICT (stream_id, target_dbid, target_procedure) DO UPDATE SET
+		confirmed = shadow_stats.confirmed + 1,
+		binding_errors = shadow_stats.binding_errors + $4,
+		missing_values = shadow_stats.missing_values + $5,
+		shadow_errors = shadow_stats.shadow_errors + $6,
+		first_stream_time = LEAST(shadow_stats.first_stream_time, $7),
+		last_stream_time = GREATEST(shadow_stats.last_stream_time, $7);`
+
+	// tableStreamCursors records the position of the latest event applied
+	// per stream, target and message chain, for events that track it.
+	tableStreamCursors = `CREATE TABLE IF NOT EXISTS ` + streamrSchemaName + `.stream_cursors (
+		stream_id TEXT NOT NULL,
+		target_dbid TEXT NOT NULL,
+		target TEXT NOT NULL,
+		publisher_id TEXT NOT NULL,
+		msg_chain_id TEXT NOT NULL,
+		stream_time INT8 NOT NULL,
+		sequence INT8 NOT NULL,
+		PRIMARY KEY (stream_id, target_dbid, target, publisher_id, msg_chain_id)
+	);`
+
+	// the cursor only moves forward, even if events are applied out of order.
+	upsertStreamCursor = `INSERT INTO ` + streamrSchemaName + `.stream_cursors (stream_id, target_dbid, target,
+		publisher_id, msg_chain_id, stream_time, sequence)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (stream_id, target_dbid, target, publisher_id, msg_chain_id) DO UPDATE SET
+		stream_time = $6, sequence = $7
+		WHERE (stream_cursors.stream_time, stream_cursors.sequence) < ($6::INT8, $7::INT8);`
+
+	// ListCursors lists the cursors of a stream and target. It is used by
+	// the listener and the command line tools. Empty arguments match any
+	// stream or target.
+	ListCursors = `SELECT stream_id, target_dbid, target, publisher_id, msg_chain_id, stream_time, sequence
+		FROM ` + streamrSchemaName + `.stream_cursors
+		WHERE ($1::TEXT = '' OR stream_id = $1::TEXT) AND ($2::TEXT = '' OR target_dbid = $2::TEXT)
+		AND ($3::TEXT = '' OR target = $3::TEXT)
+		ORDER BY stream_id, target_dbid, target, publisher_id, msg_chain_id;`
+
+	// ListShadowStats lists the shadow mode statistics, optionally
+	// filtered by target database. It is used by the command line tools.
+	ListShadowStats = `SELECT stream_id, target_dbid, target_procedure, confirmed, binding_errors,
+		missing_values, shadow_errors, first_stream_time, last_stream_time
+		FROM ` + streamrSchemaName + `.shadow_stats WHERE $1::TEXT = '' OR target_dbid = $1::TEXT
+		ORDER BY target_dbid, target_procedure, stream_id;`
+
+	pruneAppliedEvents = `DELETE FROM ` + streamrSchemaName + `.applied_events WHERE scope = $1 AND stream_time < $2;`
+)
+
+// stateReady is set once a resolution that ensured the state has
+// succeeded, after which the state is known to exist, and is not created
+// again by this process.
+var stateReady atomic.Bool
+
+// ensureState creates the tables used by the resolution, if they do not
+// exist. Extensions have no hook that runs when a node starts, so this is
+// called once at the start of each resolution, and by the precompile,
+// before the state is used. It does nothing once the state is ready.
+func ensureState(ctx context.Context, db sql.Executor) error {
+	if stateReady.Load() {
+		return nil
+	}
+
+	for _, stmt := range []string{createStreamrSchema, tableAppliedEvents, appliedEventsScopeIndex, tableReplayHorizons, tableChainPositions,
+		tableFailures, failuresTargetIndex, tableAllowedTargets, tableShadowStats, tableStreamCursors} {
+		if _, err := db.Execute(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create Streamr state: %w", err)
+		}
+	}
+	return nil
+}
+
+// replayScope is the scope that an event's ID is retained in. Aggregates
+// lag behind the messages of their stream, so events sent to different
+// targets have their own retention horizon.
+func replayScope(ev *StreamrEvent) string {
+	return fmt.Sprintf("%s/%d/%s/%s", ev.StreamID, ev.Partition, ev.TargetDBID, ev.Target())
+}
+
+var (
+	// errAlreadyApplied is returned if an event has already been applied.
+	errAlreadyApplied = errors.New("event has already been applied")
+	// errBeyondRetention is returned if an event is older than the
+	// retention period of its scope, so it can no longer be checked.
+	errBeyondRetention = errors.New("event is older than its replay retention period")
+)
+
+// recordApplied records that an event is applied. It returns
+// errAlreadyApplied or errBeyondRetention if the event must be skipped.
+// It does nothing if the event does not use replay protection.
+func recordApplied(ctx context.Context, db sql.Executor, ev *StreamrEvent) error {
+	if ev.ReplayRetention == 0 {
+		return nil
+	}
+	if ev.IDVersion == IDVersionLegacy {
+		// legacy IDs can collide across streams and publishers, so they
+		// would cause valid events to be skipped.
+		return fmt.Errorf("replay protection requires event ID version %d or later", IDVersion1)
+	}
+
+	scope := replayScope(ev)
+	ts := int64(ev.Timestamp)
+	retention := int64(ev.ReplayRetention)
+
+	res, err := db.Execute(ctx, getReplayHorizon, scope)
+	if err != nil {
+		return err
+	}
+
+	// advanced is true if the event moves the scope's horizon forward.
+	advanced := true
+	if len(res.Rows) > 0 {
+		latest, ok := res.Rows[0][0].(int64)
+		if !ok {
+			return fmt.Errorf("unexpected replay horizon type %T", res.Rows[0][0])
+		}
+
+		if ts < latest-retention {
+			return errBeyondRetention
+		}
+		advanced = ts > latest
+	}
+
+	res, err = db.Execute(ctx, insertAppliedEvent, ev.TxID(), scope, ts)
+	if err != nil {
+		return err
+	}
+	if res.Status.RowsAffected == 0 {
+		return errAlreadyApplied
+	}
+
+	if !advanced {
+		return nil
+	}
+
+	if _, err = db.Execute(ctx, upsertReplayHorizon, scope, ts); err != nil {
+		return err
+	}
+
+	_, err = db.Execute(ctx, pruneAppliedEvents, scope, ts-retention)
+	return err
+}
+
+// resetReplay removes the replay horizons of a stream and target, in
+// every partition, so that the next event applied to them sets a new
+// horizon. It is used to recover a scope whose horizon was moved too far
+// ahead, for example by an event with a timestamp in the future. The IDs
+// that were applied are kept, so replays are still skipped.
+func resetReplay(ctx context.Context, db sql.Executor, streamID, dbid, target string) error {
+	res, err := db.Execute(ctx, listReplayHorizons)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range res.Rows {
+		scope, ok := row[0].(string)
+		if !ok {
+			return fmt.Errorf("unexpected replay scope type %T", row[0])
+		}
+		if !matchesScope(scope, streamID, dbid, target) {
+			continue
+		}
+
+		if _, err := db.Execute(ctx, deleteReplayHorizon, scope); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchesScope returns true if scope is the replay scope of a stream and
+// target, in any partition. See replayScope.
+func matchesScope(scope, streamID, dbid, target string) bool {
+	rest, ok := strings.CutPrefix(scope, streamID+"/")
+	if !ok {
+		return false
+	}
+	partition, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return false
+	}
+	if _, err := strconv.ParseUint(partition, 10, 64); err != nil {
+		return false
+	}
+	scopeTarget, ok := strings.CutPrefix(rest, dbid+"/")
+	return ok && strings.EqualFold(scopeTarget, target)
+}
+
+// advanceChain records the event as the latest applied event of its
+// message chain. If a later event of the chain has already been applied,
+// it returns true, and does not record the event. Elements of an exploded
+// message share the message's position, so they are not stale relative
+// to each other.
+func advanceChain(ctx context.Context, db sql.Executor, ev *StreamrEvent) (stale bool, err error) {
+	ts, seq := int64(ev.Timestamp), int64(ev.SequenceID)
+	key := []any{ev.StreamID, int64(ev.Partition), strings.ToLower(ev.PublisherID), ev.MsgChainID,
+		ev.AggregateKey, ev.TargetDBID, ev.Target()}
+
+	res, err := db.Execute(ctx, getChainPosition, key...)
+	if err != nil {
+		return false, err
+	}
+
+	if len(res.Rows) > 0 {
+		lastTs, ok1 := res.Rows[0][0].(int64)
+		lastSeq, ok2 := res.Rows[0][1].(int64)
+		if !ok1 || !ok2 {
+			return false, fmt.Errorf("unexpected chain position types %T, %T", res.Rows[0][0], res.Rows[0][1])
+		}
+
+		if ts < lastTs || (ts == lastTs && seq < lastSeq) {
+			return true, nil
+		}
+	}
+
+	_, err = db.Execute(ctx, upsertChainPosition, append(key, ts, seq)...)
+	return false, err
+}
+
+// advanceCursor moves the cursor of the event's stream, target and message
+// chain to the event, if it is later than the cursor.
+func advanceCursor(ctx context.Context, db sql.Executor, ev *StreamrEvent) error {
+	// aggregates do not have the position of a message, and legacy IDs
+	// leave out the stream and publisher.
+	if ev.AggregateKey != "" || ev.IDVersion == IDVersionLegacy {
+		return nil
+	}
+	_, err := db.Execute(ctx, upsertStreamCursor, ev.StreamID, ev.TargetDBID, strings.ToLower(ev.Target()),
+		strings.ToLower(ev.PublisherID), ev.MsgChainID, int64(ev.Timestamp), int64(ev.SequenceID))
+	return err
+}
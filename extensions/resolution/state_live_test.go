@@ -0,0 +1,217 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/stretchr/testify/require"
+)
+
+// horizon returns the replay horizon of an event's scope, or nil.
+func horizon(t *testing.T, app *common.App, ev *StreamrEvent) any {
+	rows := query(t, app, getReplayHorizon, replayScope(ev))
+	if len(rows) == 0 {
+		return nil
+	}
+	return rows[0][0]
+}
+
+func Test_RecordApplied(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+	ev := func(ts uint64) *StreamrEvent {
+		e := liveEvent(ts, 0)
+		e.ReplayRetention = 1000
+		return e
+	}
+
+	require.NoError(t, recordApplied(ctx, app.DB, ev(5000)))
+	require.ErrorIs(t, recordApplied(ctx, app.DB, ev(5000)), errAlreadyApplied)
+
+	// older events within the retention are still checked, and do not
+	// move the horizon back
+	require.NoError(t, recordApplied(ctx, app.DB, ev(4500)))
+	require.ErrorIs(t, recordApplied(ctx, app.DB, ev(4500)), errAlreadyApplied)
+	require.Equal(t, int64(5000), horizon(t, app, ev(0)))
+
+	// events older than the retention can no longer be checked
+	require.ErrorIs(t, recordApplied(ctx, app.DB, ev(3999)), errBeyondRetention)
+
+	// IDs that fall out of the retention are pruned
+	require.NoError(t, recordApplied(ctx, app.DB, ev(5600)))
+	require.Equal(t, [][]any{{int64(5000)}, {int64(5600)}},
+		query(t, app, `SELECT stream_time FROM kwild_streamr.applied_events ORDER BY stream_time;`))
+
+	// events without replay protection are never recorded
+	require.NoError(t, recordApplied(ctx, app.DB, liveEvent(5000, 0)))
+	require.NoError(t, recordApplied(ctx, app.DB, liveEvent(5000, 0)))
+
+	// legacy IDs cannot be used with replay protection
+	legacy := ev(6000)
+	legacy.IDVersion = IDVersionLegacy
+	require.Error(t, recordApplied(ctx, app.DB, legacy))
+}
+
+func Test_ApplyReplayed(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+	allowLive(t, app, anyStream, "write")
+	ev := func(ts uint64) *StreamrEvent {
+		e := liveEvent(ts, 0)
+		e.ReplayRetention = 1000
+		e.RecordFailures = true
+		return e
+	}
+
+	// a replayed event is applied once
+	require.NoError(t, resolveEvent(t, app, ev(5000)))
+	require.NoError(t, resolveEvent(t, app, ev(5000)))
+	require.Equal(t, []string{"write[5000]"}, calls(t, app))
+
+	// an event beyond the retention is not applied, but it is kept in
+	// the failure ledger, from where it can be re-driven
+	old := ev(3000)
+	require.NoError(t, resolveEvent(t, app, old))
+	require.Len(t, calls(t, app), 1)
+	require.Equal(t, [][]any{{old.TxID(), liveDBID, "write", string(failureRetention), errBeyondRetention.Error(), int64(3000)}},
+		query(t, app, ListFailures, ""))
+
+	require.NoError(t, resolveLive(t, app, func(app *common.App) error {
+		return redrive(ctx, app, liveDBID, old.TxID(), "")
+	}))
+	require.Equal(t, []string{"write[5000]", "write[3000]"}, calls(t, app))
+	require.Empty(t, query(t, app, ListFailures, ""))
+}
+
+func Test_ResetReplay(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+	ev := liveEvent(5000, 0)
+	ev.ReplayRetention = 1000
+
+	// an event far in the future moves the horizon past later events
+	future := liveEvent(1_000_000, 0)
+	future.ReplayRetention = 1000
+	require.NoError(t, recordApplied(ctx, app.DB, future))
+	require.ErrorIs(t, recordApplied(ctx, app.DB, ev), errBeyondRetention)
+
+	other := liveEvent(1_000_000, 1)
+	other.ReplayRetention, other.TargetProcedure = 1000, "bump"
+	require.NoError(t, recordApplied(ctx, app.DB, other))
+
+	// resetting the horizon lets the next event set a new one, but keeps
+	// the applied IDs, and the horizons of other targets
+	require.NoError(t, resetReplay(ctx, app.DB, ev.StreamID, liveDBID, "WRITE"))
+	require.Nil(t, horizon(t, app, ev))
+	require.NoError(t, recordApplied(ctx, app.DB, ev))
+	require.ErrorIs(t, recordApplied(ctx, app.DB, future), errAlreadyApplied)
+	require.Equal(t, int64(1_000_000), horizon(t, app, other))
+}
+
+func Test_AdvanceChain(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+
+	type position struct {
+		ts, seq uint64
+		stale   bool
+	}
+	for _, p := range []position{
+		{ts: 100, seq: 1},
+		{ts: 100, seq: 1}, // elements of a message share its position
+		{ts: 100, seq: 2},
+		{ts: 100, seq: 0, stale: true},
+		{ts: 99, seq: 5, stale: true},
+		{ts: 101, seq: 0},
+		{ts: 100, seq: 9, stale: true},
+	} {
+		stale, err := advanceChain(ctx, app.DB, liveEvent(p.ts, p.seq))
+		require.NoError(t, err)
+		require.Equalf(t, p.stale, stale, "position %d/%d", p.ts, p.seq)
+	}
+
+	// chains are kept per publisher, regardless of case, and per target
+	ev := liveEvent(50, 0)
+	ev.PublisherID = "0xdef"
+	stale, err := advanceChain(ctx, app.DB, ev)
+	require.NoError(t, err)
+	require.True(t, stale)
+
+	ev.PublisherID = "0x123"
+	stale, err = advanceChain(ctx, app.DB, ev)
+	require.NoError(t, err)
+	require.False(t, stale)
+
+	ev = liveEvent(50, 0)
+	ev.TargetProcedure = "bump"
+	stale, err = advanceChain(ctx, app.DB, ev)
+	require.NoError(t, err)
+	require.False(t, stale)
+
+	// aggregates of different keys have their own positions
+	ev = liveEvent(50, 0)
+	ev.AggregateKey = `[["device","a"]]`
+	stale, err = advanceChain(ctx, app.DB, ev)
+	require.NoError(t, err)
+	require.False(t, stale)
+}
+
+func Test_ApplyOrdering(t *testing.T) {
+	app, _ := newLiveApp(t)
+	allowLive(t, app, anyStream, "write", "write_late")
+	ev := func(ts uint64, ordering OrderingMode) *StreamrEvent {
+		e := liveEvent(ts, 0)
+		e.Ordering = ordering
+		e.LateProcedure = "write_late"
+		return e
+	}
+
+	require.NoError(t, resolveEvent(t, app, ev(200, OrderingReject)))
+	require.NoError(t, resolveEvent(t, app, ev(100, OrderingReject)))
+	require.Equal(t, []string{"write[200]"}, calls(t, app))
+
+	// late events are sent to their late procedure, and do not move the
+	// position of the chain back
+	require.NoError(t, resolveEvent(t, app, ev(150, OrderingLate)))
+	require.NoError(t, resolveEvent(t, app, ev(180, OrderingLate)))
+	require.NoError(t, resolveEvent(t, app, ev(300, OrderingLate)))
+	require.Equal(t, []string{"write[200]", "write_late[150]", "write_late[180]", "write[300]"}, calls(t, app))
+}
+
+func Test_AdvanceCursor(t *testing.T) {
+	ctx := context.Background()
+	app, _ := newLiveApp(t)
+	allowLive(t, app, anyStream, "write")
+	ev := func(ts, seq uint64) *StreamrEvent {
+		e := liveEvent(ts, seq)
+		e.TrackCursor = true
+		e.TargetProcedure = "Write"
+		return e
+	}
+
+	require.NoError(t, resolveEvent(t, app, ev(100, 2)))
+	require.NoError(t, resolveEvent(t, app, ev(100, 1)))
+	require.NoError(t, resolveEvent(t, app, ev(90, 5)))
+
+	// the publisher and target are lowercase, as the listener reads them
+	cursor := func(ts, seq int64) [][]any {
+		return [][]any{{"0xabc/weather", liveDBID, "write", "0xdef", "chain", ts, seq}}
+	}
+	require.Equal(t, cursor(100, 2), query(t, app, ListCursors, "", "", ""))
+
+	require.NoError(t, resolveEvent(t, app, ev(100, 3)))
+	require.Equal(t, cursor(100, 3), query(t, app, ListCursors, "0xabc/weather", liveDBID, "write"))
+
+	// aggregates and legacy IDs have no position to resend from
+	aggregate := ev(200, 0)
+	aggregate.AggregateKey = "sensor-1"
+	require.NoError(t, advanceCursor(ctx, app.DB, aggregate))
+
+	legacy := ev(200, 0)
+	legacy.IDVersion = IDVersionLegacy
+	require.NoError(t, advanceCursor(ctx, app.DB, legacy))
+	require.Equal(t, cursor(100, 3), query(t, app, ListCursors, "", "", ""))
+}
@@ -0,0 +1,131 @@
+package resolution
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kwilteam/kwil-db/common"
+	"github.com/kwilteam/kwil-db/common/sql"
+)
+
+// Step is one of the procedures that an event is applied to, if it has
+// more than one.
+type Step struct {
+	// Procedure is the name of the procedure/action to be executed.
+	Procedure string
+	// Values is the key-value pairs that are passed to the procedure.
+	Values []*ParamValue
+	// Results are parameters that are passed values returned by earlier
+	// steps.
+	Results []*StepResult
+}
+
+// StepResult binds a parameter of a step to a column of the first row
+// returned by an earlier step. If the earlier step returned no rows, the
+// parameter is passed nil.
+type StepResult struct {
+	// Param is the name of the parameter.
+	Param string
+	// Step is the index of the earlier step.
+	Step uint64
+	// Column is the name of the column returned by the earlier step.
+	Column string
+}
+
+// stepsTarget is the target of an event with steps. It identifies the
+// event's targets for replay protection, ordering and the failure ledger.
+func stepsTarget(steps []*Step) string {
+	procedures := make([]string, len(steps))
+	for i, step := range steps {
+		procedures[i] = strings.ToLower(step.Procedure)
+	}
+	return strings.Join(procedures, ",")
+}
+
+// callSteps executes the steps of the event in order. They are executed
+// in a savepoint, so that either all of them are applied, or none are.
+func callSteps(ctx context.Context, app *common.App, ev *StreamrEvent) error {
+	tx, err := app.DB.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = callStepsTx(ctx, &common.App{
+		Service: app.Service,
+		DB:      tx,
+		Engine:  app.Engine,
+	}, ev)
+	if err != nil {
+		if err2 := tx.Rollback(ctx); err2 != nil {
+			return err2
+		}
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func callStepsTx(ctx context.Context, app *common.App, ev *StreamrEvent) error {
+	schema, err := app.Engine.GetSchema(ev.TargetDBID)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errTargetNotFound, err)
+	}
+
+	results := make([]*sql.ResultSet, len(ev.Steps))
+	for i, step := range ev.Steps {
+		plan, err := plans.get(schema, ev.TargetDBID, step.Procedure)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errTargetNotFound, err)
+		}
+
+		args := plan.bind(step.Values)
+		for _, r := range step.Results {
+			if r.Step >= uint64(i) {
+				return fmt.Errorf("step %d (%s) refers to step %d, which is not an earlier step", i, step.Procedure, r.Step)
+			}
+
+			value, err := resultValue(results[r.Step], r.Column)
+			if err != nil {
+				return fmt.Errorf("step %d (%s): %w", i, step.Procedure, err)
+			}
+			for j, param := range plan.params {
+				if param == r.Param {
+					args[j] = value
+				}
+			}
+		}
+
+		results[i], err = app.Engine.Procedure(ctx, app.DB, &common.ExecutionData{
+			TransactionData: common.TransactionData{
+				Caller: "streamr",
+				Signer: []byte("streamr"),
+				TxID:   ev.TxID(),
+				Height: -1,
+			},
+			Dataset:   ev.TargetDBID,
+			Procedure: step.Procedure,
+			Args:      args,
+		})
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", i, step.Procedure, err)
+		}
+	}
+
+	return nil
+}
+
+// resultValue returns the value of a column in the first row of a result.
+func resultValue(res *sql.ResultSet, column string) (any, error) {
+	if res == nil || len(res.Rows) == 0 {
+		return nil, nil
+	}
+
+	for i, col := range res.Columns {
+		if strings.EqualFold(col, column) {
+			return res.Rows[0][i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("result has no column %s", column)
+}
@@ -0,0 +1,46 @@
+//go:build pglive
+
+package resolution
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CallSteps(t *testing.T) {
+	ctx := context.Background()
+	app, engine := newLiveApp(t)
+	engine.results["bump"] = `SELECT 7::INT8 AS "Temp";`
+	allowLive(t, app, anyStream, "bump", "write", "write_late")
+
+	ev := liveEvent(100, 0)
+	ev.RecordFailures = true
+	ev.Steps = []*Step{
+		{Procedure: "bump", Values: []*ParamValue{{Param: "temp", Value: "1"}}},
+		{Procedure: "write", Results: []*StepResult{{Param: "temp", Step: 0, Column: "temp"}}},
+		{Procedure: "write_late", Values: []*ParamValue{{Param: "temp", Value: "2"}}},
+	}
+	require.NoError(t, resolveEvent(t, app, ev))
+	require.Equal(t, []string{"bump[1]", "write[7]", "write_late[2]"}, calls(t, app))
+
+	// if a step fails, the earlier steps are rolled back
+	engine.failing["write_late"] = raise("caller is not streamr")
+	ev.Timestamp = 200
+	require.NoError(t, resolveEvent(t, app, ev))
+	require.Len(t, calls(t, app), 3)
+	failures := query(t, app, ListFailures, liveDBID)
+	require.Len(t, failures, 1)
+	require.Equal(t, []any{ev.TxID(), "bump,write,write_late"}, []any{failures[0][0], failures[0][2]})
+
+	// the steps are rolled back by callSteps itself, without the
+	// savepoint of the failure ledger
+	require.ErrorContains(t, callSteps(ctx, app, ev), "step 2 (write_late)")
+	require.Len(t, calls(t, app), 3)
+
+	// steps can only refer to earlier steps
+	ev.Steps[2].Results = []*StepResult{{Param: "temp", Step: 2, Column: "temp"}}
+	require.ErrorContains(t, callSteps(ctx, app, ev), "not an earlier step")
+	require.Len(t, calls(t, app), 3)
+}
@@ -0,0 +1,43 @@
+package resolution
+
+import (
+	"testing"
+
+	"github.com/kwilteam/kwil-db/common/sql"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StepsTarget(t *testing.T) {
+	ev := &StreamrEvent{
+		TargetProcedure: "ignored",
+		Steps:           []*Step{{Procedure: "Write_Raw"}, {Procedure: "bump_summary"}},
+	}
+	require.Equal(t, "write_raw,bump_summary", ev.Target())
+
+	ev.Steps = nil
+	require.Equal(t, "ignored", ev.Target())
+}
+
+func Test_ResultValue(t *testing.T) {
+	res := &sql.ResultSet{
+		Columns: []string{"id", "total"},
+		Rows:    [][]any{{"a", int64(1)}, {"b", int64(2)}},
+	}
+
+	// the first row is used, and columns are case-insensitive
+	v, err := resultValue(res, "TOTAL")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), v)
+
+	_, err = resultValue(res, "missing")
+	require.Error(t, err)
+
+	// a step that returned nothing passes nil
+	v, err = resultValue(&sql.ResultSet{Columns: []string{"id"}}, "id")
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	v, err = resultValue(nil, "id")
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
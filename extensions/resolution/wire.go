@@ -0,0 +1,507 @@
+package resolution
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/kwilteam/kwil-db/core/types/serialize"
+)
+
+/*
+	wire.go contains the encodings of event bodies that are voted on.
+
+	All validators must produce byte-identical bodies for the same Streamr
+	message for a resolution to be confirmed, so the encoding of each
+	version is frozen once released. During a rolling upgrade, validators
+	can be configured to keep emitting an older version until every
+	validator can decode the newer one.
+
+	Version 0 (legacy) is the original encoding: the RLP serialization of
+	the event struct, with no prefix.
+
+	Version 1 and later are prefixed with a header:
+		magic (4 bytes) | version (1 byte) | kind (1 byte) | payload
+
+	The legacy encoding always starts with the serialize package's encoding
+	type prefix, so it can never start with the magic bytes.
+
+	Fields may only be added to a version's payload as trailing optional
+	fields. A body that does not use them encodes identically, which is
+	verified by the golden vectors in testdata.
+*/
+
+// WireVersion is the version of the encoding of an event body.
+type WireVersion uint8
+
+const (
+	// WireVersionLegacy is the original, unprefixed encoding.
+	WireVersionLegacy WireVersion = 0
+	// WireVersion1 is the first prefixed encoding.
+	WireVersion1 WireVersion = 1
+
+	// LatestWireVersion is the latest supported wire version.
+	LatestWireVersion = WireVersion1
+)
+
+// wireMagic marks a versioned body.
+var wireMagic = []byte("STRM")
+
+// bodyKind is the kind of value that a versioned body contains.
+type bodyKind uint8
+
+const (
+	kindEvent bodyKind = 1
+	kindBatch bodyKind = 2
+	kindAllow bodyKind = 3
+)
+
+// MarshalVersion encodes the event using the given wire version.
+func (s *StreamrEvent) MarshalVersion(version WireVersion) ([]byte, error) {
+	switch version {
+	case WireVersionLegacy:
+		if err := checkLegacy(s); err != nil {
+			return nil, err
+		}
+		return serialize.Encode(eventToV0(s))
+	case WireVersion1:
+		return encodeVersioned(version, kindEvent, eventToV1(s))
+	default:
+		return nil, fmt.Errorf("unsupported wire version %d", version)
+	}
+}
+
+// MarshalBinary encodes the event using the latest wire version.
+func (s *StreamrEvent) MarshalBinary() ([]byte, error) {
+	return s.MarshalVersion(LatestWireVersion)
+}
+
+// UnmarshalBinary decodes an event encoded with any wire version.
+func (s *StreamrEvent) UnmarshalBinary(data []byte) error {
+	version, payload, err := decodeHeader(data, kindEvent)
+	if err != nil {
+		return err
+	}
+
+	switch version {
+	case WireVersionLegacy:
+		ev := &eventV0{}
+		if err := serialize.Decode(payload, ev); err != nil {
+			return err
+		}
+		*s = *ev.toEvent()
+	case WireVersion1:
+		ev := &eventV1{}
+		if err := serialize.Decode(payload, ev); err != nil {
+			return err
+		}
+		*s = *ev.toEvent()
+	default:
+		return fmt.Errorf("unsupported wire version %d", version)
+	}
+
+	return nil
+}
+
+// MarshalVersion encodes the batch using the given wire version.
+func (b *StreamrBatch) MarshalVersion(version WireVersion) ([]byte, error) {
+	switch version {
+	case WireVersionLegacy:
+		batch := &batchV0{Events: make([]*eventV0, len(b.Events))}
+		for i, ev := range b.Events {
+			if err := checkLegacy(ev); err != nil {
+				return nil, err
+			}
+			batch.Events[i] = eventToV0(ev)
+		}
+		return serialize.Encode(batch)
+	case WireVersion1:
+		batch := &batchV1{Events: make([]*eventV1, len(b.Events))}
+		for i, ev := range b.Events {
+			batch.Events[i] = eventToV1(ev)
+		}
+		return encodeVersioned(version, kindBatch, batch)
+	default:
+		return nil, fmt.Errorf("unsupported wire version %d", version)
+	}
+}
+
+// MarshalBinary encodes the batch using the latest wire version.
+func (b *StreamrBatch) MarshalBinary() ([]byte, error) {
+	return b.MarshalVersion(LatestWireVersion)
+}
+
+// UnmarshalBinary decodes a batch encoded with any wire version.
+func (b *StreamrBatch) UnmarshalBinary(data []byte) error {
+	version, payload, err := decodeHeader(data, kindBatch)
+	if err != nil {
+		return err
+	}
+
+	switch version {
+	case WireVersionLegacy:
+		batch := &batchV0{}
+		if err := serialize.Decode(payload, batch); err != nil {
+			return err
+		}
+		b.Events = make([]*StreamrEvent, len(batch.Events))
+		for i, ev := range batch.Events {
+			b.Events[i] = ev.toEvent()
+		}
+	case WireVersion1:
+		batch := &batchV1{}
+		if err := serialize.Decode(payload, batch); err != nil {
+			return err
+		}
+		b.Events = make([]*StreamrEvent, len(batch.Events))
+		for i, ev := range batch.Events {
+			b.Events[i] = ev.toEvent()
+		}
+	default:
+		return fmt.Errorf("unsupported wire version %d", version)
+	}
+
+	return nil
+}
+
+// encodeVersioned encodes a value with a versioned header.
+func encodeVersioned(version WireVersion, kind bodyKind, v any) ([]byte, error) {
+	payload, err := serialize.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(wireMagic)+2+len(payload))
+	buf = append(buf, wireMagic...)
+	buf = append(buf, byte(version), byte(kind))
+	return append(buf, payload...), nil
+}
+
+// decodeHeader returns the wire version and payload of a body. It checks
+// that a versioned body contains the expected kind of value.
+func decodeHeader(data []byte, kind bodyKind) (WireVersion, []byte, error) {
+	if !bytes.HasPrefix(data, wireMagic) {
+		return WireVersionLegacy, data, nil
+	}
+
+	data = data[len(wireMagic):]
+	if len(data) < 2 {
+		return 0, nil, errors.New("versioned body is missing its header")
+	}
+	if bodyKind(data[1]) != kind {
+		return 0, nil, fmt.Errorf("unexpected body kind %d, expected %d", data[1], kind)
+	}
+
+	return WireVersion(data[0]), data[2:], nil
+}
+
+// eventV0 is the legacy encoding of an event.
+// It must never be changed.
+type eventV0 struct {
+	Values          []*paramValueV0
+	TargetDBID      string
+	TargetProcedure string
+	Timestamp       uint64
+	SequenceID      uint64
+	MsgChainID      string
+	AggregateKey    string `rlp:"optional"`
+	ElementIndex    uint64 `rlp:"optional"`
+	IsElement       bool   `rlp:"optional"`
+	StreamID        string `rlp:"optional"`
+	Partition       uint64 `rlp:"optional"`
+	PublisherID     string `rlp:"optional"`
+	IDVersion       uint8  `rlp:"optional"`
+}
+
+// paramValueV0 is the legacy encoding of a parameter value.
+// It must never be changed.
+type paramValueV0 struct {
+	Param      string
+	Value      string
+	ValueArray []string
+	IsArray    bool
+}
+
+// batchV0 is the legacy encoding of a batch.
+// It must never be changed.
+type batchV0 struct {
+	Events []*eventV0
+}
+
+// checkLegacy returns an error if the event uses fields that cannot be
+// encoded with the legacy wire version.
+func checkLegacy(ev *StreamrEvent) error {
+	if ev.ReplayRetention != 0 {
+		return errors.New("replay protection is not supported by wire version 0")
+	}
+	if ev.Ordering != OrderingNone {
+		return errors.New("ordering is not supported by wire version 0")
+	}
+	if ev.RecordFailures {
+		return errors.New("the failure ledger is not supported by wire version 0")
+	}
+	if ev.Shadow {
+		return errors.New("shadow mode is not supported by wire version 0")
+	}
+	if ev.TargetTable != "" {
+		return errors.New("target tables are not supported by wire version 0")
+	}
+	if len(ev.Steps) > 0 {
+		return errors.New("steps are not supported by wire version 0")
+	}
+	if ev.TrackCursor {
+		return errors.New("cursors are not supported by wire version 0")
+	}
+	for _, v := range ev.Values {
+		if v.IsNull || v.Defaulted {
+			return errors.New("optional values are not supported by wire version 0")
+		}
+	}
+	return nil
+}
+
+func eventToV0(ev *StreamrEvent) *eventV0 {
+	values := make([]*paramValueV0, len(ev.Values))
+	for i, v := range ev.Values {
+		values[i] = &paramValueV0{
+			Param:      v.Param,
+			Value:      v.Value,
+			ValueArray: v.ValueArray,
+			IsArray:    v.IsArray,
+		}
+	}
+
+	return &eventV0{
+		Values:          values,
+		TargetDBID:      ev.TargetDBID,
+		TargetProcedure: ev.TargetProcedure,
+		Timestamp:       ev.Timestamp,
+		SequenceID:      ev.SequenceID,
+		MsgChainID:      ev.MsgChainID,
+		AggregateKey:    ev.AggregateKey,
+		ElementIndex:    ev.ElementIndex,
+		IsElement:       ev.IsElement,
+		StreamID:        ev.StreamID,
+		Partition:       ev.Partition,
+		PublisherID:     ev.PublisherID,
+		IDVersion:       ev.IDVersion,
+	}
+}
+
+func (e *eventV0) toEvent() *StreamrEvent {
+	values := make([]*ParamValue, len(e.Values))
+	for i, v := range e.Values {
+		values[i] = &ParamValue{
+			Param:      v.Param,
+			Value:      v.Value,
+			ValueArray: v.ValueArray,
+			IsArray:    v.IsArray,
+		}
+	}
+
+	return &StreamrEvent{
+		Values:          values,
+		TargetDBID:      e.TargetDBID,
+		TargetProcedure: e.TargetProcedure,
+		Timestamp:       e.Timestamp,
+		SequenceID:      e.SequenceID,
+		MsgChainID:      e.MsgChainID,
+		AggregateKey:    e.AggregateKey,
+		ElementIndex:    e.ElementIndex,
+		IsElement:       e.IsElement,
+		StreamID:        e.StreamID,
+		Partition:       e.Partition,
+		PublisherID:     e.PublisherID,
+		IDVersion:       e.IDVersion,
+	}
+}
+
+// eventV1 is the version 1 encoding of an event. Fields that identify
+// the message come first, followed by the target and the values.
+// Fields may only be appended, and must be optional.
+type eventV1 struct {
+	IDVersion       uint8
+	StreamID        string
+	Partition       uint64
+	PublisherID     string
+	MsgChainID      string
+	Timestamp       uint64
+	SequenceID      uint64
+	IsElement       bool
+	ElementIndex    uint64
+	AggregateKey    string
+	TargetDBID      string
+	TargetProcedure string
+	Values          []*paramValueV1
+	ReplayRetention uint64         `rlp:"optional"`
+	Ordering        OrderingMode   `rlp:"optional"`
+	LateProcedure   string         `rlp:"optional"`
+	RecordFailures  bool           `rlp:"optional"`
+	Shadow          bool           `rlp:"optional"`
+	ShadowProcedure string         `rlp:"optional"`
+	TargetTable     string         `rlp:"optional"`
+	OnConflict      ConflictPolicy `rlp:"optional"`
+	KeyColumn       string         `rlp:"optional"`
+	Steps           []*stepV1      `rlp:"optional"`
+	TrackCursor     bool           `rlp:"optional"`
+}
+
+// paramValueV1 is the version 1 encoding of a parameter value.
+// Fields may only be appended, and must be optional.
+type paramValueV1 struct {
+	Param      string
+	IsArray    bool
+	Value      string
+	ValueArray []string
+	IsNull     bool `rlp:"optional"`
+	Defaulted  bool `rlp:"optional"`
+}
+
+// stepV1 is the version 1 encoding of a step.
+// Fields may only be appended, and must be optional.
+type stepV1 struct {
+	Procedure string
+	Values    []*paramValueV1
+	Results   []*stepResultV1
+}
+
+// stepResultV1 is the version 1 encoding of a step result.
+// Fields may only be appended, and must be optional.
+type stepResultV1 struct {
+	Param  string
+	Step   uint64
+	Column string
+}
+
+// batchV1 is the version 1 encoding of a batch.
+type batchV1 struct {
+	Events []*eventV1
+}
+
+// allowV1 is the version 1 encoding of an allow proposal.
+// Fields may only be appended, and must be optional.
+type allowV1 struct {
+	StreamID   string
+	TargetDBID string
+	Targets    []string
+}
+
+func valuesToV1(vals []*ParamValue) []*paramValueV1 {
+	values := make([]*paramValueV1, len(vals))
+	for i, v := range vals {
+		values[i] = &paramValueV1{
+			Param:      v.Param,
+			IsArray:    v.IsArray,
+			Value:      v.Value,
+			ValueArray: v.ValueArray,
+			IsNull:     v.IsNull,
+			Defaulted:  v.Defaulted,
+		}
+	}
+	return values
+}
+
+func valuesFromV1(vals []*paramValueV1) []*ParamValue {
+	values := make([]*ParamValue, len(vals))
+	for i, v := range vals {
+		values[i] = &ParamValue{
+			Param:      v.Param,
+			Value:      v.Value,
+			ValueArray: v.ValueArray,
+			IsArray:    v.IsArray,
+			IsNull:     v.IsNull,
+			Defaulted:  v.Defaulted,
+		}
+	}
+	return values
+}
+
+func eventToV1(ev *StreamrEvent) *eventV1 {
+	values := valuesToV1(ev.Values)
+
+	// steps are nil if there are none, so that the encoding of events
+	// without steps does not change.
+	var steps []*stepV1
+	for _, step := range ev.Steps {
+		results := make([]*stepResultV1, len(step.Results))
+		for i, r := range step.Results {
+			results[i] = &stepResultV1{Param: r.Param, Step: r.Step, Column: r.Column}
+		}
+		steps = append(steps, &stepV1{
+			Procedure: step.Procedure,
+			Values:    valuesToV1(step.Values),
+			Results:   results,
+		})
+	}
+
+	return &eventV1{
+		IDVersion:       ev.IDVersion,
+		StreamID:        ev.StreamID,
+		Partition:       ev.Partition,
+		PublisherID:     ev.PublisherID,
+		MsgChainID:      ev.MsgChainID,
+		Timestamp:       ev.Timestamp,
+		SequenceID:      ev.SequenceID,
+		IsElement:       ev.IsElement,
+		ElementIndex:    ev.ElementIndex,
+		AggregateKey:    ev.AggregateKey,
+		TargetDBID:      ev.TargetDBID,
+		TargetProcedure: ev.TargetProcedure,
+		Values:          values,
+		ReplayRetention: ev.ReplayRetention,
+		Ordering:        ev.Ordering,
+		LateProcedure:   ev.LateProcedure,
+		RecordFailures:  ev.RecordFailures,
+		Shadow:          ev.Shadow,
+		ShadowProcedure: ev.ShadowProcedure,
+		TargetTable:     ev.TargetTable,
+		OnConflict:      ev.OnConflict,
+		KeyColumn:       ev.KeyColumn,
+		Steps:           steps,
+		TrackCursor:     ev.TrackCursor,
+	}
+}
+
+func (e *eventV1) toEvent() *StreamrEvent {
+	values := valuesFromV1(e.Values)
+
+	var steps []*Step
+	for _, step := range e.Steps {
+		results := make([]*StepResult, len(step.Results))
+		for i, r := range step.Results {
+			results[i] = &StepResult{Param: r.Param, Step: r.Step, Column: r.Column}
+		}
+		steps = append(steps, &Step{
+			Procedure: step.Procedure,
+			Values:    valuesFromV1(step.Values),
+			Results:   results,
+		})
+	}
+
+	return &StreamrEvent{
+		Values:          values,
+		TargetDBID:      e.TargetDBID,
+		TargetProcedure: e.TargetProcedure,
+		Timestamp:       e.Timestamp,
+		SequenceID:      e.SequenceID,
+		MsgChainID:      e.MsgChainID,
+		AggregateKey:    e.AggregateKey,
+		ElementIndex:    e.ElementIndex,
+		IsElement:       e.IsElement,
+		StreamID:        e.StreamID,
+		Partition:       e.Partition,
+		PublisherID:     e.PublisherID,
+		IDVersion:       e.IDVersion,
+		ReplayRetention: e.ReplayRetention,
+		Ordering:        e.Ordering,
+		LateProcedure:   e.LateProcedure,
+		RecordFailures:  e.RecordFailures,
+		Shadow:          e.Shadow,
+		ShadowProcedure: e.ShadowProcedure,
+		TargetTable:     e.TargetTable,
+		OnConflict:      e.OnConflict,
+		KeyColumn:       e.KeyColumn,
+		Steps:           steps,
+		TrackCursor:     e.TrackCursor,
+	}
+}
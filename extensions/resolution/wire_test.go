@@ -0,0 +1,315 @@
+package resolution
+
+import (
+	"encoding"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// update rewrites the golden vectors. It must only be used when adding a
+// new vector: the encoding of an existing vector must never change.
+var update = flag.Bool("update", false, "write missing golden vectors")
+
+// versioned is a value that can be encoded with any wire version.
+type versioned interface {
+	MarshalVersion(WireVersion) ([]byte, error)
+	encoding.BinaryUnmarshaler
+}
+
+func testEvent() *StreamrEvent {
+	return &StreamrEvent{
+		Values: []*ParamValue{
+			{Param: "latitude", Value: "44.88"},
+			{Param: "tags", ValueArray: []string{"a", ""}, IsArray: true},
+			{Param: "temp", Value: "30"},
+		},
+		TargetDBID:      "x97e26ddf8405e1d0eb508f9dd622c41d84377420d65f094d96f3dddb",
+		TargetProcedure: "write_temp",
+		Timestamp:       1718146494844,
+		SequenceID:      3,
+		MsgChainID:      "chain1",
+	}
+}
+
+func testFullEvent() *StreamrEvent {
+	ev := testEvent()
+	ev.StreamID = "0xabc/weather"
+	ev.Partition = 2
+	ev.PublisherID = "0xdef"
+	ev.ElementIndex = 1
+	ev.IsElement = true
+	ev.IDVersion = IDVersion1
+	return ev
+}
+
+func testAggregateEvent() *StreamrEvent {
+	return &StreamrEvent{
+		Values: []*ParamValue{
+			{Param: "count", Value: "2"},
+			{Param: "window_start", Value: "1718146440000"},
+		},
+		TargetDBID:      "x97e26ddf8405e1d0eb508f9dd622c41d84377420d65f094d96f3dddb",
+		TargetProcedure: "write_agg",
+		Timestamp:       1718146440000,
+		AggregateKey:    "device=1",
+		StreamID:        "0xabc/weather",
+		IDVersion:       IDVersion1,
+	}
+}
+
+func Test_WireGolden(t *testing.T) {
+	type testcase struct {
+		// name is the name of the golden file in testdata.
+		name    string
+		version WireVersion
+		value   versioned
+		// decoded is a new value to decode the golden vector into.
+		decoded versioned
+	}
+
+	tests := []testcase{
+		{
+			// this vector was produced by the original release, before
+			// the wire format was versioned.
+			name:    "v0_event",
+			version: WireVersionLegacy,
+			value:   testEvent(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v0_event_full",
+			version: WireVersionLegacy,
+			value:   testFullEvent(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v0_batch",
+			version: WireVersionLegacy,
+			value:   &StreamrBatch{Events: []*StreamrEvent{testEvent(), testAggregateEvent()}},
+			decoded: &StreamrBatch{},
+		},
+		{
+			name:    "v1_event",
+			version: WireVersion1,
+			value:   testEvent(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_full",
+			version: WireVersion1,
+			value:   testFullEvent(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_replay",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.ReplayRetention = 3600000
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_ordering",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.Ordering = OrderingLate
+				ev.LateProcedure = "write_late"
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_failures",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.RecordFailures = true
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_shadow",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.Shadow = true
+				ev.ShadowProcedure = "write_shadow"
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_sink",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.TargetProcedure = ""
+				ev.TargetTable = "records"
+				ev.OnConflict = ConflictUpdate
+				ev.KeyColumn = "id"
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_steps",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.TargetProcedure = ""
+				ev.Values = nil
+				ev.Steps = []*Step{
+					{
+						Procedure: "write_raw",
+						Values:    []*ParamValue{{Param: "temp", Value: "30"}},
+					},
+					{
+						Procedure: "bump_summary",
+						Values:    []*ParamValue{{Param: "tags", ValueArray: []string{"a"}, IsArray: true}},
+						Results:   []*StepResult{{Param: "raw_id", Step: 0, Column: "id"}},
+					},
+				}
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_cursor",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testFullEvent()
+				ev.TrackCursor = true
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_event_optional",
+			version: WireVersion1,
+			value: func() *StreamrEvent {
+				ev := testEvent()
+				ev.Values = append(ev.Values,
+					&ParamValue{Param: "humidity", IsNull: true},
+					&ParamValue{Param: "pressure", Value: "0", Defaulted: true},
+				)
+				return ev
+			}(),
+			decoded: &StreamrEvent{},
+		},
+		{
+			name:    "v1_batch",
+			version: WireVersion1,
+			value:   &StreamrBatch{Events: []*StreamrEvent{testEvent(), testAggregateEvent()}},
+			decoded: &StreamrBatch{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bts, err := tt.value.MarshalVersion(tt.version)
+			require.NoError(t, err)
+
+			path := filepath.Join("testdata", tt.name+".hex")
+			golden, err := os.ReadFile(path)
+			if os.IsNotExist(err) && *update {
+				require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString(bts)+"\n"), 0644))
+				golden = []byte(hex.EncodeToString(bts))
+			} else {
+				require.NoError(t, err)
+			}
+
+			want, err := hex.DecodeString(strings.TrimSpace(string(golden)))
+			require.NoError(t, err)
+
+			require.Equal(t, want, bts, "encoding does not match golden vector")
+
+			// decoding and re-encoding must give back the same bytes.
+			// the decoded value is not compared directly, since RLP
+			// decodes nil slices as empty slices.
+			require.NoError(t, tt.decoded.UnmarshalBinary(want))
+			again, err := tt.decoded.MarshalVersion(tt.version)
+			require.NoError(t, err)
+			require.Equal(t, want, again)
+		})
+	}
+}
+
+func Test_WireDecode(t *testing.T) {
+	ev := testFullEvent()
+
+	// the default encoding is the latest version
+	bts, err := ev.MarshalBinary()
+	require.NoError(t, err)
+	latest, err := ev.MarshalVersion(LatestWireVersion)
+	require.NoError(t, err)
+	require.Equal(t, latest, bts)
+
+	// a batch cannot be decoded as an event, and vice versa
+	batch, err := (&StreamrBatch{Events: []*StreamrEvent{ev}}).MarshalBinary()
+	require.NoError(t, err)
+	require.Error(t, (&StreamrEvent{}).UnmarshalBinary(batch))
+	require.Error(t, (&StreamrBatch{}).UnmarshalBinary(bts))
+
+	// fields added after the legacy version cannot be encoded with it
+	replay := testFullEvent()
+	replay.ReplayRetention = 1
+	_, err = replay.MarshalVersion(WireVersionLegacy)
+	require.Error(t, err)
+
+	optional := testEvent()
+	optional.Values = append(optional.Values, &ParamValue{Param: "humidity", IsNull: true})
+	_, err = optional.MarshalVersion(WireVersionLegacy)
+	require.Error(t, err)
+
+	// unknown versions are rejected
+	_, err = ev.MarshalVersion(LatestWireVersion + 1)
+	require.Error(t, err)
+
+	unknown := append([]byte{}, bts...)
+	unknown[len(wireMagic)] = byte(LatestWireVersion + 1)
+	require.Error(t, (&StreamrEvent{}).UnmarshalBinary(unknown))
+}
+
+func Test_AllowProposalGolden(t *testing.T) {
+	// targets are normalized, so that validators that list them
+	// differently propose identical bodies
+	p := &AllowProposal{
+		StreamID:   "0xabc/weather",
+		TargetDBID: "x97e26ddf8405e1d0eb508f9dd622c41d84377420d65f094d96f3dddb",
+		Targets:    []string{"Write_Temp", "write_late", "write_temp"},
+	}
+	bts, err := p.MarshalBinary()
+	require.NoError(t, err)
+
+	path := filepath.Join("testdata", "v1_allow.hex")
+	golden, err := os.ReadFile(path)
+	if os.IsNotExist(err) && *update {
+		require.NoError(t, os.WriteFile(path, []byte(hex.EncodeToString(bts)+"\n"), 0644))
+		golden = []byte(hex.EncodeToString(bts))
+	} else {
+		require.NoError(t, err)
+	}
+
+	want, err := hex.DecodeString(strings.TrimSpace(string(golden)))
+	require.NoError(t, err)
+	require.Equal(t, want, bts, "encoding does not match golden vector")
+
+	decoded := &AllowProposal{}
+	require.NoError(t, decoded.UnmarshalBinary(want))
+	require.Equal(t, []string{"write_late", "write_temp"}, decoded.Targets)
+
+	// an allow proposal cannot be decoded from an event
+	ev, err := testFullEvent().MarshalBinary()
+	require.NoError(t, err)
+	require.Error(t, (&AllowProposal{}).UnmarshalBinary(ev))
+}
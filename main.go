@@ -5,7 +5,10 @@ import (
 	"os"
 
 	"github.com/kwilteam/kwil-db/cmd/kwild/root"
+
+	"github.com/kwilteam/kwil-streamr/cmd"
 	"github.com/kwilteam/kwil-streamr/extensions"
+	"github.com/kwilteam/kwil-streamr/extensions/listener"
 )
 
 func init() {
@@ -16,7 +19,16 @@ func init() {
 }
 
 func main() {
-	if err := root.RootCmd().Execute(); err != nil {
+	rootCmd := root.RootCmd()
+	rootCmd.AddCommand(cmd.NewStreamrCmd())
+
+	// the listener reads the committed cursor from the node's database,
+	// so it is given the database config that kwild starts with, once
+	// the flags are parsed.
+	listener.SetNodeDatabase(func() (*listener.NodeDatabase, error) {
+		return cmd.NodeDatabase(rootCmd)
+	})
+	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}